@@ -11,14 +11,16 @@ import (
 	"path"
 	"time"
 
+	"agent/common"
 	ahttp "agent/common/http"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	version     = "0.1.3"
-	httpTimeout = 10 * time.Second
+	version        = "0.1.3"
+	httpTimeout    = 10 * time.Second
+	maxPollBackoff = 30 * time.Minute
 )
 
 type AgentArguments struct {
@@ -45,11 +47,28 @@ type Agent struct {
 
 	scriptFileMD5     string
 	scriptFileContent []byte
+
+	selfUpdater *selfUpdater
+
+	pollScheduler *common.PollScheduler
 }
 
 type UpdateConfig struct {
-	MD5 string `json:"md5"`
-	URL string `json:"url"`
+	MD5     string `json:"md5"`
+	URL     string `json:"url"`
+	Version string `json:"version"`
+	// allow the agent update to lower version
+	Force bool `json:"force,omitempty"`
+}
+
+// httpStatusError the server response with unexpected status code
+type httpStatusError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.msg
 }
 
 func New(args *AgentArguments) (*Agent, error) {
@@ -68,6 +87,8 @@ func New(args *AgentArguments) (*Agent, error) {
 		args:         args,
 		baseInfo:     NewBaseInfo(&agentInfo, nil),
 	}
+	agent.selfUpdater = newSelfUpdater(agent)
+	agent.pollScheduler = common.NewPollScheduler("agent", time.Second*time.Duration(args.ScriptInvterval), maxPollBackoff)
 
 	// err := os.MkdirAll(args.WorkingDir, os.ModePerm)
 	// if err != nil {
@@ -81,33 +102,41 @@ func (a *Agent) Version() string {
 	return a.agentVersion
 }
 
+// SetPollInterval change the interval to poll server, used by config reload
+func (a *Agent) SetPollInterval(interval time.Duration) {
+	a.pollScheduler.SetInterval(interval)
+}
+
 func (a *Agent) Run(ctx context.Context) error {
+	a.selfUpdater.checkPending()
+
 	a.loadLocal()
 	a.updateScriptFromServer()
 	a.renewScript()
 
-	scriptUpdateinterval := time.Second * time.Duration(a.args.ScriptInvterval)
-	ticker := time.NewTicker(scriptUpdateinterval)
-	scriptUpdateTime := time.Now()
+	// the cached script keep running when server can not reach
+	timer := time.NewTimer(a.pollScheduler.Next())
 	loop := true
-	defer ticker.Stop()
+	defer timer.Stop()
 
 	for loop {
 		script := a.currentScript()
 		select {
 		case ev := <-script.Events():
 			script.HandleEvent(ev)
-		case <-ticker.C:
-			elapsed := time.Since(scriptUpdateTime)
-			if elapsed > scriptUpdateinterval {
-				a.updateScriptFromServer()
-
-				if a.scriptFileMD5 != script.fileMD5 {
-					a.renewScript()
-				}
+		case <-timer.C:
+			a.updateScriptFromServer()
 
-				scriptUpdateTime = time.Now()
+			if a.scriptFileMD5 != script.fileMD5 {
+				a.renewScript()
 			}
+
+			a.selfUpdater.checkUpdate()
+
+			timer.Reset(a.pollScheduler.Next())
+		case <-a.selfUpdater.graceTimeout():
+			log.Errorf("new version %s can not reach server in %s", a.agentVersion, selfUpdateGracePeriod)
+			a.selfUpdater.rollback()
 		case <-ctx.Done():
 			script.Stop()
 			log.Info("ctx done, Run() will quit")
@@ -120,11 +149,18 @@ func (a *Agent) Run(ctx context.Context) error {
 
 func (a *Agent) updateScriptFromServer() {
 	log.Info("updateScriptFromServer")
-	updateConfig, err := a.getUpdateConfigFromServer()
+	updateConfig, hint, err := a.getUpdateConfigFromServer("/update/lua")
+	a.pollScheduler.SetHint(hint)
 	if err != nil {
+		a.pollScheduler.Failure()
 		log.Errorf("updateScriptFromServer get update config: %s", err.Error())
 		return
 	}
+	a.pollScheduler.Success()
+
+	// new version reach server, commit it
+	a.selfUpdater.serverReached()
+
 	if a.scriptFileMD5 == updateConfig.MD5 {
 		return
 	}
@@ -176,17 +212,22 @@ func (a *Agent) loadLocal() {
 	a.scriptFileMD5 = fmt.Sprintf("%x", md5.Sum(b))
 }
 
-func (a *Agent) getUpdateConfigFromServer() (*UpdateConfig, error) {
+// getUpdateConfigFromServer return the update config and the retry hint of server,
+// the hint is for the caller's poll only
+func (a *Agent) getUpdateConfigFromServer(uri string) (*UpdateConfig, time.Duration, error) {
 	devInfoQuery := a.baseInfo.ToURLQuery()
+	if d := a.pollScheduler.OfflineDuration(); d > 0 {
+		devInfoQuery.Set("offlineSeconds", fmt.Sprintf("%d", int64(d.Seconds())))
+	}
 
-	url := fmt.Sprintf("%s/update/lua?%s", a.args.ServerURL, devInfoQuery.Encode())
+	url := fmt.Sprintf("%s%s?%s", a.args.ServerURL, uri, devInfoQuery.Encode())
 
 	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	client := &http.Client{
@@ -196,27 +237,32 @@ func (a *Agent) getUpdateConfigFromServer() (*UpdateConfig, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
 
+	hint := common.ParseRetryHint(resp.Header)
+
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("getScriptInfoFromServer status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+		return nil, hint, &httpStatusError{
+			StatusCode: resp.StatusCode,
+			msg:        fmt.Sprintf("getScriptInfoFromServer status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url),
+		}
 	}
 
 	// Read and handle the response
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	updateConfig := &UpdateConfig{}
 	err = json.Unmarshal(body, updateConfig)
 	if err != nil {
-		return nil, nil
+		return nil, 0, err
 	}
-	return updateConfig, nil
+	return updateConfig, hint, nil
 }
 
 func (a *Agent) getScriptFromServer(url string) ([]byte, error) {
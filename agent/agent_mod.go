@@ -29,10 +29,11 @@ const ExecTimeout = 10
 
 type AgentModule struct {
 	baseInfo *lua.LTable
+	owner    *Script
 }
 
-func newAgentModule(devInfo *lua.LTable) *AgentModule {
-	am := &AgentModule{baseInfo: devInfo}
+func newAgentModule(devInfo *lua.LTable, owner *Script) *AgentModule {
+	am := &AgentModule{baseInfo: devInfo, owner: owner}
 
 	return am
 }
@@ -51,6 +52,8 @@ func (am *AgentModule) loader(L *lua.LState) int {
 		"exec":           am.exec,
 		"runBashCmd":     am.runBashCmd,
 		"request":        am.request,
+		"ready":          am.ready,
+		"health":         am.health,
 	}
 
 	mod := L.SetFuncs(L.NewTable(), exports)
@@ -98,6 +101,10 @@ func fileMD5(filePath string) (string, error) {
 
 func (am *AgentModule) info(L *lua.LState) int {
 	if am.baseInfo != nil {
+		// the token is renewed by controller after the table created
+		if am.owner != nil && am.owner.baseInfo != nil {
+			am.baseInfo.RawSetString("token", lua.LString(am.owner.baseInfo.GetToken()))
+		}
 		L.Push(am.baseInfo)
 		return 1
 	}
@@ -114,6 +121,41 @@ func (am *AgentModule) info(L *lua.LState) int {
 	// return 1
 }
 
+// ready lua agent.ready(), tell controller the app is healthy, the new config is committed after it
+func (am *AgentModule) ready(L *lua.LState) int {
+	am.owner.markReady()
+	return 0
+}
+
+// health lua agent.health([name]), return the results of health checks in app config by name,
+// or the result of the named check, nil if not exist
+func (am *AgentModule) health(L *lua.LState) int {
+	name := L.OptString(1, "")
+
+	var results []HealthResult
+	if am.owner.healthChecker != nil {
+		results = am.owner.healthChecker.Results()
+	}
+
+	if len(name) > 0 {
+		for i := range results {
+			if results[i].Name == name {
+				L.Push(results[i].ToLuaTable(L))
+				return 1
+			}
+		}
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	t := L.NewTable()
+	for i := range results {
+		t.RawSetString(results[i].Name, results[i].ToLuaTable(L))
+	}
+	L.Push(t)
+	return 1
+}
+
 func (am *AgentModule) extract7z(L *lua.LState) int {
 	filePath := L.CheckString(1)
 	outputDir := L.OptString(2, filepath.Dir(filePath))
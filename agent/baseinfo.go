@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -77,6 +79,8 @@ type BaseInfo struct {
 
 	netIRate float64
 	netORate float64
+	// json of []InterfaceRate
+	netInterfaces string
 
 	baseboard string
 
@@ -87,11 +91,15 @@ type BaseInfo struct {
 	totalDisk int64
 	freeDisk  int64
 	diskModel string
+	// json of []DiskMount
+	disks string
 
 	agentInfo *AgentInfo
 
 	appInfo *AppInfo
 
+	// the fields below are updated by the collectors while the reporters read them
+	mu        sync.RWMutex
 	webServer string
 	token     string
 }
@@ -336,23 +344,45 @@ func runCmd(command string) (string, error) {
 }
 
 func (baseInfo *BaseInfo) getDiskUsage() {
-	var workingDir string
+	var workingDir, appsDir string
 	if baseInfo.agentInfo != nil && len(baseInfo.agentInfo.WorkingDir) > 0 {
 		workingDir = baseInfo.agentInfo.WorkingDir
 	} else if baseInfo.appInfo != nil && len(baseInfo.appInfo.WorkingDir) > 0 {
 		workingDir = baseInfo.appInfo.WorkingDir
+		appsDir = baseInfo.appInfo.AppRootDir
 	}
 
+	var usage *disk.UsageStat
 	if len(workingDir) > 0 {
-		usage, err := disk.Usage(workingDir)
-		if err == nil {
-			baseInfo.totalDisk = int64(usage.Total)
-			baseInfo.freeDisk = int64(usage.Free)
+		var err error
+		if usage, err = disk.Usage(workingDir); err != nil {
+			usage = nil
 		}
 	}
+
+	disks, err := json.Marshal(GetDiskMounts(workingDir, appsDir))
+
+	baseInfo.mu.Lock()
+	defer baseInfo.mu.Unlock()
+
+	if usage != nil {
+		baseInfo.totalDisk = int64(usage.Total)
+		baseInfo.freeDisk = int64(usage.Free)
+	}
+	if err == nil {
+		baseInfo.disks = string(disks)
+	}
+}
+
+// RefreshDiskUsage update the usage of working dir and mounts
+func (baseInfo *BaseInfo) RefreshDiskUsage() {
+	baseInfo.getDiskUsage()
 }
 
 func (baseInfo *BaseInfo) ToURLQuery() url.Values {
+	baseInfo.mu.RLock()
+	defer baseInfo.mu.RUnlock()
+
 	query := url.Values{}
 	query.Add("hostname", baseInfo.hostName)
 	query.Add("os", baseInfo.os)
@@ -378,6 +408,9 @@ func (baseInfo *BaseInfo) ToURLQuery() url.Values {
 
 	query.Add("netIRate", fmt.Sprintf("%f", baseInfo.netIRate))
 	query.Add("netORate", fmt.Sprintf("%f", baseInfo.netORate))
+	if len(baseInfo.netInterfaces) > 0 {
+		query.Add("netInterfaces", baseInfo.netInterfaces)
+	}
 
 	query.Add("baseboard", baseInfo.baseboard)
 
@@ -388,6 +421,9 @@ func (baseInfo *BaseInfo) ToURLQuery() url.Values {
 	query.Add("totalDisk", fmt.Sprintf("%d", baseInfo.totalDisk))
 	query.Add("freeDisk", fmt.Sprintf("%d", baseInfo.freeDisk))
 	query.Add("diskModel", baseInfo.diskModel)
+	if len(baseInfo.disks) > 0 {
+		query.Add("disks", baseInfo.disks)
+	}
 
 	if baseInfo.agentInfo != nil {
 		query.Add("version", baseInfo.agentInfo.Version)
@@ -405,6 +441,9 @@ func (baseInfo *BaseInfo) ToURLQuery() url.Values {
 }
 
 func (baseInfo *BaseInfo) ToLuaTable(L *lua.LState) *lua.LTable {
+	baseInfo.mu.RLock()
+	defer baseInfo.mu.RUnlock()
+
 	t := L.NewTable()
 	t.RawSet(lua.LString("hostname"), lua.LString(baseInfo.hostName))
 	t.RawSet(lua.LString("os"), lua.LString(baseInfo.os))
@@ -467,31 +506,62 @@ func (baseInfo *BaseInfo) ToLuaTable(L *lua.LState) *lua.LTable {
 	return t
 }
 
+// AppDir return the app dir, empty if not running as an app
+func (baseInfo *BaseInfo) AppDir() string {
+	if baseInfo.appInfo != nil {
+		return baseInfo.appInfo.AppDir
+	}
+	return ""
+}
+
 func (baseInfo *BaseInfo) UUID() string {
 	return baseInfo.uuid
 }
 
 func (baseInfo *BaseInfo) SetTraffice(n NetworkStatsRate) {
+	interfaces, err := json.Marshal(n.Interfaces)
+
+	baseInfo.mu.Lock()
+	defer baseInfo.mu.Unlock()
+
 	baseInfo.netIRate = n.IRate
 	baseInfo.netORate = n.ORate
+	if err == nil {
+		baseInfo.netInterfaces = string(interfaces)
+	}
 }
 
 func (b *BaseInfo) SetCpuUsage(cpuUsage float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	b.cpuUsage = cpuUsage
 }
 func (b *BaseInfo) SetWebServer(webServer string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	b.webServer = webServer
 }
 
 func (b *BaseInfo) GetWebServer() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	return b.webServer
 }
 
 func (b *BaseInfo) SetToken(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	b.token = token
 }
 
 func (b *BaseInfo) GetToken() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	return b.token
 }
 
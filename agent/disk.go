@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaypipes/ghw"
+	"github.com/shirou/gopsutil/v3/disk"
+	log "github.com/sirupsen/logrus"
+)
+
+// the file systems that not backed by a disk, or read only images
+var pseudoFstypes = map[string]bool{
+	"tmpfs": true, "devtmpfs": true, "ramfs": true, "overlay": true, "aufs": true,
+	"squashfs": true, "iso9660": true, "udf": true, "autofs": true, "proc": true,
+	"sysfs": true, "cgroup": true, "cgroup2": true, "nsfs": true, "fuse.lxcfs": true,
+	"devfs": true, "nullfs": true,
+}
+
+// the mounts of os, snap packages and containers
+var ignoreMountPrefixes = []string{
+	"/boot", "/snap", "/run", "/sys", "/proc", "/dev", "/var/lib/docker",
+	"/System/Volumes/VM", "/System/Volumes/Preboot", "/System/Volumes/Update", "/System/Volumes/xarts",
+	"/System/Volumes/iSCPreboot", "/System/Volumes/Hardware",
+}
+
+// DiskMount the usage of a mounted file system and the disk behind it
+type DiskMount struct {
+	Mountpoint string `json:"mountpoint"`
+	Device     string `json:"device"`
+	Fstype     string `json:"fstype"`
+	Total      uint64 `json:"total"`
+	Free       uint64 `json:"free"`
+
+	Model      string `json:"model,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Rotational bool   `json:"rotational"`
+
+	// the mount holds the working dir or the apps dir
+	WorkingDir bool `json:"workingDir,omitempty"`
+	Apps       bool `json:"apps,omitempty"`
+}
+
+// GetDiskMounts return the mounts of disks, the working dir and apps dir are marked.
+// The apps dir is the working dir if empty
+func GetDiskMounts(workingDir, appsDir string) []DiskMount {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		log.Errorf("GetDiskMounts get partitions: %v", err)
+		return nil
+	}
+
+	mounts := make([]DiskMount, 0, len(partitions))
+	for _, p := range partitions {
+		if pseudoFstypes[p.Fstype] || isIgnoredMount(p.Mountpoint) {
+			continue
+		}
+
+		usage, err := disk.Usage(p.Mountpoint)
+		if err != nil || usage.Total == 0 {
+			continue
+		}
+
+		mounts = append(mounts, DiskMount{
+			Mountpoint: p.Mountpoint,
+			Device:     p.Device,
+			Fstype:     p.Fstype,
+			Total:      usage.Total,
+			Free:       usage.Free,
+		})
+	}
+
+	mounts = markDiskMounts(mounts, workingDir, appsDir)
+	fillDiskModels(mounts)
+	return mounts
+}
+
+func isIgnoredMount(mountpoint string) bool {
+	for _, prefix := range ignoreMountPrefixes {
+		if mountContains(prefix, mountpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// markDiskMounts mark the mounts of working dir and apps dir, then drop the bind mounts
+// that share the device with another mount, the one with shortest mountpoint is kept
+func markDiskMounts(mounts []DiskMount, workingDir, appsDir string) []DiskMount {
+	if len(appsDir) == 0 {
+		appsDir = workingDir
+	}
+
+	workingDevice := mountOf(mounts, workingDir)
+	appsDevice := mountOf(mounts, appsDir)
+
+	sort.SliceStable(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) < len(mounts[j].Mountpoint) })
+
+	seen := make(map[string]bool)
+	result := make([]DiskMount, 0, len(mounts))
+	for _, m := range mounts {
+		if seen[m.Device] {
+			continue
+		}
+		seen[m.Device] = true
+
+		m.WorkingDir = len(workingDevice) > 0 && m.Device == workingDevice
+		m.Apps = len(appsDevice) > 0 && m.Device == appsDevice
+		result = append(result, m)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Mountpoint < result[j].Mountpoint })
+	return result
+}
+
+// mountOf return the device of the mount that dir is on, the longest mountpoint wins
+func mountOf(mounts []DiskMount, dir string) string {
+	if len(dir) == 0 {
+		return ""
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	var device, mountpoint string
+	for _, m := range mounts {
+		if mountContains(m.Mountpoint, dir) && len(m.Mountpoint) >= len(mountpoint) {
+			device, mountpoint = m.Device, m.Mountpoint
+		}
+	}
+	return device
+}
+
+// mountContains check if p is under mountpoint
+func mountContains(mountpoint, p string) bool {
+	if runtime.GOOS == "windows" {
+		mountpoint, p = strings.ToLower(mountpoint), strings.ToLower(p)
+	}
+
+	if p == mountpoint {
+		return true
+	}
+	if !strings.HasSuffix(mountpoint, string(filepath.Separator)) {
+		mountpoint += string(filepath.Separator)
+	}
+	return strings.HasPrefix(p, mountpoint)
+}
+
+// the disks rarely change, the block topology is cached so the usage refresh
+// does not scan all the block devices every time
+const blockCacheTTL = time.Hour
+
+var blockCache struct {
+	mu           sync.Mutex
+	updatedAt    time.Time
+	byMountpoint map[string]*ghw.Disk
+	byName       map[string]*ghw.Disk
+}
+
+// blockDisks return the disks by mountpoint and by the name of disk or partition
+func blockDisks() (map[string]*ghw.Disk, map[string]*ghw.Disk, error) {
+	blockCache.mu.Lock()
+	defer blockCache.mu.Unlock()
+
+	if blockCache.byName != nil && time.Since(blockCache.updatedAt) < blockCacheTTL {
+		return blockCache.byMountpoint, blockCache.byName, nil
+	}
+
+	blk, err := ghw.Block(ghw.WithDisableWarnings())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byMountpoint := make(map[string]*ghw.Disk)
+	byName := make(map[string]*ghw.Disk)
+	for _, d := range blk.Disks {
+		byName[d.Name] = d
+		for _, p := range d.Partitions {
+			byName[p.Name] = d
+			if len(p.MountPoint) > 0 {
+				byMountpoint[p.MountPoint] = d
+			}
+		}
+	}
+
+	blockCache.byMountpoint, blockCache.byName, blockCache.updatedAt = byMountpoint, byName, time.Now()
+	return byMountpoint, byName, nil
+}
+
+// fillDiskModels find the disks behind the mounts
+func fillDiskModels(mounts []DiskMount) {
+	byMountpoint, byName, err := blockDisks()
+	if err != nil {
+		log.Errorf("fillDiskModels get block info: %v", err)
+		return
+	}
+
+	for i := range mounts {
+		d := byMountpoint[mounts[i].Mountpoint]
+		if d == nil {
+			d = diskOfDevice(byName, mounts[i].Device)
+		}
+		if d == nil {
+			continue
+		}
+
+		mounts[i].Model = validHardwareID(d.Model)
+		mounts[i].Serial = validHardwareID(d.SerialNumber)
+		mounts[i].Rotational = d.DriveType == ghw.DriveTypeHDD
+	}
+}
+
+// diskOfDevice find the disk of device, the device mapper of lvm or luks is resolved to its first slave on linux
+func diskOfDevice(byName map[string]*ghw.Disk, device string) *ghw.Disk {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+
+	name := filepath.Base(device)
+	if d := byName[name]; d != nil {
+		return d
+	}
+
+	slaves, err := os.ReadDir(filepath.Join("/sys/block", name, "slaves"))
+	if err != nil || len(slaves) == 0 {
+		return nil
+	}
+	return diskOfDevice(byName, slaves[0].Name())
+}
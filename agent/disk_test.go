@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestMarkDiskMounts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix mountpoints")
+	}
+
+	mounts := []DiskMount{
+		{Mountpoint: "/data", Device: "/dev/sdb1", Total: 4 << 40, Free: 3 << 40},
+		{Mountpoint: "/", Device: "/dev/sda2", Total: 64 << 30, Free: 10 << 30},
+		{Mountpoint: "/database", Device: "/dev/sdc1", Total: 1 << 40, Free: 1 << 40},
+		// bind mount of /data
+		{Mountpoint: "/opt/titan/apps", Device: "/dev/sdb1", Total: 4 << 40, Free: 3 << 40},
+	}
+
+	result := markDiskMounts(mounts, "/opt/titan", "/opt/titan/apps")
+	if len(result) != 3 {
+		t.Fatalf("bind mount should be dropped, got %+v", result)
+	}
+
+	for _, m := range result {
+		switch m.Mountpoint {
+		case "/":
+			if !m.WorkingDir || m.Apps {
+				t.Fatalf("/ should hold working dir only: %+v", m)
+			}
+		case "/data":
+			if m.WorkingDir || !m.Apps {
+				t.Fatalf("/data should hold apps dir only: %+v", m)
+			}
+		case "/database":
+			if m.WorkingDir || m.Apps {
+				t.Fatalf("/database holds nothing: %+v", m)
+			}
+		default:
+			t.Fatalf("unexpected mount %s", m.Mountpoint)
+		}
+	}
+
+	// apps dir default to working dir
+	result = markDiskMounts(mounts, "/data/titan", "")
+	for _, m := range result {
+		if m.Mountpoint == "/data" && (!m.WorkingDir || !m.Apps) {
+			t.Fatalf("/data should hold working dir and apps dir: %+v", m)
+		}
+	}
+}
+
+func TestBaseInfoConcurrentRefresh(t *testing.T) {
+	b := &BaseInfo{appInfo: &AppInfo{ControllerInfo: ControllerInfo{WorkingDir: t.TempDir()}}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			b.RefreshDiskUsage()
+			b.SetTraffice(NetworkStatsRate{IRate: float64(i)})
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		b.ToURLQuery()
+	}
+	<-done
+
+	if b.ToURLQuery().Get("netIRate") != "19.000000" {
+		t.Fatalf("unexpected netIRate %s", b.ToURLQuery().Get("netIRate"))
+	}
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"agent/common"
 	ahttp "agent/common/http"
 	"context"
 	"fmt"
@@ -181,7 +182,7 @@ func (downloader *Downloader) donwloadFile(filePath, url string) error {
 	}
 	defer file.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	_, err = io.Copy(file, common.DownloadRateLimiter.Reader(downloader.ctx, resp.Body))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"agent/common"
+
+	"github.com/jaypipes/ghw"
+	"github.com/shirou/gopsutil/v3/cpu"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	fingerprintOnce sync.Once
+	fingerprint     common.Fingerprint
+)
+
+// HardwareFingerprint collect the fingerprint once, the hardware does not change while running
+func HardwareFingerprint() common.Fingerprint {
+	fingerprintOnce.Do(func() {
+		fingerprint = collectFingerprint()
+		log.Infof("hardware fingerprint: %s", fingerprint.String())
+	})
+	return fingerprint
+}
+
+func collectFingerprint() common.Fingerprint {
+	return common.Fingerprint{
+		common.FingerprintMachineID: common.HashFingerprintComponent(common.FingerprintMachineID, getMachineID()),
+		common.FingerprintBoardUUID: common.HashFingerprintComponent(common.FingerprintBoardUUID, getBoardUUID()),
+		common.FingerprintMACs:      common.HashFingerprintComponent(common.FingerprintMACs, getPhysicalMACs()),
+		common.FingerprintDisks:     common.HashFingerprintComponent(common.FingerprintDisks, getDiskSerials()),
+		common.FingerprintCPU:       common.HashFingerprintComponent(common.FingerprintCPU, getCPUIdentity()),
+	}
+}
+
+// getMachineID return the id generated by os install
+func getMachineID() string {
+	switch runtime.GOOS {
+	case "linux":
+		for _, file := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+			if b, err := os.ReadFile(file); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+				return strings.TrimSpace(string(b))
+			}
+		}
+		// android has no machine-id
+		androidID, _ := runCmd("settings get secure android_id")
+		return validHardwareID(androidID)
+	case "android":
+		androidID, _ := runCmd("settings get secure android_id")
+		return validHardwareID(androidID)
+	case "windows":
+		out, err := runCmd(`reg query HKLM\SOFTWARE\Microsoft\Cryptography /v MachineGuid`)
+		if err != nil {
+			return ""
+		}
+		fields := strings.Fields(out)
+		if len(fields) == 0 {
+			return ""
+		}
+		return validHardwareID(fields[len(fields)-1])
+	}
+	return ""
+}
+
+var ioPlatformUUIDRegexp = regexp.MustCompile(`"IOPlatformUUID" = "([^"]+)"`)
+
+// getBoardUUID return the DMI system UUID, it is kept after os reinstall
+func getBoardUUID() string {
+	if runtime.GOOS == "darwin" {
+		out, err := runCmd("ioreg -rd1 -c IOPlatformExpertDevice")
+		if err != nil {
+			return ""
+		}
+		if m := ioPlatformUUIDRegexp.FindStringSubmatch(out); m != nil {
+			return validHardwareID(m[1])
+		}
+		return ""
+	}
+
+	product, err := ghw.Product(ghw.WithDisableWarnings())
+	if err != nil {
+		return ""
+	}
+	return validHardwareID(product.UUID)
+}
+
+// getPhysicalMACs return the sorted MACs of physical interfaces,
+// the virtual interfaces change with containers or vms
+func getPhysicalMACs() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	filter := NewInterfaceFilter(nil, nil)
+	macs := make([]string, 0, len(interfaces))
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		if !filter.Match(iface.Name) {
+			continue
+		}
+		macs = append(macs, iface.HardwareAddr.String())
+	}
+
+	sort.Strings(macs)
+	return strings.Join(macs, ",")
+}
+
+// getDiskSerials return the sorted serials of fixed disks
+func getDiskSerials() string {
+	blk, err := ghw.Block(ghw.WithDisableWarnings())
+	if err != nil {
+		return ""
+	}
+
+	serials := make([]string, 0, len(blk.Disks))
+	for _, d := range blk.Disks {
+		if d.IsRemovable {
+			continue
+		}
+		if serial := validHardwareID(d.SerialNumber); len(serial) > 0 {
+			serials = append(serials, serial)
+		}
+	}
+
+	sort.Strings(serials)
+	return strings.Join(serials, ",")
+}
+
+// getCPUIdentity return the vendor, model and count of cpus
+func getCPUIdentity() string {
+	infos, err := cpu.Info()
+	if err != nil || len(infos) == 0 {
+		return ""
+	}
+
+	counts, _ := cpu.Counts(true)
+	return strings.Join([]string{infos[0].VendorID, infos[0].ModelName, strconv.Itoa(counts)}, "|")
+}
+
+// validHardwareID drop the placeholder values of firmware
+func validHardwareID(id string) string {
+	id = strings.TrimSpace(id)
+	switch strings.ToLower(id) {
+	case "", "unknown", "none", "null", "0", "default string", "to be filled by o.e.m.",
+		"00000000-0000-0000-0000-000000000000", "ffffffff-ffff-ffff-ffff-ffffffffffff", "03000200-0400-0500-0006-000700080009":
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,349 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The types of health check
+const (
+	// the processes started by app are alive, target is the process name, any process if empty
+	HealthCheckProcess = "process"
+	// target is host:port
+	HealthCheckTCP = "tcp"
+	// target is url, the status is 2xx or 3xx if expectStatus is 0
+	HealthCheckHTTP = "http"
+	// target is the command line, exit code 0 is healthy
+	HealthCheckCommand = "command"
+)
+
+const (
+	defaultHealthInterval         = 30 * time.Second
+	defaultHealthTimeout          = 5 * time.Second
+	defaultHealthFailureThreshold = 3
+	// the body of http check more than this is not matched
+	maxHealthBodySize = 64 << 10
+	// the output of failed command kept in error
+	maxHealthOutputSize = 256
+)
+
+// HealthCheck a probe of app declared in app config
+type HealthCheck struct {
+	// default to type-index
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type"`
+	Target string `json:"target,omitempty"`
+
+	ExpectStatus int `json:"expectStatus,omitempty"`
+	// regex that the http body must match
+	ExpectBody string `json:"expectBody,omitempty"`
+
+	// seconds
+	Interval int `json:"interval,omitempty"`
+	Timeout  int `json:"timeout,omitempty"`
+	// the consecutive failures to turn unhealthy
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	if hc.Interval > 0 {
+		return time.Duration(hc.Interval) * time.Second
+	}
+	return defaultHealthInterval
+}
+
+func (hc *HealthCheck) timeout() time.Duration {
+	if hc.Timeout > 0 {
+		return time.Duration(hc.Timeout) * time.Second
+	}
+	return defaultHealthTimeout
+}
+
+func (hc *HealthCheck) failureThreshold() int {
+	if hc.FailureThreshold > 0 {
+		return hc.FailureThreshold
+	}
+	return defaultHealthFailureThreshold
+}
+
+// HealthResult the latest result of a health check
+type HealthResult struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Healthy bool   `json:"healthy"`
+	// consecutive failures, reset by success
+	Failures int    `json:"failures"`
+	Error    string `json:"error,omitempty"`
+	// unix time of last check, 0 if not checked yet
+	Time int64 `json:"time"`
+	// milliseconds of last check
+	Latency int64 `json:"latency"`
+}
+
+func (r *HealthResult) ToLuaTable(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	t.RawSet(lua.LString("name"), lua.LString(r.Name))
+	t.RawSet(lua.LString("type"), lua.LString(r.Type))
+	t.RawSet(lua.LString("healthy"), lua.LBool(r.Healthy))
+	t.RawSet(lua.LString("failures"), lua.LNumber(r.Failures))
+	t.RawSet(lua.LString("error"), lua.LString(r.Error))
+	t.RawSet(lua.LString("time"), lua.LNumber(r.Time))
+	t.RawSet(lua.LString("latency"), lua.LNumber(r.Latency))
+	return t
+}
+
+// HealthChecker run the health checks of app independently of the script,
+// it live with the app, so the results are kept across script reload
+type HealthChecker struct {
+	checks []HealthCheck
+	// find the processes started by app
+	tracker *UsageTracker
+
+	lock    sync.Mutex
+	results []HealthResult
+	// notified when any check turn healthy or unhealthy
+	changed chan struct{}
+}
+
+func NewHealthChecker(checks []HealthCheck, tracker *UsageTracker) *HealthChecker {
+	hc := &HealthChecker{
+		checks:  make([]HealthCheck, len(checks)),
+		tracker: tracker,
+		results: make([]HealthResult, len(checks)),
+		changed: make(chan struct{}, 1),
+	}
+
+	for i, check := range checks {
+		if len(check.Name) == 0 {
+			check.Name = fmt.Sprintf("%s-%d", check.Type, i)
+		}
+		hc.checks[i] = check
+		hc.results[i] = HealthResult{Name: check.Name, Type: check.Type, Healthy: true}
+	}
+	return hc
+}
+
+// Run start the checks until ctx done, every check run at its interval
+func (hc *HealthChecker) Run(ctx context.Context) {
+	for i := range hc.checks {
+		go hc.runCheck(ctx, i)
+	}
+}
+
+func (hc *HealthChecker) runCheck(ctx context.Context, i int) {
+	check := &hc.checks[i]
+	ticker := time.NewTicker(check.interval())
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		checkCtx, cancel := context.WithTimeout(ctx, check.timeout())
+		err := hc.probe(checkCtx, check)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+		hc.setResult(i, err, start)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (hc *HealthChecker) setResult(i int, err error, start time.Time) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	check := &hc.checks[i]
+	r := &hc.results[i]
+	r.Time = start.Unix()
+	r.Latency = time.Since(start).Milliseconds()
+
+	if err == nil {
+		if !r.Healthy {
+			log.Infof("health check %s recovered", r.Name)
+			hc.notifyChanged()
+		}
+		r.Healthy, r.Failures, r.Error = true, 0, ""
+		return
+	}
+
+	r.Failures++
+	r.Error = err.Error()
+	if r.Healthy && r.Failures >= check.failureThreshold() {
+		log.Warnf("health check %s unhealthy after %d failures: %s", r.Name, r.Failures, r.Error)
+		r.Healthy = false
+		hc.notifyChanged()
+	}
+}
+
+func (hc *HealthChecker) notifyChanged() {
+	select {
+	case hc.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changed is notified when any check turn healthy or unhealthy
+func (hc *HealthChecker) Changed() <-chan struct{} {
+	return hc.changed
+}
+
+// Results return the latest results in the order of checks
+func (hc *HealthChecker) Results() []HealthResult {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	return append([]HealthResult(nil), hc.results...)
+}
+
+// Healthy check if all checks have run and are healthy, it is true if there is no check
+func (hc *HealthChecker) Healthy() bool {
+	for _, r := range hc.Results() {
+		if !r.Healthy || r.Time == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Unhealthy return the reason of the first unhealthy check, empty if none
+func (hc *HealthChecker) Unhealthy() string {
+	for _, r := range hc.Results() {
+		if !r.Healthy {
+			return fmt.Sprintf("health check %s: %s", r.Name, r.Error)
+		}
+	}
+	return ""
+}
+
+func (hc *HealthChecker) probe(ctx context.Context, check *HealthCheck) error {
+	switch check.Type {
+	case HealthCheckProcess:
+		return hc.probeProcess(check.Target)
+	case HealthCheckTCP:
+		return probeTCP(ctx, check.Target)
+	case HealthCheckHTTP:
+		return probeHTTP(ctx, check)
+	case HealthCheckCommand:
+		return probeCommand(ctx, check.Target)
+	}
+	return fmt.Errorf("unsupported health check type %s", check.Type)
+}
+
+func (hc *HealthChecker) probeProcess(name string) error {
+	if hc.tracker == nil {
+		return fmt.Errorf("no process tracked")
+	}
+
+	procs := hc.tracker.Processes()
+	for _, p := range procs {
+		if len(name) == 0 {
+			return nil
+		}
+		if n, err := p.Name(); err == nil && n == name {
+			return nil
+		}
+	}
+
+	if len(name) == 0 {
+		return fmt.Errorf("no process alive")
+	}
+	return fmt.Errorf("process %s not alive", name)
+}
+
+func probeTCP(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeHTTP(ctx context.Context, check *HealthCheck) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", check.Target, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if check.ExpectStatus > 0 {
+		if resp.StatusCode != check.ExpectStatus {
+			return fmt.Errorf("status %d, expect %d", resp.StatusCode, check.ExpectStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	if len(check.ExpectBody) == 0 {
+		return nil
+	}
+
+	re, err := regexp.Compile(check.ExpectBody)
+	if err != nil {
+		return fmt.Errorf("invalid expectBody: %w", err)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBodySize))
+	if err != nil {
+		return err
+	}
+	if !re.Match(body) {
+		return fmt.Errorf("body not match %s", check.ExpectBody)
+	}
+	return nil
+}
+
+func probeCommand(ctx context.Context, command string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "darwin", "android":
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	case "windows":
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", command)
+	default:
+		return fmt.Errorf("unsupported os")
+	}
+	// the children holding the output pipes do not block the check after timeout
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	// the command exit 0, only its children still hold the pipes
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	if err != nil {
+		out := strings.TrimSpace(string(output))
+		if len(out) > maxHealthOutputSize {
+			out = out[:maxHealthOutputSize]
+		}
+		if len(out) > 0 {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
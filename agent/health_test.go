@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckThreshold(t *testing.T) {
+	hc := NewHealthChecker([]HealthCheck{{Type: HealthCheckTCP, FailureThreshold: 2}}, nil)
+
+	results := hc.Results()
+	if results[0].Name != "tcp-0" || !results[0].Healthy {
+		t.Fatalf("unexpected initial result %+v", results[0])
+	}
+
+	hc.setResult(0, fmt.Errorf("refused"), time.Now())
+	if !hc.Healthy() {
+		t.Fatalf("should be healthy before threshold")
+	}
+
+	hc.setResult(0, fmt.Errorf("refused"), time.Now())
+	if hc.Healthy() {
+		t.Fatalf("should be unhealthy after threshold")
+	}
+	if r := hc.Results()[0]; r.Failures != 2 || r.Error != "refused" {
+		t.Fatalf("unexpected result %+v", r)
+	}
+
+	hc.setResult(0, nil, time.Now())
+	if r := hc.Results()[0]; !r.Healthy || r.Failures != 0 || len(r.Error) > 0 {
+		t.Fatalf("success should reset the result %+v", r)
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	type probeCase struct {
+		check   HealthCheck
+		healthy bool
+	}
+
+	hc := NewHealthChecker(nil, nil)
+	cases := []probeCase{
+		{HealthCheck{Type: HealthCheckHTTP, Target: srv.URL, ExpectBody: `"status":"ok"`}, true},
+		{HealthCheck{Type: HealthCheckHTTP, Target: srv.URL, ExpectBody: `"status":"error"`}, false},
+		{HealthCheck{Type: HealthCheckHTTP, Target: srv.URL + "/down"}, false},
+		{HealthCheck{Type: HealthCheckHTTP, Target: srv.URL + "/down", ExpectStatus: http.StatusServiceUnavailable}, true},
+		{HealthCheck{Type: HealthCheckTCP, Target: srv.Listener.Addr().String()}, true},
+		{HealthCheck{Type: HealthCheckTCP, Target: addr}, false},
+		{HealthCheck{Type: HealthCheckProcess}, false},
+		{HealthCheck{Type: "unknown"}, false},
+	}
+	if runtime.GOOS != "windows" {
+		cases = append(cases,
+			probeCase{HealthCheck{Type: HealthCheckCommand, Target: "exit 0"}, true},
+			probeCase{HealthCheck{Type: HealthCheckCommand, Target: "echo broken; exit 1"}, false},
+		)
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := hc.probe(ctx, &c.check)
+		cancel()
+
+		if (err == nil) != c.healthy {
+			t.Fatalf("%s %s: expect healthy %v, got %v", c.check.Type, c.check.Target, c.healthy, err)
+		}
+	}
+}
+
+func TestHealthCheckerChanged(t *testing.T) {
+	hc := NewHealthChecker([]HealthCheck{{Name: "api", Type: HealthCheckTCP, FailureThreshold: 1}}, nil)
+	if hc.Healthy() {
+		t.Fatal("should not be healthy before checked")
+	}
+
+	hc.setResult(0, nil, time.Now())
+	if !hc.Healthy() || hc.Unhealthy() != "" {
+		t.Fatal("should be healthy after checked")
+	}
+	select {
+	case <-hc.Changed():
+		t.Fatal("should not notify without change")
+	default:
+	}
+
+	hc.setResult(0, fmt.Errorf("refused"), time.Now())
+	select {
+	case <-hc.Changed():
+	default:
+		t.Fatal("should notify when turn unhealthy")
+	}
+	if hc.Unhealthy() != "health check api: refused" {
+		t.Fatalf("unexpected reason %s", hc.Unhealthy())
+	}
+
+	hc.setResult(0, nil, time.Now())
+	select {
+	case <-hc.Changed():
+	default:
+		t.Fatal("should notify when recovered")
+	}
+}
+
+func TestProbeCommandBackgroundChild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available")
+	}
+
+	// the child keep the output pipe open after the shell exit
+	start := time.Now()
+	if err := probeCommand(context.Background(), "sleep 10 & echo started"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("probe blocked by background child for %s", elapsed)
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	ahttp "agent/common/http"
+	"net/http"
+
+	libshttp "github.com/vadv/gopher-lua-libs/http"
+	libsclient "github.com/vadv/gopher-lua-libs/http/client"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// preloadHTTPModule override 'http' and 'http_client' of gopher-lua-libs,
+// the clients created by lua use the proxy of agent if 'proxy' is not set in config,
+// and the hosts with custom CA or pins are always verified by the agent policy
+func preloadHTTPModule(L *lua.LState) {
+	L.PreloadModule("http", httpLoader(libshttp.Loader))
+	L.PreloadModule("http_client", httpLoader(libsclient.Loader))
+}
+
+func httpLoader(loader lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		ret := loader(L)
+
+		mod := L.CheckTable(-1)
+		mod.RawSetString("client", L.NewFunction(newHTTPClient))
+		return ret
+	}
+}
+
+// newHTTPClient lua http.client(config)
+func newHTTPClient(L *lua.LState) int {
+	hasProxy := false
+	if config, ok := L.Get(1).(*lua.LTable); ok {
+		hasProxy = L.GetField(config, "proxy") != lua.LNil
+	}
+
+	ret := libsclient.New(L)
+
+	ud, ok := L.Get(-1).(*lua.LUserData)
+	if !ok {
+		return ret
+	}
+
+	client, ok := ud.Value.(*libsclient.LuaClient)
+	if !ok {
+		return ret
+	}
+
+	if transport, ok := client.Transport.(*http.Transport); ok && !hasProxy {
+		transport.Proxy = ahttp.DefaultDNSRountTripper.Proxy
+	}
+	client.Transport = &luaTransport{base: client.Transport}
+	return ret
+}
+
+// luaTransport send the requests of pinned hosts by agent, the lua config
+// like 'insecure_ssl' can not skip the verification
+type luaTransport struct {
+	base http.RoundTripper
+}
+
+func (t *luaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" && ahttp.DefaultDNSRountTripper.HasTLSPolicy(req.URL.Hostname()) {
+		return ahttp.DefaultDNSRountTripper.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"agent/common"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	libslog "github.com/vadv/gopher-lua-libs/log"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	appLogDir       = "logs"
+	appLogFile      = "app.log"
+	appLogPeriod    = 24 * time.Hour
+	appLogKeepFiles = 7
+
+	// TailAppLog read the log file backwards in chunks of this size
+	tailChunkSize = 64 << 10
+	// the bytes read from the end of a log file at most, and the size of a line returned
+	maxTailSize     = 8 << 20
+	maxTailLineSize = 64 << 10
+)
+
+// LogModule is the lua 'log' module, it keeps the gopher-lua-libs 'log.new' api
+// and adds leveled logging with key/value fields.
+// Every record is written to the app's own rotated log file and to the controller log
+type LogModule struct {
+	owner *Script
+
+	fileLogger *log.Logger
+	writer     *io.PipeWriter
+	ctxCancel  context.CancelFunc
+}
+
+func newLogModule(s *Script) *LogModule {
+	lm := &LogModule{owner: s}
+
+	appDir := s.baseInfo.AppDir()
+	if len(appDir) == 0 {
+		return lm
+	}
+
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	rotator := common.NewLogRotator(ctx, filepath.Join(appDir, appLogDir), appLogFile, appLogPeriod, appLogKeepFiles, reader)
+	go func() {
+		if err := rotator.Start(); err != nil {
+			log.Errorf("app log rotator start failed:%v", err)
+			reader.Close()
+		}
+	}()
+
+	fileLogger := log.New()
+	fileLogger.SetOutput(writer)
+	fileLogger.SetLevel(log.TraceLevel)
+	fileLogger.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+
+	lm.fileLogger = fileLogger
+	lm.writer = writer
+	lm.ctxCancel = cancel
+
+	return lm
+}
+
+func (lm *LogModule) loader(L *lua.LState) int {
+	// keep 'log.new' of gopher-lua-libs
+	libslog.Loader(L)
+	mod := L.CheckTable(-1)
+	L.Pop(1)
+
+	var exports = map[string]lua.LGFunction{
+		"debug": lm.logStub(log.DebugLevel),
+		"info":  lm.logStub(log.InfoLevel),
+		"warn":  lm.logStub(log.WarnLevel),
+		"error": lm.logStub(log.ErrorLevel),
+	}
+
+	L.SetFuncs(mod, exports)
+
+	// returns the module
+	L.Push(mod)
+	return 1
+}
+
+// logStub lua log.info(msg, {key=value})
+func (lm *LogModule) logStub(level log.Level) lua.LGFunction {
+	return func(L *lua.LState) int {
+		msg := L.CheckString(1)
+		fields := log.Fields{}
+
+		if t := L.OptTable(2, nil); t != nil {
+			t.ForEach(func(k, v lua.LValue) {
+				fields[k.String()] = luaValueToField(v)
+			})
+		}
+
+		lm.log(level, msg, fields)
+		return 0
+	}
+}
+
+func (lm *LogModule) log(level log.Level, msg string, fields log.Fields) {
+	lm.owner.logger.WithFields(fields).Log(level, msg)
+
+	if lm.fileLogger != nil {
+		lm.fileLogger.WithFields(fields).Log(level, msg)
+	}
+}
+
+func (lm *LogModule) clear() {
+	if lm.writer != nil {
+		lm.writer.Close()
+	}
+
+	if lm.ctxCancel != nil {
+		lm.ctxCancel()
+	}
+}
+
+func luaValueToField(v lua.LValue) interface{} {
+	switch lv := v.(type) {
+	case lua.LBool:
+		return bool(lv)
+	case lua.LNumber:
+		return float64(lv)
+	case lua.LString:
+		return string(lv)
+	default:
+		return v.String()
+	}
+}
+
+// AppLogFiles return the rotated log files of app, newest last
+func AppLogFiles(appDir string) ([]string, error) {
+	basename := strings.TrimSuffix(appLogFile, ".log")
+	files, err := filepath.Glob(filepath.Join(appDir, appLogDir, basename+"-*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	// file name contain the time
+	sort.Strings(files)
+	return files, nil
+}
+
+// TailAppLog return the last n lines of app's log files
+func TailAppLog(appDir string, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("lines must > 0")
+	}
+
+	files, err := AppLogFiles(appDir)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, n)
+	for i := len(files) - 1; i >= 0 && len(lines) < n; i-- {
+		fileLines, err := tailLines(files[i], n-len(lines))
+		if err != nil {
+			return nil, err
+		}
+
+		need := n - len(lines)
+		if len(fileLines) > need {
+			fileLines = fileLines[len(fileLines)-need:]
+		}
+		lines = append(fileLines, lines...)
+	}
+
+	return lines, nil
+}
+
+// tailLines read the last n lines of file backwards, the lines longer than maxTailLineSize
+// are truncated, and at most maxTailSize bytes are read from the end of file
+func tailLines(filePath string, n int) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// read chunks from the end until it contain n complete lines
+	end := info.Size()
+	offset := end
+	var buf []byte
+	for offset > 0 && end-offset < maxTailSize && bytes.Count(buf, []byte{'\n'}) <= n {
+		size := min(int64(tailChunkSize), offset, maxTailSize-(end-offset))
+		offset -= size
+
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = append(chunk, buf...)
+	}
+
+	buf = bytes.TrimSuffix(buf, []byte{'\n'})
+	if len(buf) == 0 {
+		return []string{}, nil
+	}
+
+	parts := bytes.Split(buf, []byte{'\n'})
+	// the first line is partial if the file is not read from the start
+	if offset > 0 && len(parts) > 1 {
+		parts = parts[1:]
+	}
+	if len(parts) > n {
+		parts = parts[len(parts)-n:]
+	}
+
+	lines := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if len(p) > maxTailLineSize {
+			p = p[:maxTailLineSize]
+		}
+		lines = append(lines, string(bytes.TrimSuffix(p, []byte{'\r'})))
+	}
+	return lines, nil
+}
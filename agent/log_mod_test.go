@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTailAppLog(t *testing.T) {
+	appDir := t.TempDir()
+	logDir := filepath.Join(appDir, appLogDir)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var old strings.Builder
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&old, "old %d\n", i)
+	}
+
+	// the long line is over the bufio.Scanner limit, and the chunk size
+	long := strings.Repeat("x", 200<<10)
+	var cur strings.Builder
+	cur.WriteString(long + "\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&cur, "line %d\n", i)
+	}
+	cur.WriteString(long + "\n")
+	cur.WriteString("last\n")
+
+	files := map[string]string{"app-2024-01-01.log": old.String(), "app-2024-01-02.log": cur.String()}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(logDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines, err := TailAppLog(appDir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || lines[0] != "line 19999" || len(lines[1]) != maxTailLineSize || lines[2] != "last" {
+		t.Fatalf("unexpected tail %d lines, first: %.20s", len(lines), lines[0])
+	}
+
+	// the lines of older file are prepended
+	lines, err = TailAppLog(appDir, 20005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 20005 || lines[0] != "old 1" || lines[2] != long[:maxTailLineSize] || lines[3] != "line 0" {
+		t.Fatalf("unexpected tail %d lines, first: %.20s", len(lines), lines[0])
+	}
+}
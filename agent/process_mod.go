@@ -1,15 +1,29 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/shirou/gopsutil/v3/process"
 	log "github.com/sirupsen/logrus"
 	lua "github.com/yuin/gopher-lua"
 )
 
+const (
+	// detached processes keep their pidfile and output under <appDir>/.proc
+	procDir = ".proc"
+	// interval to check if the adopted process is still alive
+	adoptedProcessCheckInterval = 3 * time.Second
+	// time for processes to exit after SIGTERM, then they are killed
+	processStopGrace = 10 * time.Second
+)
+
 type ProcessEvent struct {
 	name string
 }
@@ -20,18 +34,65 @@ func (pe *ProcessEvent) evtType() string {
 
 type Process struct {
 	name string
-	cmd  *exec.Cmd
+	// cmd is nil when the process is adopted from a pidfile
+	cmd *exec.Cmd
+	pid int
+	// createTime of the adopted process, checked before signal it
+	// in case the pid was reused by other process
+	createTime int64
+	// detached process will not be killed when script stop
+	detach bool
+	// closed when the child process exit, nil if adopted
+	exited chan struct{}
+}
+
+func (p *Process) osProcess() (*os.Process, error) {
+	if p.cmd != nil {
+		return p.cmd.Process, nil
+	}
+	if !isProcessAlive(p.pid, p.createTime) {
+		return nil, fmt.Errorf("process %s pid:%d is not alive", p.name, p.pid)
+	}
+	return os.FindProcess(p.pid)
+}
+
+func (p *Process) kill() error {
+	proc, err := p.osProcess()
+	if err != nil {
+		return err
+	}
+	return proc.Kill()
+}
+
+// terminate ask the process to exit, so it can clean up
+func (p *Process) terminate() error {
+	proc, err := p.osProcess()
+	if err != nil {
+		return err
+	}
+	return terminateProcess(proc)
+}
+
+// pidFile record the detached process, createTime is used to make sure
+// the pid was not reused by other process
+type pidFile struct {
+	Pid        int    `json:"pid"`
+	CreateTime int64  `json:"createTime"`
+	Command    string `json:"command"`
 }
 
 type ProcessModule struct {
 	owner      *Script
 	processMap map[string]*Process
+	// closed when module clear, stop to watch the detached process
+	done chan struct{}
 }
 
 func newProcessModule(s *Script) *ProcessModule {
 	pm := &ProcessModule{
 		owner:      s,
 		processMap: make(map[string]*Process),
+		done:       make(chan struct{}),
 	}
 
 	return pm
@@ -44,6 +105,7 @@ func (pm *ProcessModule) loader(L *lua.LState) int {
 		"killProcess":   pm.killProcessStub,
 		"listProcess":   pm.listProcessStub,
 		"getProcess":    pm.getProcessStub,
+		"usage":         pm.usageStub,
 	}
 
 	mod := L.SetFuncs(L.NewTable(), exports)
@@ -53,12 +115,20 @@ func (pm *ProcessModule) loader(L *lua.LState) int {
 	return 1
 }
 
+// createProcessStub lua createProcess(name, command, env, {detach=true})
+// detached process survive the script stop and controller restart,
+// it will be adopted when createProcess with the same name again
 func (pm *ProcessModule) createProcessStub(L *lua.LState) int {
 	name := L.ToString(1)
 	command := L.ToString(2)
 	envStr := L.ToString(3)
 
-	log.Infof("createProcessStub name:%s, command:%s", name, command)
+	detach := false
+	if opts := L.OptTable(4, nil); opts != nil {
+		detach = lua.LVAsBool(opts.RawGetString("detach"))
+	}
+
+	log.Infof("createProcessStub name:%s, command:%s, detach:%v", name, command, detach)
 	// log.Infof("createProcessStub command:%s\n, envStr:%s", command, envStr)
 
 	if len(name) < 1 {
@@ -72,6 +142,14 @@ func (pm *ProcessModule) createProcessStub(L *lua.LState) int {
 		return 1
 	}
 
+	if detach {
+		if err := pm.createDetachedProcess(name, command, pm.parseEnv(envStr)); err != nil {
+			L.Push(lua.LString(err.Error()))
+			return 1
+		}
+		return 0
+	}
+
 	env := pm.parseEnv(envStr)
 	cmd, err := pm.createProcess(command, env)
 	if err != nil {
@@ -86,17 +164,186 @@ func (pm *ProcessModule) createProcessStub(L *lua.LState) int {
 	}
 
 	process := &Process{
-		name: name,
-		cmd:  cmd,
+		name:   name,
+		cmd:    cmd,
+		pid:    cmd.Process.Pid,
+		exited: make(chan struct{}),
 	}
 
 	go pm.waitProcess(process)
 
 	pm.processMap[name] = process
+	pm.owner.usageTracker.Track(process.pid)
 
 	return 0
 }
 
+func (pm *ProcessModule) createDetachedProcess(name, command string, env []string) error {
+	// name is used as file name under procDir
+	if !isValidProcessName(name) {
+		return fmt.Errorf("invalid detached process name %s", name)
+	}
+
+	dir, err := pm.procDir()
+	if err != nil {
+		return err
+	}
+
+	// adopt the process started before
+	if process := pm.adoptProcess(name); process != nil {
+		log.Infof("adopt process %s, pid:%d", name, process.pid)
+		pm.processMap[name] = process
+		pm.owner.usageTracker.Track(process.pid)
+		go pm.watchProcess(process)
+		return nil
+	}
+
+	cmd, err := pm.createProcess(command, env)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// detached process can not write to controller stdout
+	logFile, err := os.OpenFile(filepath.Join(dir, name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	setDetachAttr(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	process := &Process{
+		name:   name,
+		cmd:    cmd,
+		pid:    cmd.Process.Pid,
+		detach: true,
+		exited: make(chan struct{}),
+	}
+
+	if err := pm.writePidFile(name, process.pid, command); err != nil {
+		log.Errorf("write pid file for process %s failed:%v", name, err)
+	}
+
+	go pm.waitProcess(process)
+
+	pm.processMap[name] = process
+	pm.owner.usageTracker.Track(process.pid)
+
+	return nil
+}
+
+func (pm *ProcessModule) procDir() (string, error) {
+	appDir := pm.owner.baseInfo.AppDir()
+	if len(appDir) == 0 {
+		return "", fmt.Errorf("detach process only support in app")
+	}
+	return filepath.Join(appDir, procDir), nil
+}
+
+// isValidProcessName make sure the name can not escape from procDir
+func isValidProcessName(name string) bool {
+	if len(name) == 0 || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`) && !strings.Contains(name, "..")
+}
+
+func (pm *ProcessModule) pidFilePath(name string) string {
+	dir, _ := pm.procDir()
+	return filepath.Join(dir, name+".pid")
+}
+
+func (pm *ProcessModule) writePidFile(name string, pid int, command string) error {
+	createTime, err := processCreateTime(pid)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&pidFile{Pid: pid, CreateTime: createTime, Command: command})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(pm.pidFilePath(name), b, 0644)
+}
+
+func (pm *ProcessModule) readPidFile(name string) (*pidFile, error) {
+	b, err := os.ReadFile(pm.pidFilePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	pf := &pidFile{}
+	if err := json.Unmarshal(b, pf); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+func (pm *ProcessModule) removePidFile(name string) {
+	if err := os.Remove(pm.pidFilePath(name)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("remove pid file for process %s failed:%v", name, err)
+	}
+}
+
+// adoptProcess return the process recorded in pidfile if it still alive,
+// stale pidfile will be removed
+func (pm *ProcessModule) adoptProcess(name string) *Process {
+	pf, err := pm.readPidFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("read pid file for process %s failed:%v", name, err)
+		}
+		return nil
+	}
+
+	if !isProcessAlive(pf.Pid, pf.CreateTime) {
+		log.Infof("process %s pid:%d is not alive, remove pid file", name, pf.Pid)
+		pm.removePidFile(name)
+		return nil
+	}
+
+	return &Process{name: name, pid: pf.Pid, createTime: pf.CreateTime, detach: true}
+}
+
+// watchProcess check the adopted process, it is not child of us, so can not wait it
+func (pm *ProcessModule) watchProcess(process *Process) {
+	pf, err := pm.readPidFile(process.name)
+	if err != nil {
+		log.Errorf("watch process %s, read pid file failed:%v", process.name, err)
+		return
+	}
+
+	ticker := time.NewTicker(adoptedProcessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if isProcessAlive(pf.Pid, pf.CreateTime) {
+				continue
+			}
+
+			log.Infof("adopted process %s pid:%d exit", process.name, process.pid)
+			pm.removePidFile(process.name)
+			pm.owner.pushEvt(&ProcessEvent{name: process.name})
+			return
+		case <-pm.done:
+			return
+		}
+	}
+}
+
 func (tm *ProcessModule) parseEnv(envStr string) []string {
 	if len(envStr) == 0 {
 		return []string{}
@@ -114,7 +361,9 @@ func (tm *ProcessModule) killProcessStub(L *lua.LState) int {
 		return 0
 	}
 
-	process.cmd.Process.Kill()
+	if err := process.kill(); err != nil {
+		log.Errorf("kill process %s failed:%v", name, err)
+	}
 
 	// delete(tm.processMap, name)
 
@@ -128,10 +377,7 @@ func (pm *ProcessModule) listProcessStub(L *lua.LState) int {
 
 	t := L.NewTable()
 	for _, v := range pm.processMap {
-		process := L.NewTable()
-		process.RawSet(lua.LString("name"), lua.LString(v.name))
-		process.RawSet(lua.LString("pid"), lua.LNumber(v.cmd.Process.Pid))
-		t.Append(process)
+		t.Append(v.toLuaTable(L))
 	}
 
 	L.Push(t)
@@ -146,21 +392,45 @@ func (pm *ProcessModule) getProcessStub(L *lua.LState) int {
 	name := L.ToString(1)
 	process := pm.processMap[name]
 	if process != nil {
-		t := L.NewTable()
-		t.RawSet(lua.LString("name"), lua.LString(process.name))
-		t.RawSet(lua.LString("pid"), lua.LNumber(process.cmd.Process.Pid))
-		L.Push(t)
+		L.Push(process.toLuaTable(L))
 		return 1
 	}
 
 	return 0
 }
 
+// usageStub return the resource usage of all processes started by the app
+func (pm *ProcessModule) usageStub(L *lua.LState) int {
+	usage := pm.owner.usageTracker.Usage()
+	L.Push(usage.ToLuaTable(L))
+	return 1
+}
+
+func (p *Process) toLuaTable(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	t.RawSet(lua.LString("name"), lua.LString(p.name))
+	t.RawSet(lua.LString("pid"), lua.LNumber(p.pid))
+	t.RawSet(lua.LString("detach"), lua.LBool(p.detach))
+	return t
+}
+
 func (pm *ProcessModule) waitProcess(process *Process) {
 	err := process.cmd.Wait()
 	if err != nil {
 		log.Errorf("wait process %s, err:%v", process.name, err)
 	}
+	close(process.exited)
+
+	if process.detach {
+		pm.removePidFile(process.name)
+
+		// script already stop, the process was left running
+		select {
+		case <-pm.done:
+			return
+		default:
+		}
+	}
 
 	pm.owner.pushEvt(&ProcessEvent{name: process.name})
 }
@@ -169,9 +439,38 @@ func (pm *ProcessModule) delete(name string) {
 	delete(pm.processMap, name)
 }
 
-func (pm *ProcessModule) clear() {
+// clear stop all processes except the detached processes, SIGTERM is sent first,
+// the processes still running after grace period or ctx done are killed
+func (pm *ProcessModule) clear(ctx context.Context) {
+	close(pm.done)
+
+	stopping := make([]*Process, 0, len(pm.processMap))
 	for _, v := range pm.processMap {
-		v.cmd.Process.Kill()
+		if v.detach {
+			log.Infof("leave detached process %s pid:%d running", v.name, v.pid)
+			continue
+		}
+
+		if err := v.terminate(); err != nil {
+			log.Warnf("terminate process %s pid:%d failed:%v", v.name, v.pid, err)
+			v.kill()
+			continue
+		}
+		stopping = append(stopping, v)
+	}
+
+	if len(stopping) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, processStopGrace)
+		defer cancel()
+
+		for _, v := range stopping {
+			select {
+			case <-v.exited:
+			case <-ctx.Done():
+				log.Warnf("process %s pid:%d not exit after SIGTERM, kill it", v.name, v.pid)
+				v.kill()
+			}
+		}
 	}
 
 	pm.processMap = make(map[string]*Process)
@@ -207,3 +506,30 @@ func (tm *ProcessModule) createProcess(command string, env []string) (*exec.Cmd,
 
 	return cmd, nil
 }
+
+func processCreateTime(pid int) (int64, error) {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return 0, err
+	}
+	return p.CreateTime()
+}
+
+// isProcessAlive check the pid is running and is the same process by create time
+func isProcessAlive(pid int, createTime int64) bool {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return false
+	}
+
+	ct, err := p.CreateTime()
+	if err != nil || ct != createTime {
+		return false
+	}
+
+	if status, err := p.Status(); err == nil && len(status) > 0 && status[0] == process.Zombie {
+		return false
+	}
+
+	return true
+}
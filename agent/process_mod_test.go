@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIsValidProcessName(t *testing.T) {
+	cases := map[string]bool{
+		"worker":       true,
+		"worker-1.bin": true,
+		"":             false,
+		".":            false,
+		"..":           false,
+		"../worker":    false,
+		"a/b":          false,
+		`a\b`:          false,
+		"a..b":         false,
+	}
+
+	for name, want := range cases {
+		if got := isValidProcessName(name); got != want {
+			t.Errorf("isValidProcessName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestAdoptedProcessReusedPid(t *testing.T) {
+	createTime, err := processCreateTime(os.Getpid())
+	if err != nil {
+		t.Skipf("process create time not available: %v", err)
+	}
+
+	// same pid but different create time, the pid was reused by other process
+	p := &Process{name: "worker", pid: os.Getpid(), createTime: createTime + 1000, detach: true}
+	if _, err := p.osProcess(); err == nil {
+		t.Fatal("expect error for adopted process with mismatched create time")
+	}
+
+	p.createTime = createTime
+	if _, err := p.osProcess(); err != nil {
+		t.Fatalf("osProcess: %v", err)
+	}
+}
+
+func TestStopFunctionContext(t *testing.T) {
+	deadline := time.Now().Add(30 * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	stopCtx, stopCancel := stopFunctionContext(ctx)
+	defer stopCancel()
+	if d, _ := stopCtx.Deadline(); !d.Equal(deadline.Add(-processStopGrace)) {
+		t.Fatalf("stop function should leave the grace period, got %s", deadline.Sub(d))
+	}
+
+	// the short budget is shared
+	short, shortCancel := context.WithTimeout(context.Background(), processStopGrace)
+	defer shortCancel()
+	d1, _ := short.Deadline()
+	stopCtx, stopCancel = stopFunctionContext(short)
+	defer stopCancel()
+	if d, _ := stopCtx.Deadline(); d1.Sub(d) < processStopGrace/2-time.Second || d1.Sub(d) > processStopGrace/2 {
+		t.Fatalf("stop function should get half of the short budget, got %s", d1.Sub(d))
+	}
+
+	stopCtx, stopCancel = stopFunctionContext(context.Background())
+	defer stopCancel()
+	if _, ok := stopCtx.Deadline(); ok {
+		t.Fatalf("no deadline expected")
+	}
+}
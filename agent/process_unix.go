@@ -0,0 +1,19 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setDetachAttr run the process in new session, so it will not receive the signal of controller
+func setDetachAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// terminateProcess send SIGTERM, the process can clean up before exit
+func terminateProcess(proc *os.Process) error {
+	return proc.Signal(syscall.SIGTERM)
+}
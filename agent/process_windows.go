@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const detachedProcess = 0x00000008
+
+// setDetachAttr run the process without console and in new process group
+func setDetachAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
+
+// terminateProcess kill the process, windows has no SIGTERM for the process without console
+func terminateProcess(proc *os.Process) error {
+	return proc.Kill()
+}
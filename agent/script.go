@@ -1,11 +1,17 @@
 package agent
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	libs "github.com/vadv/gopher-lua-libs"
 	lua "github.com/yuin/gopher-lua"
 )
 
+const scriptStopTimeout = 30 * time.Second
+
 type ScriptEvent interface {
 	evtType() string
 }
@@ -27,16 +33,47 @@ type Script struct {
 	processModule *ProcessModule
 
 	metricModule *MetricModule
+
+	logModule *LogModule
+
+	logger *log.Logger
+
+	usageTracker *UsageTracker
+
+	errLock   sync.Mutex
+	lastError string
+
+	// signaled by agent.ready()
+	readyCh chan struct{}
+	// the health checks of app, nil if script run without controller
+	healthChecker *HealthChecker
 }
 
 func (s *Script) Events() <-chan ScriptEvent {
 	return s.eventsChan
 }
 
+// EventQueueLen return the number of events wait to handle
+func (s *Script) EventQueueLen() int {
+	return len(s.eventsChan)
+}
+
 func (s *Script) pushEvt(evt ScriptEvent) {
 	s.eventsChan <- evt
 }
 
+// Ready is signaled when the script call agent.ready()
+func (s *Script) Ready() <-chan struct{} {
+	return s.readyCh
+}
+
+func (s *Script) markReady() {
+	select {
+	case s.readyCh <- struct{}{}:
+	default:
+	}
+}
+
 func (s *Script) Metric() <-chan string {
 	if s.metricModule != nil {
 		return s.metricModule.metric()
@@ -74,9 +111,12 @@ func (s *Script) HandleEvent(evt ScriptEvent) {
 
 func NewScript(baseInfo *BaseInfo, scriptFileMD5 string, fileContent []byte) *Script {
 	s := &Script{
-		baseInfo:   baseInfo,
-		fileMD5:    scriptFileMD5,
-		eventsChan: make(chan ScriptEvent, 64),
+		baseInfo:     baseInfo,
+		fileMD5:      scriptFileMD5,
+		eventsChan:   make(chan ScriptEvent, 64),
+		readyCh:      make(chan struct{}, 1),
+		logger:       log.StandardLogger(),
+		usageTracker: NewUsageTracker(),
 	}
 
 	s.state = lua.NewState()
@@ -88,6 +128,22 @@ func NewScript(baseInfo *BaseInfo, scriptFileMD5 string, fileContent []byte) *Sc
 	return s
 }
 
+// SetUsageTracker set the tracker that accounting the processes started by script,
+// must be called before Start
+func (s *Script) SetUsageTracker(tracker *UsageTracker) {
+	s.usageTracker = tracker
+}
+
+// SetHealthChecker set the checker of app that script can read results, must be called before Start
+func (s *Script) SetHealthChecker(checker *HealthChecker) {
+	s.healthChecker = checker
+}
+
+// SetLogger set the logger used by script, must be called before Start
+func (s *Script) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
 func (s *Script) Start() {
 	ls := s.state
 	s.timerModule = newTimerModule(s)
@@ -102,10 +158,17 @@ func (s *Script) Start() {
 	s.metricModule = newMetricModule()
 	ls.PreloadModule("metric", s.metricModule.loader)
 
-	ls.PreloadModule("agent", newAgentModule(s.baseInfo.ToLuaTable(ls)).loader)
+	ls.PreloadModule("agent", newAgentModule(s.baseInfo.ToLuaTable(ls), s).loader)
 
 	libs.Preload(ls)
 
+	// lua http clients use the same proxy as agent
+	preloadHTTPModule(ls)
+
+	// override 'log' of gopher-lua-libs, 'log.new' is still available
+	s.logModule = newLogModule(s)
+	ls.PreloadModule("log", s.logModule.loader)
+
 	if s.modTable != nil {
 		// exec 'start' funciton in lua mod
 		s.callModFunction0("start")
@@ -128,7 +191,8 @@ func (s *Script) callModFunction0(funcName string) {
 		ls.Push(fn)
 		err := ls.PCall(0, lua.MultRet, nil)
 		if err != nil {
-			log.Errorf("callModFunction0 %s failed:%v", funcName, err)
+			s.logger.Errorf("callModFunction0 %s failed:%v", funcName, err)
+			s.setLastError(err)
 		}
 	}
 }
@@ -141,16 +205,50 @@ func (s *Script) callModFunction1(funcName string, param0 lua.LValue) {
 		ls.Push(param0)
 		err := ls.PCall(1, lua.MultRet, nil)
 		if err != nil {
-			log.Errorf("callModFunction1 %s failed:%v", funcName, err)
+			s.logger.Errorf("callModFunction1 %s failed:%v", funcName, err)
+			s.setLastError(err)
 		}
 	}
 }
 
+func (s *Script) setLastError(err error) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+
+	s.lastError = err.Error()
+}
+
+// LastError return the last error of lua script, it is safe to call in other goroutine
+func (s *Script) LastError() string {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+
+	return s.lastError
+}
+
+// FileMD5 return the md5 of script file
+func (s *Script) FileMD5() string {
+	return s.fileMD5
+}
+
+// Stop stop the script in scriptStopTimeout
 func (s *Script) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptStopTimeout)
+	defer cancel()
+
+	s.StopContext(ctx)
+}
+
+// StopContext stop the script, the lua 'stop' function is interrupted before the
+// grace period of processes, and the processes are killed when ctx done
+func (s *Script) StopContext(ctx context.Context) {
 	ls := s.state
 	if s.modTable != nil {
-		// exec 'stop' funciton in lua mod
+		// exec 'stop' funciton in lua mod, the processes still have the grace period after it
+		stopCtx, cancel := stopFunctionContext(ctx)
+		ls.SetContext(stopCtx)
 		s.callModFunction0("stop")
+		cancel()
 	}
 
 	ls.Close()
@@ -160,22 +258,41 @@ func (s *Script) Stop() {
 	s.timerModule = nil
 	s.downloadModule.clear()
 	s.downloadModule = nil
-	s.processModule.clear()
+	s.processModule.clear(ctx)
 	s.processModule = nil
+	s.logModule.clear()
+	s.logModule = nil
+}
+
+// stopFunctionContext reserve processStopGrace of the stop budget for the processes to exit
+// after SIGTERM, the 'stop' function get half of the budget when it is shorter than twice of that
+func stopFunctionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	reserve := processStopGrace
+	if remain := time.Until(deadline); remain < 2*reserve {
+		reserve = remain / 2
+	}
+	return context.WithDeadline(ctx, deadline.Add(-reserve))
 }
 
 func (s *Script) load(fileContent []byte) {
 	ls := s.state
 	fn, err := ls.LoadString(string(fileContent))
 	if err != nil {
-		log.Errorf("lstate load string failed:%v", err)
+		s.logger.Errorf("lstate load string failed:%v", err)
+		s.setLastError(err)
 		return
 	}
 
 	ls.Push(fn)
 	err = ls.PCall(0, lua.MultRet, nil)
 	if err != nil {
-		log.Errorf("lstate PCall failed:%v", err)
+		s.logger.Errorf("lstate PCall failed:%v", err)
+		s.setLastError(err)
 		return
 	}
 
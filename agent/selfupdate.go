@@ -0,0 +1,383 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"agent/common"
+	ahttp "agent/common/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	selfUpdateDir  = ".titanagent"
+	selfUpdateFile = "agent_update.json"
+	// new version must reach the server in this time, or rollback
+	selfUpdateGracePeriod = 5 * time.Minute
+	// new version crash before reach server too many times, rollback
+	selfUpdateMaxAttempts = 3
+	selfUpdateTimeout     = 5 * time.Minute
+	// the rejected versions more than this are dropped, the oldest first
+	maxRejectedVersions = 20
+)
+
+// selfUpdateState is persisted between the old and new binary
+type selfUpdateState struct {
+	OldVersion string `json:"oldVersion"`
+	NewVersion string `json:"newVersion"`
+	// times of the new version start without reach server
+	Attempts  int   `json:"attempts"`
+	UpdatedAt int64 `json:"updatedAt"`
+	// the versions rollback, will not update to them again.
+	// The state is kept after commit for them
+	RejectedVersions []string `json:"rejectedVersions,omitempty"`
+	// the single rejected version saved by old agent
+	RejectedVersion string `json:"rejectedVersion,omitempty"`
+}
+
+func (s *selfUpdateState) isRejected(version string) bool {
+	return slices.Contains(s.RejectedVersions, version)
+}
+
+func (s *selfUpdateState) reject(version string) {
+	if s.isRejected(version) {
+		return
+	}
+
+	s.RejectedVersions = append(s.RejectedVersions, version)
+	if n := len(s.RejectedVersions); n > maxRejectedVersions {
+		s.RejectedVersions = s.RejectedVersions[n-maxRejectedVersions:]
+	}
+}
+
+type selfUpdater struct {
+	agent *Agent
+	exe   string
+	state *selfUpdateState
+	// not nil when new version wait to be committed
+	graceTimer *time.Timer
+}
+
+func newSelfUpdater(a *Agent) *selfUpdater {
+	su := &selfUpdater{agent: a}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Errorf("selfUpdater get executable failed:%v", err)
+	} else if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		log.Errorf("selfUpdater eval executable symlinks failed:%v", err)
+	}
+	su.exe = exe
+
+	state, err := su.loadState()
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("selfUpdater load state failed:%v", err)
+	}
+	su.state = state
+
+	return su
+}
+
+func (su *selfUpdater) statePath() string {
+	return filepath.Join(su.agent.args.WorkingDir, selfUpdateDir, selfUpdateFile)
+}
+
+func (su *selfUpdater) loadState() (*selfUpdateState, error) {
+	b, err := os.ReadFile(su.statePath())
+	if err != nil {
+		return nil, err
+	}
+
+	state := &selfUpdateState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+
+	if len(state.RejectedVersion) > 0 {
+		state.reject(state.RejectedVersion)
+		state.RejectedVersion = ""
+	}
+	return state, nil
+}
+
+func (su *selfUpdater) saveState() error {
+	if su.state == nil {
+		return os.Remove(su.statePath())
+	}
+
+	b, err := json.Marshal(su.state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(su.statePath()), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(su.statePath(), b, 0644)
+}
+
+// isPending return true if current binary is the new version not committed
+func (su *selfUpdater) isPending() bool {
+	return su.state != nil && su.state.NewVersion == su.agent.agentVersion && !su.state.isRejected(su.state.NewVersion)
+}
+
+// checkPending run at start, if current binary is new version, start the grace timer
+func (su *selfUpdater) checkPending() {
+	if !su.isPending() {
+		return
+	}
+
+	su.state.Attempts++
+	if su.state.Attempts > selfUpdateMaxAttempts {
+		log.Errorf("selfUpdater version %s start %d times without reach server, rollback", su.agent.agentVersion, su.state.Attempts-1)
+		su.rollback()
+		return
+	}
+
+	if err := su.saveState(); err != nil {
+		log.Errorf("selfUpdater save state failed:%v", err)
+	}
+
+	log.Infof("selfUpdater version %s wait to reach server in %s", su.agent.agentVersion, selfUpdateGracePeriod)
+	su.graceTimer = time.NewTimer(selfUpdateGracePeriod)
+}
+
+// graceTimeout return the timer channel, nil if no update pending
+func (su *selfUpdater) graceTimeout() <-chan time.Time {
+	if su.graceTimer == nil {
+		return nil
+	}
+	return su.graceTimer.C
+}
+
+// serverReached commit the new version
+func (su *selfUpdater) serverReached() {
+	if su.graceTimer == nil {
+		return
+	}
+
+	su.graceTimer.Stop()
+	su.graceTimer = nil
+
+	log.Infof("selfUpdater commit version %s", su.agent.agentVersion)
+
+	os.Remove(su.exe + ".old")
+	if len(su.state.RejectedVersions) > 0 {
+		// keep the rejected versions only
+		su.state = &selfUpdateState{RejectedVersions: su.state.RejectedVersions}
+	} else {
+		su.state = nil
+	}
+	if err := su.saveState(); err != nil {
+		log.Errorf("selfUpdater remove state failed:%v", err)
+	}
+}
+
+// rollback restore the old binary and restart it
+func (su *selfUpdater) rollback() {
+	oldExe := su.exe + ".old"
+	if _, err := os.Stat(oldExe); err != nil {
+		log.Errorf("selfUpdater can not rollback, old binary not exist:%v", err)
+		return
+	}
+
+	if err := os.Rename(oldExe, su.exe); err != nil {
+		log.Errorf("selfUpdater rollback rename failed:%v", err)
+		return
+	}
+
+	su.state.reject(su.state.NewVersion)
+	if err := su.saveState(); err != nil {
+		log.Errorf("selfUpdater save state failed:%v", err)
+	}
+
+	log.Infof("selfUpdater rollback to version %s", su.state.OldVersion)
+	su.restart()
+}
+
+func (su *selfUpdater) restart() {
+	if su.agent.script != nil {
+		su.agent.script.Stop()
+		su.agent.script = nil
+	}
+
+	if err := reexec(su.exe); err != nil {
+		log.Errorf("selfUpdater restart failed:%v", err)
+		os.Exit(1)
+	}
+}
+
+// checkUpdate get the agent binary config from server, and update if version changed
+func (su *selfUpdater) checkUpdate() {
+	// the retry hint is for the script poll, the agent binary is checked along with it
+	updateConfig, _, err := su.agent.getUpdateConfigFromServer("/update/agent")
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest {
+		// no agent binary configured for this os
+		log.Debugf("selfUpdater no update: %s", err.Error())
+		return
+	}
+	if err != nil {
+		log.Errorf("selfUpdater get update config: %s", err.Error())
+		return
+	}
+
+	if err := su.update(updateConfig); err != nil {
+		log.Errorf("selfUpdater update failed: %s", err.Error())
+	}
+}
+
+// update download the new binary, swap it and restart
+func (su *selfUpdater) update(updateConfig *UpdateConfig) error {
+	if len(su.exe) == 0 || updateConfig == nil || len(updateConfig.Version) == 0 {
+		return nil
+	}
+
+	if updateConfig.Version == su.agent.agentVersion || su.isPending() {
+		return nil
+	}
+
+	if su.state != nil && su.state.isRejected(updateConfig.Version) {
+		return nil
+	}
+
+	if !updateConfig.Force && compareVersion(updateConfig.Version, su.agent.agentVersion) < 0 {
+		log.Warnf("selfUpdater refuse to downgrade from %s to %s without force", su.agent.agentVersion, updateConfig.Version)
+		return nil
+	}
+
+	log.Infof("selfUpdater update from %s to %s", su.agent.agentVersion, updateConfig.Version)
+
+	newExe := su.exe + ".new"
+	if err := su.download(updateConfig, newExe); err != nil {
+		os.Remove(newExe)
+		return err
+	}
+
+	oldExe := su.exe + ".old"
+	if err := os.Rename(su.exe, oldExe); err != nil {
+		os.Remove(newExe)
+		return err
+	}
+
+	if err := os.Rename(newExe, su.exe); err != nil {
+		// restore the current binary
+		os.Rename(oldExe, su.exe)
+		return err
+	}
+
+	var rejected []string
+	if su.state != nil {
+		rejected = su.state.RejectedVersions
+	}
+	su.state = &selfUpdateState{
+		OldVersion:       su.agent.agentVersion,
+		NewVersion:       updateConfig.Version,
+		UpdatedAt:        time.Now().Unix(),
+		RejectedVersions: rejected,
+	}
+	if err := su.saveState(); err != nil {
+		log.Errorf("selfUpdater save state failed:%v", err)
+	}
+
+	su.restart()
+	return nil
+}
+
+func (su *selfUpdater) download(updateConfig *UpdateConfig, filePath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfUpdateTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", updateConfig.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: ahttp.DefaultDNSRountTripper,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("download agent status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), updateConfig.URL)
+	}
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), common.DownloadRateLimiter.Reader(ctx, resp.Body)); err != nil {
+		return err
+	}
+
+	if md5Str := fmt.Sprintf("%x", h.Sum(nil)); md5Str != updateConfig.MD5 {
+		return fmt.Errorf("agent file md5 not match, download: %s, expect: %s", md5Str, updateConfig.MD5)
+	}
+
+	return f.Sync()
+}
+
+// compareVersion compare the dotted numeric versions like 0.1.3 or v1.2, the missing parts are 0.
+// The versions that can not be parsed are treated as equal
+func compareVersion(a, b string) int {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0
+	}
+
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return cmp.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	// ignore the pre-release or build suffix
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	nums := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		nums = append(nums, n)
+	}
+	return nums, true
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"agent/common"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompareVersion(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"0.1.3", "0.1.3", 0},
+		{"0.1.10", "0.1.9", 1},
+		{"0.1", "0.1.1", -1},
+		{"v1.0.0", "0.9.9", 1},
+		{"1.0.0-rc1", "1.0.0", 0},
+		{"dev", "0.1.3", 0},
+	}
+
+	for _, c := range cases {
+		if got := compareVersion(c.a, c.b); got != c.want {
+			t.Errorf("compareVersion(%s, %s) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestSelfUpdateRejectedVersions(t *testing.T) {
+	dir := t.TempDir()
+	su := &selfUpdater{agent: &Agent{args: &AgentArguments{WorkingDir: dir}, agentVersion: "0.1.3"}, exe: filepath.Join(dir, "agent")}
+
+	// the state saved by old agent
+	if err := os.MkdirAll(filepath.Dir(su.statePath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(su.statePath(), []byte(`{"oldVersion":"0.1.2","newVersion":"0.1.4","rejectedVersion":"0.1.4"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := su.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.isRejected("0.1.4") || state.RejectedVersion != "" {
+		t.Fatalf("legacy rejected version not migrated %+v", state)
+	}
+
+	for i := 0; i < maxRejectedVersions+5; i++ {
+		state.reject(fmt.Sprintf("1.0.%d", i))
+	}
+	if len(state.RejectedVersions) != maxRejectedVersions || state.isRejected("0.1.4") {
+		t.Fatalf("rejected versions should be capped, got %d", len(state.RejectedVersions))
+	}
+
+	// the rejected and lower versions are not downloaded
+	su.state = &selfUpdateState{RejectedVersions: []string{"0.1.5"}}
+	for _, cfg := range []*UpdateConfig{
+		{Version: "0.1.5", URL: "http://127.0.0.1:0/agent"},
+		{Version: "0.1.2", URL: "http://127.0.0.1:0/agent"},
+	} {
+		if err := su.update(cfg); err != nil {
+			t.Fatalf("update to %s should be skipped: %v", cfg.Version, err)
+		}
+	}
+
+	// forced downgrade try to download
+	if err := su.update(&UpdateConfig{Version: "0.1.2", URL: "http://127.0.0.1:0/agent", Force: true}); err == nil {
+		t.Fatal("forced downgrade should try to download")
+	}
+}
+
+func TestCheckUpdateKeepPollHint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	a := &Agent{
+		args:          &AgentArguments{ServerURL: srv.URL},
+		baseInfo:      &BaseInfo{},
+		pollScheduler: common.NewPollScheduler("agent", time.Minute, 10*time.Minute),
+	}
+	su := &selfUpdater{agent: a}
+
+	// the hint of agent update must not delay the script poll
+	su.checkUpdate()
+	if d := a.pollScheduler.Next(); d > 2*time.Minute {
+		t.Fatalf("script poll should not use the update hint, got %s", d)
+	}
+
+	_, hint, err := a.getUpdateConfigFromServer("/update/lua")
+	if err == nil || hint != 600*time.Second {
+		t.Fatalf("expect the retry hint with error, got %s %v", hint, err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// reexec replace current process with the binary
+func reexec(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
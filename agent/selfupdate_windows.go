@@ -0,0 +1,21 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+)
+
+// reexec start the binary as new process and exit, windows not support exec
+func reexec(exe string) error {
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	os.Exit(0)
+	return nil
+}
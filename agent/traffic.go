@@ -1,42 +1,99 @@
 package agent
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
-	"os/exec"
+	"io"
+	"math"
+	"os"
+	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/net"
+	log "github.com/sirupsen/logrus"
 )
 
-type NetworkStats struct {
-	Ibytes uint64
-	Obytes uint64
+// DefaultInterfaceExclude the loopback, container, vm bridge and tunnel interfaces,
+// their traffic is also counted on the physical interface
+var DefaultInterfaceExclude = []string{
+	"lo", "lo0", "Loopback*",
+	"docker*", "veth*", "br-*", "cni*", "flannel*", "cali*", "vxlan*", "kube-*",
+	"virbr*", "vnet*", "vmnet*", "vboxnet*", "mpqemubr*", "vEthernet*", "bridge*",
+	"tun*", "tap*", "utun*", "wg*", "tailscale*", "zt*", "ifb*", "dummy*",
+	"isatap*", "Teredo*", "awdl*", "llw*", "anpi*", "gif*", "stf*",
+}
+
+// InterfaceFilter select the interfaces to count by glob pattern,
+// all interfaces are included if Include is empty
+type InterfaceFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// NewInterfaceFilter use DefaultInterfaceExclude if exclude is empty
+func NewInterfaceFilter(include, exclude []string) InterfaceFilter {
+	if len(exclude) == 0 {
+		exclude = DefaultInterfaceExclude
+	}
+	return InterfaceFilter{Include: include, Exclude: exclude}
+}
+
+func (f InterfaceFilter) Match(name string) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, name) {
+		return false
+	}
+	return !matchAny(f.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// InterfaceStats the byte counters of interface
+type InterfaceStats struct {
+	Name    string
+	RxBytes uint64
+	TxBytes uint64
+}
+
+type InterfaceRate struct {
+	Name  string  `json:"name"`
+	IRate float64 `json:"irate"`
+	ORate float64 `json:"orate"`
 }
 
 type NetworkStatsRate struct {
 	IRate float64 // Bytes per second received
 	ORate float64 // Bytes per second sent
+
+	// the rate of interfaces that counted in total
+	Interfaces []InterfaceRate
 }
 
-func MonitorNetworkStats(ctx context.Context, interval time.Duration) (<-chan NetworkStatsRate, error) {
+func MonitorNetworkStats(ctx context.Context, interval time.Duration, filter InterfaceFilter) (<-chan NetworkStatsRate, error) {
 	outputChan := make(chan NetworkStatsRate)
 
+	stats, err := getNetworkStats()
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := newTrafficSampler(filter)
+	sampler.sample(stats, time.Now())
+
 	go func() {
 		defer close(outputChan)
-		var previousStats NetworkStats
-		var err error
-
-		previousStats, err = getNetworkStats()
-		if err != nil {
-			fmt.Printf("Error fetching initial stats: %v\n", err)
-			return
-		}
 
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -44,22 +101,22 @@ func MonitorNetworkStats(ctx context.Context, interval time.Duration) (<-chan Ne
 		for {
 			select {
 			case <-ticker.C:
-				currentStats, err := getNetworkStats()
+				stats, err := getNetworkStats()
 				if err != nil {
-					fmt.Printf("Error fetching network stats: %v\n", err)
+					log.Errorf("MonitorNetworkStats get network stats: %v", err)
 					continue
 				}
 
-				ibytesDiff := currentStats.Ibytes - previousStats.Ibytes
-				obytesDiff := currentStats.Obytes - previousStats.Obytes
-
-				seconds := interval.Seconds()
-				outputChan <- NetworkStatsRate{
-					IRate: float64(ibytesDiff) / seconds,
-					ORate: float64(obytesDiff) / seconds,
+				rate, ok := sampler.sample(stats, time.Now())
+				if !ok {
+					continue
 				}
 
-				previousStats = currentStats
+				select {
+				case outputChan <- rate:
+				case <-ctx.Done():
+					return
+				}
 
 			case <-ctx.Done():
 				return
@@ -70,145 +127,141 @@ func MonitorNetworkStats(ctx context.Context, interval time.Duration) (<-chan Ne
 	return outputChan, nil
 }
 
-func getNetworkStats() (NetworkStats, error) {
-	switch runtime.GOOS {
-	case "darwin":
-		return getNetworkStatsMacOS()
-	case "linux", "android":
-		return getNetworkStatsLinux()
-	case "windows":
-		return getNetworkStatsWindows()
-	default:
-		return NetworkStats{}, fmt.Errorf("unsupported OS: %s", runtime.GOOS)
-	}
+// trafficSampler turn the counters to rates
+type trafficSampler struct {
+	filter   InterfaceFilter
+	prev     map[string]InterfaceStats
+	prevTime time.Time
 }
 
-func getNetworkStatsLinux() (NetworkStats, error) {
-	output, err := exec.Command("cat", "/proc/net/dev").Output()
-	if err != nil {
-		return NetworkStats{}, err
-	}
-
-	lines := strings.Split(string(output), "\n")
-	var totalStats NetworkStats
+func newTrafficSampler(filter InterfaceFilter) *trafficSampler {
+	return &trafficSampler{filter: filter}
+}
 
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) < 10 || !strings.Contains(line, ":") {
-			continue
+// sample return the rates since last sample, false for the first sample.
+// The interface that appear first time has no rate until next sample
+func (ts *trafficSampler) sample(stats []InterfaceStats, now time.Time) (NetworkStatsRate, bool) {
+	current := make(map[string]InterfaceStats, len(stats))
+	for _, s := range stats {
+		if ts.filter.Match(s.Name) {
+			current[s.Name] = s
 		}
-
-		ibytes, _ := strconv.ParseUint(fields[1], 10, 64) // Bytes received
-		obytes, _ := strconv.ParseUint(fields[9], 10, 64) // Bytes sent
-
-		totalStats.Ibytes += ibytes
-		totalStats.Obytes += obytes
 	}
 
-	return totalStats, nil
-}
+	prev, prevTime := ts.prev, ts.prevTime
+	ts.prev, ts.prevTime = current, now
 
-func getNetworkStatsMacOS() (NetworkStats, error) {
-	cmd := exec.Command("netstat", "-ib")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		return NetworkStats{}, err
+	seconds := now.Sub(prevTime).Seconds()
+	if prev == nil || seconds <= 0 {
+		return NetworkStatsRate{}, false
 	}
 
-	return parseNetstatOutput(out.String())
-}
-
-func parseNetstatOutput(output string) (NetworkStats, error) {
-	lines := strings.Split(output, "\n")
-	var totalStats NetworkStats
-	seen := make(map[string]bool)
-
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) < 10 {
+	rate := NetworkStatsRate{Interfaces: make([]InterfaceRate, 0, len(current))}
+	for name, cur := range current {
+		last, ok := prev[name]
+		if !ok {
 			continue
 		}
 
-		interfaceName := fields[0]
-		if seen[interfaceName] || strings.HasPrefix(interfaceName, "utun") || strings.HasPrefix(interfaceName, "vmnet") {
-			continue // Skip duplicate or virtual interfaces
+		r := InterfaceRate{
+			Name:  name,
+			IRate: float64(counterDelta(last.RxBytes, cur.RxBytes)) / seconds,
+			ORate: float64(counterDelta(last.TxBytes, cur.TxBytes)) / seconds,
 		}
-		seen[interfaceName] = true
+		rate.IRate += r.IRate
+		rate.ORate += r.ORate
+		rate.Interfaces = append(rate.Interfaces, r)
+	}
 
-		ibytes, _ := strconv.ParseUint(fields[6], 10, 64) // Bytes received
-		obytes, _ := strconv.ParseUint(fields[9], 10, 64) // Bytes sent
+	sort.Slice(rate.Interfaces, func(i, j int) bool { return rate.Interfaces[i].Name < rate.Interfaces[j].Name })
+	return rate, true
+}
 
-		totalStats.Ibytes += ibytes
-		totalStats.Obytes += obytes
+// counterDelta return the increase of counter. A 32 bits counter may wrap,
+// otherwise the counter was reset, e.g. the interface was recreated,
+// and it counts from zero
+func counterDelta(prev, cur uint64) uint64 {
+	if cur >= prev {
+		return cur - prev
 	}
 
-	return totalStats, nil
+	if prev <= math.MaxUint32 {
+		if wrapped := math.MaxUint32 - prev + cur + 1; wrapped < math.MaxUint32/2 {
+			return wrapped
+		}
+	}
+	return cur
 }
 
-func getNetworkStatsWindows() (NetworkStats, error) {
-	cmd := exec.Command("powershell", "-Command", `
-	Get-Counter -Counter "\Network Interface(*)\Bytes Received/sec", "\Network Interface(*)\Bytes Sent/sec" |
-	Select-Object -ExpandProperty CounterSamples |
-	ConvertTo-Json
-	`)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		return NetworkStats{}, err
+func getNetworkStats() ([]InterfaceStats, error) {
+	switch runtime.GOOS {
+	case "linux", "android":
+		return readNetDevStats("/proc/net/dev")
+	case "darwin", "windows":
+		return getNetworkStatsGopsutil()
+	default:
+		return nil, fmt.Errorf("unsupported OS: %s", runtime.GOOS)
 	}
+}
 
-	type CounterSample struct {
-		Path         string  `json:"Path"`
-		InstanceName string  `json:"InstanceName"`
-		CookedValue  float64 `json:"CookedValue"`
+// getNetworkStatsGopsutil read the byte counters of interfaces by system api
+func getNetworkStatsGopsutil() ([]InterfaceStats, error) {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		return nil, err
 	}
 
-	var samples []CounterSample
-	if err := json.Unmarshal(out.Bytes(), &samples); err != nil {
-		return NetworkStats{}, fmt.Errorf("json unmarshal error: %v", err)
+	stats := make([]InterfaceStats, 0, len(counters))
+	for _, c := range counters {
+		stats = append(stats, InterfaceStats{Name: c.Name, RxBytes: c.BytesRecv, TxBytes: c.BytesSent})
 	}
+	return stats, nil
+}
 
-	var totalStats NetworkStats
-	for _, s := range samples {
-		if strings.Contains(strings.ToLower(s.Path), "bytes received/sec") {
-			totalStats.Ibytes += uint64(s.CookedValue)
-		} else if strings.Contains(strings.ToLower(s.Path), "bytes sent/sec") {
-			totalStats.Obytes += uint64(s.CookedValue)
-		}
+// readNetDevStats read the file in /proc/net/dev format
+func readNetDevStats(filePath string) ([]InterfaceStats, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	return totalStats, nil
+	return parseNetDev(f)
 }
 
-func parseWindowsOutput(output string) (NetworkStats, error) {
-	lines := strings.Split(output, "\n")
-	var totalStats NetworkStats
-
-	for _, line := range lines {
-		if !strings.Contains(line, "\\Network Interface") {
+// parseNetDev parse /proc/net/dev, the first 2 lines are headers:
+//
+//	Inter-|   Receive                                                |  Transmit
+//	 face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets ...
+//	  eth0: 1234 ...
+func parseNetDev(r io.Reader) ([]InterfaceStats, error) {
+	stats := make([]InterfaceStats, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
 			continue
 		}
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
+
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
 			continue
 		}
 
-		value, err := strconv.ParseUint(fields[1], 10, 64)
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
 		if err != nil {
-			return NetworkStats{}, err
+			return nil, fmt.Errorf("parse rx bytes of %s: %w", name, err)
 		}
-
-		if strings.Contains(fields[0], "Bytes Received/sec") {
-			totalStats.Ibytes += value
-		} else if strings.Contains(fields[0], "Bytes Sent/sec") {
-			totalStats.Obytes += value
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse tx bytes of %s: %w", name, err)
 		}
+
+		stats = append(stats, InterfaceStats{Name: strings.TrimSpace(name), RxBytes: rx, TxBytes: tx})
 	}
 
-	return totalStats, nil
+	return stats, scanner.Err()
 }
 
 func GetCpuRealtimeUsage() float64 {
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseNetDev(t *testing.T) {
+	stats, err := readNetDevStats("testdata/proc_net_dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats) != 6 {
+		t.Fatalf("expect 6 interfaces, got %d", len(stats))
+	}
+
+	eth0 := stats[1]
+	if eth0.Name != "eth0" || eth0.RxBytes != 1000000 || eth0.TxBytes != 500000 {
+		t.Fatalf("unexpected eth0 %+v", eth0)
+	}
+}
+
+func TestTrafficSampler(t *testing.T) {
+	first, err := readNetDevStats("testdata/proc_net_dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := readNetDevStats("testdata/proc_net_dev.next")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sampler := newTrafficSampler(NewInterfaceFilter(nil, nil))
+	now := time.Now()
+	if _, ok := sampler.sample(first, now); ok {
+		t.Fatalf("first sample has no rate")
+	}
+
+	rate, ok := sampler.sample(next, now.Add(10*time.Second))
+	if !ok {
+		t.Fatalf("expect rate")
+	}
+
+	// lo, docker0, veth and mpqemubr0 are excluded, eth1 is new,
+	// wlan0 counter was reset and counts from zero
+	if len(rate.Interfaces) != 2 || rate.Interfaces[0].Name != "eth0" || rate.Interfaces[1].Name != "wlan0" {
+		t.Fatalf("unexpected interfaces %+v", rate.Interfaces)
+	}
+	if rate.Interfaces[0].IRate != 60000 || rate.Interfaces[0].ORate != 30000 {
+		t.Fatalf("unexpected eth0 rate %+v", rate.Interfaces[0])
+	}
+	if rate.IRate != 60600 || rate.ORate != 30300 {
+		t.Fatalf("unexpected total rate %f %f", rate.IRate, rate.ORate)
+	}
+
+	sampler = newTrafficSampler(NewInterfaceFilter([]string{"eth*"}, nil))
+	sampler.sample(first, now)
+	rate, _ = sampler.sample(next, now.Add(10*time.Second))
+	if len(rate.Interfaces) != 1 || rate.Interfaces[0].Name != "eth0" {
+		t.Fatalf("include filter not applied %+v", rate.Interfaces)
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	if d := counterDelta(100, 300); d != 200 {
+		t.Fatalf("normal delta %d", d)
+	}
+
+	// 32 bits counter wrap
+	if d := counterDelta(math.MaxUint32-99, 100); d != 200 {
+		t.Fatalf("wrap delta %d", d)
+	}
+
+	// reset
+	if d := counterDelta(1<<40, 500); d != 500 {
+		t.Fatalf("reset delta %d", d)
+	}
+}
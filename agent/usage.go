@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// interval to sample the tracked process trees
+const usageSampleInterval = 5 * time.Second
+
+// AppUsage is the resource usage of all processes started by an app.
+// CPU, disk io and net are accumulated since the app start, RSS is current
+type AppUsage struct {
+	CPUSeconds float64 `json:"cpuSeconds"`
+	RSSBytes   uint64  `json:"rssBytes"`
+	ReadBytes  uint64  `json:"readBytes"`
+	WriteBytes uint64  `json:"writeBytes"`
+	NetRxBytes uint64  `json:"netRxBytes"`
+	NetTxBytes uint64  `json:"netTxBytes"`
+}
+
+func (u *AppUsage) add(o *AppUsage) {
+	u.CPUSeconds += o.CPUSeconds
+	u.RSSBytes += o.RSSBytes
+	u.ReadBytes += o.ReadBytes
+	u.WriteBytes += o.WriteBytes
+	u.NetRxBytes += o.NetRxBytes
+	u.NetTxBytes += o.NetTxBytes
+}
+
+func (u *AppUsage) ToLuaTable(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	t.RawSet(lua.LString("cpuSeconds"), lua.LNumber(u.CPUSeconds))
+	t.RawSet(lua.LString("rssBytes"), lua.LNumber(u.RSSBytes))
+	t.RawSet(lua.LString("readBytes"), lua.LNumber(u.ReadBytes))
+	t.RawSet(lua.LString("writeBytes"), lua.LNumber(u.WriteBytes))
+	t.RawSet(lua.LString("netRxBytes"), lua.LNumber(u.NetRxBytes))
+	t.RawSet(lua.LString("netTxBytes"), lua.LNumber(u.NetTxBytes))
+	return t
+}
+
+// procKey identify a process, pid may be reused
+type procKey struct {
+	pid        int32
+	createTime int64
+}
+
+// trackedProcess is the last sample of a process in tracked trees
+type trackedProcess struct {
+	ppid  int32
+	usage *AppUsage
+}
+
+// netKey identify an interface in a network namespace
+type netKey struct {
+	ns    string
+	iface string
+}
+
+type netCounter struct {
+	rx uint64
+	tx uint64
+}
+
+// UsageTracker accumulate the usage of process trees that started by process module,
+// it live with the app, so the usage is kept across script reload.
+// The trees are sampled periodically, so the usage of exited processes is kept,
+// the descendants of an exited root are still tracked after they are reparented
+type UsageTracker struct {
+	lock sync.Mutex
+	// the root pids started by process module
+	roots map[int32]struct{}
+	// last sample of every process in trees
+	last map[procKey]*trackedProcess
+	// the usage of processes already exit
+	exited AppUsage
+	// last counters of every interface in tracked network namespaces
+	lastNet map[netKey]netCounter
+	// the traffic of namespaces or interfaces already gone
+	exitedNet netCounter
+	// last usage returned, the accumulated counters never go backwards
+	reported AppUsage
+}
+
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{
+		roots:   make(map[int32]struct{}),
+		last:    make(map[procKey]*trackedProcess),
+		lastNet: make(map[netKey]netCounter),
+	}
+}
+
+// Track add a process tree to tracker
+func (ut *UsageTracker) Track(pid int) {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+
+	ut.roots[int32(pid)] = struct{}{}
+}
+
+// Run sample the tracked trees every usageSampleInterval until ctx done,
+// so the usage of short-lived processes is not lost between two Usage calls
+func (ut *UsageTracker) Run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(usageSampleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ut.Usage()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Usage sample all tracked process trees, and return the app usage
+func (ut *UsageTracker) Usage() AppUsage {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+
+	procs := ut.walk()
+	current := make(map[procKey]*trackedProcess, len(procs))
+	for k, p := range procs {
+		current[k] = &trackedProcess{ppid: p.ppid, usage: sampleProcess(p.proc)}
+	}
+
+	running := make(map[int32]bool, len(current))
+	for k := range current {
+		running[k.pid] = true
+	}
+
+	for k, t := range ut.last {
+		if _, ok := current[k]; ok {
+			continue
+		}
+
+		// the parent add the cpu and io of the child to its own counters when reap it,
+		// so the child is already counted if its parent is still tracked
+		if reapedCountedByParent && running[t.ppid] {
+			continue
+		}
+
+		// RSS only count the running processes
+		exited := *t.usage
+		exited.RSSBytes = 0
+		ut.exited.add(&exited)
+	}
+	ut.last = current
+
+	usage := ut.exited
+	for _, t := range current {
+		usage.add(t.usage)
+	}
+
+	// net can not attribute to process, only count by network namespace
+	rx, tx := ut.netUsage()
+	usage.NetRxBytes += rx
+	usage.NetTxBytes += tx
+
+	ut.reported = monotonicUsage(&ut.reported, &usage)
+	return ut.reported
+}
+
+// monotonicUsage keep the accumulated counters from going backwards,
+// e.g. a reaped child is moved to its parent before the parent counters update
+func monotonicUsage(last, u *AppUsage) AppUsage {
+	r := *u
+	r.CPUSeconds = math.Max(last.CPUSeconds, u.CPUSeconds)
+	r.ReadBytes = max(last.ReadBytes, u.ReadBytes)
+	r.WriteBytes = max(last.WriteBytes, u.WriteBytes)
+	r.NetRxBytes = max(last.NetRxBytes, u.NetRxBytes)
+	r.NetTxBytes = max(last.NetTxBytes, u.NetTxBytes)
+	return r
+}
+
+// Processes return the running processes in all tracked trees
+func (ut *UsageTracker) Processes() []*process.Process {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+
+	procs := ut.walk()
+	ret := make([]*process.Process, 0, len(procs))
+	for _, p := range procs {
+		ret = append(ret, p.proc)
+	}
+	return ret
+}
+
+type treeProcess struct {
+	proc *process.Process
+	ppid int32
+}
+
+// walk return the running processes in tracked trees, the trees start from the roots
+// and the processes seen last time, so the orphans of an exited root are kept
+func (ut *UsageTracker) walk() map[procKey]*treeProcess {
+	all, err := process.Processes()
+	if err != nil {
+		return map[procKey]*treeProcess{}
+	}
+
+	procs := make(map[int32]*treeProcess, len(all))
+	children := make(map[int32][]int32)
+	for _, p := range all {
+		ppid, err := p.Ppid()
+		if err != nil {
+			continue
+		}
+		procs[p.Pid] = &treeProcess{proc: p, ppid: ppid}
+		children[ppid] = append(children[ppid], p.Pid)
+	}
+
+	// children of the processes in tree are trusted, the pids seen last time
+	// may be reused by unrelated processes, so check the create time
+	type entry struct {
+		pid     int32
+		trusted bool
+	}
+
+	var queue []entry
+	for pid := range ut.roots {
+		if _, ok := procs[pid]; !ok {
+			delete(ut.roots, pid)
+			continue
+		}
+		queue = append(queue, entry{pid: pid, trusted: true})
+	}
+	for k := range ut.last {
+		queue = append(queue, entry{pid: k.pid})
+	}
+
+	tree := make(map[procKey]*treeProcess)
+	visited := make(map[int32]bool)
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		if visited[e.pid] {
+			continue
+		}
+
+		p, ok := procs[e.pid]
+		if !ok {
+			continue
+		}
+		createTime, err := p.proc.CreateTime()
+		if err != nil {
+			continue
+		}
+
+		key := procKey{pid: e.pid, createTime: createTime}
+		if _, seen := ut.last[key]; !e.trusted && !seen {
+			continue
+		}
+		visited[e.pid] = true
+
+		tree[key] = p
+		for _, child := range children[e.pid] {
+			queue = append(queue, entry{pid: child, trusted: true})
+		}
+	}
+	return tree
+}
+
+func sampleProcess(p *process.Process) *AppUsage {
+	u := &AppUsage{}
+	if times, err := p.Times(); err == nil {
+		u.CPUSeconds = times.User + times.System + reapedChildrenCPU(p.Pid)
+	}
+
+	if mem, err := p.MemoryInfo(); err == nil {
+		u.RSSBytes = mem.RSS
+	}
+
+	if io, err := p.IOCounters(); err == nil {
+		u.ReadBytes = io.ReadBytes
+		u.WriteBytes = io.WriteBytes
+	}
+	return u
+}
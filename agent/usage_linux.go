@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// linux add the cpu time and io of a child to its parent when the child is reaped,
+// /proc/<pid>/io include them, the cpu time is in cutime and cstime of /proc/<pid>/stat
+const reapedCountedByParent = true
+
+// clock ticks per second of /proc/<pid>/stat, same as gopsutil
+const clockTicks = 100
+
+// reapedChildrenCPU return the cpu seconds of the children reaped by pid
+func reapedChildrenCPU(pid int32) float64 {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	return parseReapedChildrenCPU(string(b))
+}
+
+func parseReapedChildrenCPU(stat string) float64 {
+	// comm may contain spaces, the fields after it start from state(3)
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(stat[i+1:])
+	// cutime(16) and cstime(17)
+	if len(fields) < 15 {
+		return 0
+	}
+
+	cutime, err := strconv.ParseFloat(fields[13], 64)
+	if err != nil {
+		return 0
+	}
+	cstime, err := strconv.ParseFloat(fields[14], 64)
+	if err != nil {
+		return 0
+	}
+	return (cutime + cstime) / clockTicks
+}
+
+// netUsage sum the traffic of network namespaces that the tracked processes run in.
+// Processes sharing the host network namespace can not be counted separately,
+// usually the app run its workload in container or vm with its own namespace.
+// The traffic of a namespace or interface is kept after it is gone
+func (ut *UsageTracker) netUsage() (uint64, uint64) {
+	hostNS, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		return ut.exitedNet.rx, ut.exitedNet.tx
+	}
+
+	current := make(map[netKey]netCounter)
+	seen := map[string]bool{hostNS: true}
+	for k := range ut.last {
+		ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", k.pid))
+		if err != nil || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+
+		stats, err := readNetDevStats(fmt.Sprintf("/proc/%d/net/dev", k.pid))
+		if err != nil {
+			continue
+		}
+		for _, s := range stats {
+			if s.Name == "lo" {
+				continue
+			}
+			current[netKey{ns: ns, iface: s.Name}] = netCounter{rx: s.RxBytes, tx: s.TxBytes}
+		}
+	}
+
+	for k, last := range ut.lastNet {
+		c, ok := current[k]
+		// the interface is gone or recreated with counters reset
+		if !ok || c.rx < last.rx || c.tx < last.tx {
+			ut.exitedNet.rx += last.rx
+			ut.exitedNet.tx += last.tx
+		}
+	}
+	ut.lastNet = current
+
+	rx, tx := ut.exitedNet.rx, ut.exitedNet.tx
+	for _, c := range current {
+		rx += c.rx
+		tx += c.tx
+	}
+	return rx, tx
+}
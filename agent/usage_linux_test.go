@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestParseReapedChildrenCPU(t *testing.T) {
+	stat := "1234 (my (app) x) S 1 1234 1234 0 -1 4194560 100 0 0 0 50 20 150 50 20 0 1 0 100 1000 10"
+	if got := parseReapedChildrenCPU(stat); got != 2 {
+		t.Fatalf("expect 2 cpu seconds, got %v", got)
+	}
+
+	if got := parseReapedChildrenCPU("1234 (app) S 1"); got != 0 {
+		t.Fatalf("expect 0 for short stat, got %v", got)
+	}
+}
+
+func TestUsageTrackerExitedChildren(t *testing.T) {
+	// the child burn cpu and exit between two samples, the root reap it and exit later
+	cmd := exec.Command("sh", "-c", "sh -c 'i=0; while [ $i -lt 300000 ]; do i=$((i+1)); done'; sleep 1")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("start sh: %v", err)
+	}
+
+	ut := NewUsageTracker()
+	ut.Track(cmd.Process.Pid)
+	ut.Usage()
+
+	// wait the child exit and reaped by root
+	deadline := time.Now().Add(30 * time.Second)
+	var running AppUsage
+	for time.Now().Before(deadline) {
+		running = ut.Usage()
+		if running.CPUSeconds > 0 && len(ut.Processes()) == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if running.CPUSeconds <= 0 {
+		t.Fatalf("expect cpu of exited child counted, got %v", running.CPUSeconds)
+	}
+
+	cmd.Wait()
+	exited := ut.Usage()
+	if exited.CPUSeconds < running.CPUSeconds {
+		t.Fatalf("cpu go backwards after root exit: %v < %v", exited.CPUSeconds, running.CPUSeconds)
+	}
+	if exited.RSSBytes != 0 {
+		t.Fatalf("expect no rss after all processes exit, got %d", exited.RSSBytes)
+	}
+}
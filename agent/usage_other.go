@@ -0,0 +1,15 @@
+//go:build !linux
+
+package agent
+
+// the cpu and io of reaped children are not added to the parent counters
+const reapedCountedByParent = false
+
+func reapedChildrenCPU(pid int32) float64 {
+	return 0
+}
+
+// netUsage per-app traffic is only supported on linux
+func (ut *UsageTracker) netUsage() (uint64, uint64) {
+	return 0, 0
+}
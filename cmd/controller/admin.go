@@ -0,0 +1,186 @@
+package main
+
+import (
+	"agent/agent"
+	"agent/controller"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var adminWorkingDirFlag = &cli.StringFlag{
+	Name:     "working-dir",
+	Usage:    "--working-dir=/path/to/working/dir",
+	EnvVars:  []string{"WORKING_DIR"},
+	Required: true,
+	Value:    "",
+}
+
+var statusCmd = &cli.Command{
+	Name:  "status",
+	Usage: "show the status of running controller",
+	Flags: []cli.Flag{
+		adminWorkingDirFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		client, err := controller.NewAdminClient(cctx.String("working-dir"))
+		if err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+
+		status, err := client.Status()
+		if err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+
+		fmt.Printf("Version:     %s\n", status.Version)
+		fmt.Printf("NodeID:      %s\n", status.NodeID)
+		fmt.Printf("Server:      %s\n", status.ServerURL)
+		fmt.Printf("WorkingDir:  %s\n", status.WorkingDir)
+		fmt.Printf("Uptime:      %s\n", time.Duration(status.Uptime)*time.Second)
+		if status.Offline {
+			fmt.Printf("Offline:     %s\n", time.Duration(status.OfflineSeconds)*time.Second)
+		}
+		if status.Control {
+			fmt.Printf("Control:     connected\n")
+		} else {
+			fmt.Printf("Control:     down, polling\n")
+		}
+		fmt.Printf("Apps:        %d\n", status.AppCount)
+		if status.PinFailures > 0 {
+			fmt.Printf("Pin errors:  %d\n", status.PinFailures)
+		}
+		return nil
+	},
+}
+
+var appsCmd = &cli.Command{
+	Name:  "apps",
+	Usage: "manage the apps of running controller",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "list apps",
+			Flags: []cli.Flag{adminWorkingDirFlag},
+			Action: func(cctx *cli.Context) error {
+				client, err := controller.NewAdminClient(cctx.String("working-dir"))
+				if err != nil {
+					return cli.Exit(err.Error(), -1)
+				}
+
+				apps, err := client.Apps()
+				if err != nil {
+					return cli.Exit(err.Error(), -1)
+				}
+
+				printApps(apps)
+				return nil
+			},
+		},
+		appActionCmd("stop", "stop app, it will not start until start or config change"),
+		appActionCmd("start", "start the stopped app"),
+		appActionCmd("restart", "restart app"),
+		appActionCmd("reload", "reload app script from disk"),
+	},
+}
+
+var diagCmd = &cli.Command{
+	Name:  "diag",
+	Usage: "collect the diagnostics bundle of running controller and upload it to server",
+	Flags: []cli.Flag{
+		adminWorkingDirFlag,
+		&cli.IntFlag{
+			Name:  "log-mb",
+			Usage: "the MB of controller log and each app log to collect",
+			Value: 2,
+		},
+		&cli.BoolFlag{
+			Name:  "no-upload",
+			Usage: "only save the bundle in working dir",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		client, err := controller.NewAdminClient(cctx.String("working-dir"))
+		if err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+
+		result, err := client.Diag(cctx.Int("log-mb"), !cctx.Bool("no-upload"))
+		if err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+
+		fmt.Printf("Bundle:      %s\n", result.Path)
+		fmt.Printf("Size:        %d\n", result.Size)
+		if result.Uploaded {
+			fmt.Printf("Uploaded:    yes\n")
+		} else if len(result.UploadError) > 0 {
+			fmt.Printf("Uploaded:    no, %s\n", result.UploadError)
+		}
+		return nil
+	},
+}
+
+func appActionCmd(action, usage string) *cli.Command {
+	return &cli.Command{
+		Name:      action,
+		Usage:     usage,
+		ArgsUsage: "<app name>",
+		Flags:     []cli.Flag{adminWorkingDirFlag},
+		Action: func(cctx *cli.Context) error {
+			appName := cctx.Args().First()
+			if appName == "" {
+				return cli.Exit("app name is required", -1)
+			}
+
+			client, err := controller.NewAdminClient(cctx.String("working-dir"))
+			if err != nil {
+				return cli.Exit(err.Error(), -1)
+			}
+
+			app, err := client.AppAction(appName, action)
+			if err != nil {
+				return cli.Exit(err.Error(), -1)
+			}
+
+			printApps([]*controller.AppStatus{app})
+			return nil
+		},
+	}
+}
+
+// healthSummary return the number of healthy checks, e.g. 2/3, - if app has no health check
+func healthSummary(results []agent.HealthResult) string {
+	if len(results) == 0 {
+		return "-"
+	}
+
+	healthy := 0
+	for _, r := range results {
+		if r.Healthy {
+			healthy++
+		}
+	}
+	return fmt.Sprintf("%d/%d", healthy, len(results))
+}
+
+func printApps(apps []*controller.AppStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tHEALTH\tSCRIPT MD5\tUPTIME\tLAST METRIC\tLAST ERROR")
+	for _, app := range apps {
+		lastMetric := "-"
+		if app.LastMetricTime > 0 {
+			lastMetric = fmt.Sprintf("%s ago", time.Since(time.Unix(app.LastMetricTime, 0)).Round(time.Second))
+		}
+		lastError := app.LastError
+		if len(lastError) == 0 {
+			lastError = app.StateReason
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", app.AppName, app.State, healthSummary(app.Health), app.ScriptMD5,
+			time.Duration(app.Uptime)*time.Second, lastMetric, lastError)
+	}
+	w.Flush()
+}
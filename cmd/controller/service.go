@@ -0,0 +1,57 @@
+package main
+
+import (
+	"agent/common/service"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+var installServiceCmd = &cli.Command{
+	Name:   "install-service",
+	Usage:  "install controller as system service with the run flags, systemd, openrc or sysv",
+	Flags:  append(append([]cli.Flag{}, runCmd.Flags...), service.CommandFlags("titan-controller")...),
+	Before: runCmd.Before,
+	Action: func(cctx *cli.Context) error {
+		exe, err := service.Executable()
+		if err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+
+		workingDir, err := filepath.Abs(cctx.String("working-dir"))
+		if err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+
+		// the log-file of controller is a path
+		args := append([]string{"run"}, service.AbsFlagArgs(service.FlagArgs(cctx, runCmd.Flags, explicitFlags), "log-file")...)
+		spec := &service.Spec{
+			Name:        cctx.String("service-name"),
+			Description: "Titan controller",
+			ExecPath:    exe,
+			Args:        args,
+			WorkingDir:  workingDir,
+			StopTimeout: cctx.Int("shutdown-timeout"),
+		}
+
+		svc := service.New(cctx.String("root"), cctx.Bool("dry-run"), os.Stdout)
+		if err := svc.Install(spec); err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+		return nil
+	},
+}
+
+var uninstallServiceCmd = &cli.Command{
+	Name:  "uninstall-service",
+	Usage: "stop and remove the controller system service",
+	Flags: service.CommandFlags("titan-controller"),
+	Action: func(cctx *cli.Context) error {
+		svc := service.New(cctx.String("root"), cctx.Bool("dry-run"), os.Stdout)
+		if err := svc.Uninstall(cctx.String("service-name")); err != nil {
+			return cli.Exit(err.Error(), -1)
+		}
+		return nil
+	},
+}
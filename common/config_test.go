@@ -0,0 +1,140 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestLoadConfig(t *testing.T) {
+	flags := []cli.Flag{
+		&cli.StringFlag{Name: "working-dir"},
+		&cli.IntFlag{Name: "script-interval"},
+	}
+
+	dir := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	cfg, err := LoadConfig(write(`
+working-dir: /data/titan
+script-interval: 30
+log:
+  level: debug
+dns:
+  doh-servers: [https://dns.example.com]
+  doh-method: post
+limits:
+  download-rate: 1048576
+`), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Flags["working-dir"] != "/data/titan" {
+		t.Fatalf("working-dir: %s", cfg.Flags["working-dir"])
+	}
+
+	if interval, ok := cfg.IntFlag("script-interval"); !ok || interval != 30 {
+		t.Fatalf("script-interval: %d", interval)
+	}
+
+	if cfg.Log.Level != "debug" || cfg.Limits.DownloadRate != 1048576 {
+		t.Fatalf("sections: %+v %+v", cfg.Log, cfg.Limits)
+	}
+
+	if len(cfg.DNS.DoHServers) != 1 || cfg.DNS.DoHMethod != "post" || cfg.DNS.Fallback != nil {
+		t.Fatalf("dns: %+v", cfg.DNS)
+	}
+
+	invalids := []string{
+		"unknown-key: 1",
+		"log:\n  level: verbose",
+		"log:\n  colour: true",
+		"proxy:\n  url: ftp://proxy:21",
+		"dns:\n  doh-servers: [dns.example.com]",
+		"dns:\n  doh-method: put",
+		"tls:\n  cdn:\n    pins: [sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=]",
+		"tls:\n  server:\n    pins: [sha256/abc]",
+		"tls:\n  server:\n    ca-file: /not/exist.pem",
+		"limits:\n  download-rate: -1",
+	}
+	for _, content := range invalids {
+		if _, err := LoadConfig(write(content), flags); err == nil {
+			t.Fatalf("config should be invalid: %s", content)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte("working-dir: /config\nscript-interval: 30\nserver-url: https://config\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_SCRIPT_INTERVAL", "45")
+
+	var workingDir, serverURL string
+	var interval int
+	var explicit map[string]bool
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config"},
+			&cli.StringFlag{Name: "working-dir", EnvVars: []string{"TEST_WORKING_DIR"}},
+			&cli.IntFlag{Name: "script-interval", EnvVars: []string{"TEST_SCRIPT_INTERVAL"}, Value: 60},
+			&cli.StringFlag{Name: "server-url", Value: "http://default"},
+		},
+		Before: func(cctx *cli.Context) error {
+			if configFile := cctx.String("config"); len(configFile) > 0 {
+				cfg, err := LoadConfig(configFile, cctx.App.Flags)
+				if err != nil {
+					return err
+				}
+				explicit = ExplicitFlags(cctx, cctx.App.Flags)
+				return cfg.ApplyFlags(cctx)
+			}
+			return nil
+		},
+		Action: func(cctx *cli.Context) error {
+			if err := CheckRequiredFlags(cctx, "working-dir", "server-url"); err != nil {
+				return err
+			}
+			workingDir = cctx.String("working-dir")
+			interval = cctx.Int("script-interval")
+			serverURL = cctx.String("server-url")
+			return nil
+		},
+		Commands: []*cli.Command{
+			{Name: "noop", Action: func(*cli.Context) error { return nil }},
+		},
+	}
+
+	// command line > env > config file > default
+	if err := app.Run([]string{"agent", "--config", configFile, "--working-dir", "/cli"}); err != nil {
+		t.Fatal(err)
+	}
+	if workingDir != "/cli" || interval != 45 || serverURL != "https://config" {
+		t.Fatalf("unexpected flags, working-dir: %s, script-interval: %d, server-url: %s", workingDir, interval, serverURL)
+	}
+	if !explicit["working-dir"] || !explicit["script-interval"] || explicit["server-url"] {
+		t.Fatalf("unexpected explicit flags %v", explicit)
+	}
+
+	// the default value does not meet the required flag
+	if err := app.Run([]string{"agent", "--working-dir", "/cli"}); err == nil {
+		t.Fatal("expect server-url is required without config file")
+	}
+
+	// the subcommand does not require the flags of main command
+	if err := app.Run([]string{"agent", "noop"}); err != nil {
+		t.Fatalf("subcommand: %v", err)
+	}
+}
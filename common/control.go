@@ -0,0 +1,32 @@
+package common
+
+import "encoding/json"
+
+// the messages on control channel, the server send commands and the controller reply a result for each of them
+const (
+	ControlTypeCommand = "command"
+	ControlTypeResult  = "result"
+)
+
+// the commands that server can push to controller
+const (
+	// poll app configs from server now
+	ControlCmdRefresh = "refresh"
+	// restart app, args: app
+	ControlCmdRestart = "restart"
+	// collect the diagnostics bundle and upload it, args: logMB
+	ControlCmdDiag = "diag"
+	// report the status of controller and apps
+	ControlCmdStatus = "status"
+)
+
+// ControlMessage the frame of control channel, the result has the same ID as the command
+type ControlMessage struct {
+	ID      string            `json:"id"`
+	Type    string            `json:"type"`
+	Command string            `json:"command,omitempty"`
+	Args    map[string]string `json:"args,omitempty"`
+	// the result of command, error is empty on success
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
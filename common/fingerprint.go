@@ -0,0 +1,116 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// The components of hardware fingerprint
+const (
+	FingerprintMachineID = "machine"
+	FingerprintBoardUUID = "board"
+	FingerprintMACs      = "mac"
+	FingerprintDisks     = "disk"
+	FingerprintCPU       = "cpu"
+)
+
+var fingerprintComponents = []string{
+	FingerprintMachineID, FingerprintBoardUUID, FingerprintMACs, FingerprintDisks, FingerprintCPU,
+}
+
+// fingerprintMinCompared the least components both fingerprints have, so that
+// two nodes are not treated as the same by only one component, e.g. the cpu model
+const fingerprintMinCompared = 3
+
+// the components shared by many machines, e.g. the cpu model. They are not indexed to find
+// the candidates, a match has at least one other component the same, see Match
+var fingerprintLowEntropy = map[string]bool{FingerprintCPU: true}
+
+// FingerprintIndexed check if the component is indexed to find the machines with the same hardware
+func FingerprintIndexed(component string) bool {
+	return !fingerprintLowEntropy[component]
+}
+
+// Fingerprint the hashes of hardware components, the raw values are not reported.
+// A component is empty if it can not be read on the platform
+type Fingerprint map[string]string
+
+// HashFingerprintComponent hash the raw value of component, empty for empty value
+func HashFingerprintComponent(component, value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(component + ":" + value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// String encode the fingerprint as 'machine:<hash>,board:<hash>,...', the empty components are omitted
+func (f Fingerprint) String() string {
+	parts := make([]string, 0, len(fingerprintComponents))
+	for _, c := range fingerprintComponents {
+		if len(f[c]) > 0 {
+			parts = append(parts, c+":"+f[c])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseFingerprint decode the string of Fingerprint.String, unknown components are ignored
+func ParseFingerprint(s string) (Fingerprint, error) {
+	f := make(Fingerprint)
+	if len(s) == 0 {
+		return f, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		component, hash, ok := strings.Cut(part, ":")
+		if !ok || len(hash) == 0 {
+			return nil, fmt.Errorf("invalid fingerprint component %q", part)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("invalid fingerprint component %q: %w", part, err)
+		}
+		f[component] = hash
+	}
+
+	for component := range f {
+		if !isFingerprintComponent(component) {
+			delete(f, component)
+		}
+	}
+	return f, nil
+}
+
+func isFingerprintComponent(component string) bool {
+	for _, c := range fingerprintComponents {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare count the components that both fingerprints have, and how many of them differ
+func (f Fingerprint) Compare(other Fingerprint) (compared, differ int) {
+	for _, c := range fingerprintComponents {
+		if len(f[c]) == 0 || len(other[c]) == 0 {
+			continue
+		}
+		compared++
+		if f[c] != other[c] {
+			differ++
+		}
+	}
+	return compared, differ
+}
+
+// Match check if the fingerprints are from the same machine,
+// a single component may change, e.g. a disk or network card is replaced
+func (f Fingerprint) Match(other Fingerprint) bool {
+	compared, differ := f.Compare(other)
+	return compared >= fingerprintMinCompared && differ <= 1
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"testing"
+)
+
+func testFingerprint(values map[string]string) Fingerprint {
+	fp := make(Fingerprint)
+	for component, value := range values {
+		fp[component] = HashFingerprintComponent(component, value)
+	}
+	return fp
+}
+
+func TestFingerprintMatch(t *testing.T) {
+	base := map[string]string{
+		FingerprintMachineID: "5f1a3c",
+		FingerprintBoardUUID: "4c4c4544-0042-3510",
+		FingerprintMACs:      "00:11:22:33:44:55",
+		FingerprintDisks:     "S3Z9NB0K",
+		FingerprintCPU:       "GenuineIntel|Intel(R) Core(TM) i5|8",
+	}
+	fp := testFingerprint(base)
+
+	// os reinstall change the machine id only
+	reinstall := testFingerprint(map[string]string{
+		FingerprintMachineID: "9e8d7c",
+		FingerprintBoardUUID: base[FingerprintBoardUUID],
+		FingerprintMACs:      base[FingerprintMACs],
+		FingerprintDisks:     base[FingerprintDisks],
+		FingerprintCPU:       base[FingerprintCPU],
+	})
+	if !fp.Match(reinstall) {
+		t.Fatalf("single component change should match")
+	}
+
+	// cloned vm has the same machine id, disk and cpu, but different uuid and mac
+	clone := testFingerprint(map[string]string{
+		FingerprintMachineID: base[FingerprintMachineID],
+		FingerprintBoardUUID: "4c4c4544-0042-9999",
+		FingerprintMACs:      "52:54:00:aa:bb:cc",
+		FingerprintDisks:     base[FingerprintDisks],
+		FingerprintCPU:       base[FingerprintCPU],
+	})
+	if fp.Match(clone) {
+		t.Fatalf("two components change should not match")
+	}
+	if _, differ := fp.Compare(clone); differ != 2 {
+		t.Fatalf("expect 2 differ, got %d", differ)
+	}
+
+	// the cpu model only is not enough
+	cpuOnly := testFingerprint(map[string]string{FingerprintCPU: base[FingerprintCPU]})
+	if fp.Match(cpuOnly) {
+		t.Fatalf("too few components should not match")
+	}
+}
+
+func TestFingerprintParse(t *testing.T) {
+	fp := testFingerprint(map[string]string{
+		FingerprintMachineID: "5f1a3c",
+		FingerprintMACs:      "00:11:22:33:44:55",
+		FingerprintDisks:     " ",
+	})
+	if len(fp[FingerprintDisks]) != 0 {
+		t.Fatalf("empty component should have no hash")
+	}
+
+	parsed, err := ParseFingerprint(fp.String() + ",future:abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != fp.String() || len(parsed) != 2 {
+		t.Fatalf("parse %s got %s", fp.String(), parsed.String())
+	}
+
+	if _, err := ParseFingerprint("machine:not-hex"); err == nil {
+		t.Fatalf("expect invalid hash error")
+	}
+}
+
+// the candidates are found by the indexed components only, every match must share one of them
+func TestFingerprintIndexed(t *testing.T) {
+	if FingerprintIndexed(FingerprintCPU) || !FingerprintIndexed(FingerprintMachineID) {
+		t.Fatal("cpu should not be indexed, machine should be")
+	}
+
+	// each component is missing, the same or different
+	combos := 1
+	for range fingerprintComponents {
+		combos *= 3
+	}
+
+	for n := 0; n < combos; n++ {
+		a, b := make(Fingerprint), make(Fingerprint)
+		v := n
+		for _, c := range fingerprintComponents {
+			switch v % 3 {
+			case 1:
+				a[c], b[c] = "01", "01"
+			case 2:
+				a[c], b[c] = "01", "02"
+			}
+			v /= 3
+		}
+
+		if !a.Match(b) {
+			continue
+		}
+
+		shared := false
+		for c, hash := range a {
+			if FingerprintIndexed(c) && b[c] == hash {
+				shared = true
+			}
+		}
+		if !shared {
+			t.Fatalf("%s match %s without indexed component", a.String(), b.String())
+		}
+	}
+}
@@ -0,0 +1,581 @@
+package http
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dohTimeout         = 5 * time.Second
+	dohMaxMessageSize  = 65535
+	dohContentType     = "application/dns-message"
+	defaultCacheSize   = 1024
+	minCacheTTL        = 5 * time.Second
+	maxCacheTTL        = time.Hour
+	negativeCacheTTL   = 30 * time.Second
+	upstreamBackoff    = 5 * time.Second
+	upstreamMaxBackoff = 5 * time.Minute
+	happyEyeballsDelay = 300 * time.Millisecond
+)
+
+var (
+	errNoRecord   = errors.New("no A or AAAA record")
+	errNoUpstream = errors.New("DoH server not configured")
+)
+
+// ResolverConfig the DoH servers and the behavior when they failed
+type ResolverConfig struct {
+	// DoH server urls, '/dns-query' is added if the url has no path
+	Servers []string
+	// send RFC 8484 POST instead of GET
+	Post bool
+	// resolve by system resolver when DoH servers failed or no record found
+	Fallback bool
+	// max hosts in cache
+	CacheSize int
+}
+
+// ResolverConfigFromEnv read config from env,
+// TITAN_DOH_SERVER: comma separated DoH servers,
+// TITAN_DOH_METHOD: get or post,
+// TITAN_DOH_FALLBACK: false to disable system resolver
+func ResolverConfigFromEnv() ResolverConfig {
+	config := ResolverConfig{Fallback: true, CacheSize: defaultCacheSize}
+	for _, server := range strings.Split(os.Getenv("TITAN_DOH_SERVER"), ",") {
+		if server = strings.TrimSpace(server); len(server) > 0 {
+			config.Servers = append(config.Servers, server)
+		}
+	}
+
+	config.Post = strings.EqualFold(os.Getenv("TITAN_DOH_METHOD"), "post")
+	if v := os.Getenv("TITAN_DOH_FALLBACK"); v == "false" || v == "0" {
+		config.Fallback = false
+	}
+	return config
+}
+
+// ParseDoHServer check the DoH server url and add the default path
+func ParseDoHServer(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("unsupported DoH scheme '%s'", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return "", fmt.Errorf("DoH host is empty")
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/dns-query"
+	}
+	return u.String(), nil
+}
+
+type dohUpstream struct {
+	url       string
+	failures  int
+	downUntil time.Time
+}
+
+// Resolver resolve host by DoH servers, it is safe for concurrent use
+type Resolver struct {
+	lock      sync.Mutex
+	config    ResolverConfig
+	upstreams []*dohUpstream
+	cache     *dnsCache
+
+	client *http.Client
+}
+
+// NewResolver create resolver, transport is used to send the DoH queries
+func NewResolver(config ResolverConfig, transport http.RoundTripper) *Resolver {
+	r := &Resolver{
+		client: &http.Client{Timeout: dohTimeout, Transport: transport},
+	}
+	r.SetConfig(config)
+	return r
+}
+
+// SetConfig replace the DoH servers and clear the cache
+func (r *Resolver) SetConfig(config ResolverConfig) {
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultCacheSize
+	}
+
+	upstreams := make([]*dohUpstream, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		u, err := ParseDoHServer(server)
+		if err != nil {
+			log.Errorf("Resolver ignore DoH server %s: %v", server, err)
+			continue
+		}
+		upstreams = append(upstreams, &dohUpstream{url: u})
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.config = config
+	r.upstreams = upstreams
+	r.cache = newDNSCache(config.CacheSize)
+}
+
+func (r *Resolver) current() (ResolverConfig, *dnsCache) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.config, r.cache
+}
+
+// LookupIP return the IPv4 and IPv6 addresses of host
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	config, cache := r.current()
+
+	ips, ok := cache.get(host)
+	if !ok {
+		var ttl time.Duration
+		var err error
+		ips, ttl, err = r.queryUpstreams(ctx, host)
+		switch {
+		case err == nil:
+			cache.add(host, ips, ttl)
+		case errors.Is(err, errNoRecord):
+			cache.add(host, nil, negativeCacheTTL)
+		case errors.Is(err, errNoUpstream):
+			return r.lookupSystem(ctx, host)
+		case config.Fallback:
+			log.Warnf("Resolver DoH lookup %s failed, fallback to system resolver: %v", host, err)
+			return r.lookupSystem(ctx, host)
+		default:
+			return nil, err
+		}
+	}
+
+	if len(ips) == 0 {
+		if config.Fallback {
+			return r.lookupSystem(ctx, host)
+		}
+		return nil, fmt.Errorf("lookup %s: %w", host, errNoRecord)
+	}
+	return ips, nil
+}
+
+func (r *Resolver) lookupSystem(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// orderedUpstreams return the healthy upstreams in config order, then the failed ones
+// that will recover soonest, so a query is tried on all of them
+func (r *Resolver) orderedUpstreams() []*dohUpstream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	healthy := make([]*dohUpstream, 0, len(r.upstreams))
+	down := make([]*dohUpstream, 0)
+	for _, u := range r.upstreams {
+		if now.Before(u.downUntil) {
+			down = append(down, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+
+	sort.SliceStable(down, func(i, j int) bool { return down[i].downUntil.Before(down[j].downUntil) })
+	return append(healthy, down...)
+}
+
+func (r *Resolver) markUpstream(u *dohUpstream, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err == nil {
+		u.failures = 0
+		u.downUntil = time.Time{}
+		return
+	}
+
+	u.failures++
+	backoff := upstreamMaxBackoff
+	if u.failures < 16 {
+		backoff = min(upstreamBackoff<<(u.failures-1), upstreamMaxBackoff)
+	}
+	u.downUntil = time.Now().Add(backoff)
+	log.Warnf("Resolver DoH server %s failed %d times, retry after %s: %v", u.url, u.failures, backoff, err)
+}
+
+func (r *Resolver) queryUpstreams(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	upstreams := r.orderedUpstreams()
+	if len(upstreams) == 0 {
+		return nil, 0, errNoUpstream
+	}
+
+	config, _ := r.current()
+
+	var lastErr error
+	for _, u := range upstreams {
+		ips, ttl, err := r.queryBoth(ctx, u.url, config.Post, host)
+		if err == nil || errors.Is(err, errNoRecord) {
+			r.markUpstream(u, nil)
+			return ips, ttl, err
+		}
+
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+
+		r.markUpstream(u, err)
+		lastErr = err
+	}
+
+	return nil, 0, lastErr
+}
+
+type queryResult struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// queryBoth query A and AAAA at the same time, succeed if any of them succeed
+func (r *Resolver) queryBoth(ctx context.Context, server string, post bool, host string) ([]net.IP, time.Duration, error) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make([]queryResult, len(qtypes))
+
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			ips, ttl, err := r.exchange(ctx, server, post, host, qtype)
+			results[i] = queryResult{ips: ips, ttl: ttl, err: err}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var (
+		ips      []net.IP
+		ttl      time.Duration
+		answered bool
+		lastErr  error
+	)
+	for _, res := range results {
+		if res.err != nil && !errors.Is(res.err, errNoRecord) {
+			lastErr = res.err
+			continue
+		}
+
+		answered = true
+		if len(res.ips) > 0 {
+			ips = append(ips, res.ips...)
+			if ttl == 0 || res.ttl < ttl {
+				ttl = res.ttl
+			}
+		}
+	}
+
+	if !answered {
+		return nil, 0, lastErr
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("lookup %s: %w", host, errNoRecord)
+	}
+	return ips, ttl, nil
+}
+
+// exchange send one RFC 8484 query
+func (r *Resolver) exchange(ctx context.Context, server string, post bool, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	msg.RecursionDesired = true
+	// RFC 8484 4.1, id 0 is cache friendly
+	msg.Id = 0
+
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+	if post {
+		req, err = http.NewRequestWithContext(ctx, "POST", server, bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dohContentType)
+		}
+	} else {
+		sep := "?"
+		if strings.Contains(server, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, "GET", server+sep+"dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query DoH server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH server %s status code: %d", server, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxMessageSize+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("read DoH response: %w", err)
+	}
+	if len(body) > dohMaxMessageSize {
+		return nil, 0, fmt.Errorf("DoH response too large")
+	}
+
+	return parseDNSResponse(body)
+}
+
+// parseDNSResponse return the A and AAAA records and the min ttl,
+// the CNAME records are skipped because DoH servers resolve them
+func parseDNSResponse(response []byte) ([]net.IP, time.Duration, error) {
+	reply := new(dns.Msg)
+	if err := reply.Unpack(response); err != nil {
+		return nil, 0, fmt.Errorf("unpack DNS response: %w", err)
+	}
+
+	switch reply.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, 0, errNoRecord
+	default:
+		return nil, 0, fmt.Errorf("DNS response rcode %s", dns.RcodeToString[reply.Rcode])
+	}
+
+	var (
+		ips []net.IP
+		ttl time.Duration
+	)
+	for _, answer := range reply.Answer {
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		ips = append(ips, ip)
+		if t := time.Duration(answer.Header().Ttl) * time.Second; ttl == 0 || t < ttl {
+			ttl = t
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, errNoRecord
+	}
+	return ips, ttl, nil
+}
+
+type dnsCacheEntry struct {
+	host   string
+	ips    []net.IP
+	expire time.Time
+}
+
+// dnsCache is a LRU cache of resolved hosts, the entry without ips is negative cache
+type dnsCache struct {
+	lock  sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *dnsCache) get(host string) ([]net.IP, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.items[host]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*dnsCacheEntry)
+	if time.Now().After(entry.expire) {
+		c.ll.Remove(elem)
+		delete(c.items, host)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return entry.ips, true
+}
+
+func (c *dnsCache) add(host string, ips []net.IP, ttl time.Duration) {
+	ttl = max(min(ttl, maxCacheTTL), minCacheTTL)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[host]; ok {
+		entry := elem.Value.(*dnsCacheEntry)
+		entry.ips = ips
+		entry.expire = time.Now().Add(ttl)
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[host] = c.ll.PushFront(&dnsCacheEntry{host: host, ips: ips, expire: time.Now().Add(ttl)})
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*dnsCacheEntry).host)
+	}
+}
+
+func (c *dnsCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.ll.Len()
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs dial the addresses as RFC 8305, IPv6 and IPv4 are interleaved
+// and the next attempt starts after a short delay or the previous one failed
+func dialHappyEyeballs(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	ips = sortAddresses(network, ips)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address for network %s", network)
+	}
+	if len(ips) == 1 {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	pending, next := 0, 0
+	var delay <-chan time.Time
+
+	startNext := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- dialResult{conn: conn, err: err}
+		}()
+
+		delay = nil
+		if next < len(ips) {
+			delay = time.After(happyEyeballsDelay)
+		}
+	}
+
+	startNext()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// close the connections that established later
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+
+			lastErr = res.err
+			if next < len(ips) {
+				startNext()
+			}
+		case <-delay:
+			startNext()
+		}
+	}
+
+	return nil, lastErr
+}
+
+// sortAddresses filter the addresses by network and interleave IPv6 and IPv4, IPv6 first
+func sortAddresses(network string, ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch network {
+	case "tcp4", "udp4":
+		return v4
+	case "tcp6", "udp6":
+		return v6
+	}
+
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,234 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testDoHServer answer the A and AAAA queries of records, NXDOMAIN for others
+type testDoHServer struct {
+	*httptest.Server
+	records map[string][]string
+	queries atomic.Int32
+	posts   atomic.Int32
+}
+
+func newTestDoHServer(records map[string][]string) *testDoHServer {
+	s := &testDoHServer{records: records}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *testDoHServer) handle(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+	if r.Method == "POST" {
+		s.posts.Add(1)
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(r.Body)
+	} else {
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	s.queries.Add(1)
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+
+	q := msg.Question[0]
+	ips, ok := s.records[q.Name]
+	if !ok {
+		reply.Rcode = dns.RcodeNameError
+	}
+	for _, ip := range ips {
+		isV4 := net.ParseIP(ip).To4() != nil
+		if isV4 && q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A %s", q.Name, ip))
+			reply.Answer = append(reply.Answer, rr)
+		} else if !isV4 && q.Qtype == dns.TypeAAAA {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN AAAA %s", q.Name, ip))
+			reply.Answer = append(reply.Answer, rr)
+		}
+	}
+
+	b, _ := reply.Pack()
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(b)
+}
+
+func TestResolverLookup(t *testing.T) {
+	server := newTestDoHServer(map[string][]string{
+		"dual.example.com.": {"10.0.0.1", "fd00::1"},
+	})
+	defer server.Close()
+
+	for _, post := range []bool{false, true} {
+		r := NewResolver(ResolverConfig{Servers: []string{server.URL}, Post: post}, http.DefaultTransport)
+
+		ips, err := r.LookupIP(context.Background(), "dual.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 2 {
+			t.Fatalf("expect A and AAAA, got %v", ips)
+		}
+
+		// cached
+		before := server.queries.Load()
+		if _, err := r.LookupIP(context.Background(), "dual.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if server.queries.Load() != before {
+			t.Fatalf("lookup not cached")
+		}
+	}
+
+	if server.posts.Load() == 0 {
+		t.Fatalf("POST not used")
+	}
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	server := newTestDoHServer(map[string][]string{})
+	defer server.Close()
+
+	r := NewResolver(ResolverConfig{Servers: []string{server.URL}}, http.DefaultTransport)
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupIP(context.Background(), "missing.example.com"); err == nil {
+			t.Fatalf("expect no record error")
+		}
+	}
+
+	// A and AAAA of the first lookup
+	if n := server.queries.Load(); n != 2 {
+		t.Fatalf("negative result not cached, %d queries", n)
+	}
+}
+
+func TestResolverFailover(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	server := newTestDoHServer(map[string][]string{
+		"a.example.com.": {"10.0.0.1"},
+		"b.example.com.": {"10.0.0.2"},
+	})
+	defer server.Close()
+
+	r := NewResolver(ResolverConfig{Servers: []string{broken.URL, server.URL}}, http.DefaultTransport)
+	ips, err := r.LookupIP(context.Background(), "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips[0].String() != "10.0.0.1" {
+		t.Fatalf("unexpected ip %v", ips)
+	}
+
+	// the broken server is tried last until it recovers
+	upstreams := r.orderedUpstreams()
+	if upstreams[0].url != server.URL+"/dns-query" {
+		t.Fatalf("broken server not moved back, first %s", upstreams[0].url)
+	}
+
+	if _, err := r.LookupIP(context.Background(), "b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolverNoFallback(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	r := NewResolver(ResolverConfig{Servers: []string{broken.URL}, Fallback: false}, http.DefaultTransport)
+	if _, err := r.LookupIP(context.Background(), "localhost"); err == nil {
+		t.Fatalf("expect error without fallback")
+	}
+
+	r.SetConfig(ResolverConfig{Servers: []string{broken.URL}, Fallback: true})
+	if _, err := r.LookupIP(context.Background(), "localhost"); err != nil {
+		t.Fatalf("fallback to system resolver: %v", err)
+	}
+}
+
+func TestDNSCacheLRU(t *testing.T) {
+	c := newDNSCache(2)
+	c.add("a", []net.IP{net.ParseIP("10.0.0.1")}, time.Minute)
+	c.add("b", []net.IP{net.ParseIP("10.0.0.2")}, time.Minute)
+
+	// 'a' is recently used, 'b' is evicted
+	c.get("a")
+	c.add("c", []net.IP{net.ParseIP("10.0.0.3")}, time.Minute)
+
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("b should be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatalf("a should be cached")
+	}
+	if c.len() != 2 {
+		t.Fatalf("cache size %d", c.len())
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// 127.0.0.2 refuse the connection, the next address is tried at once
+	ips := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+	start := time.Now()
+	conn, err := dialHappyEyeballs(context.Background(), &net.Dialer{}, "tcp", ips, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if d := time.Since(start); d >= happyEyeballsDelay {
+		t.Fatalf("failed address should not wait the delay, took %s", d)
+	}
+
+	sorted := sortAddresses("tcp", []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("fd00::1")})
+	if sorted[0].To4() != nil || sorted[1].String() != "10.0.0.1" {
+		t.Fatalf("addresses not interleaved: %v", sorted)
+	}
+}
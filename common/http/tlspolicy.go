@@ -0,0 +1,171 @@
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const pinPrefix = "sha256/"
+
+// PinError is returned when the certificate chain of host match none of the pins
+type PinError struct {
+	Host string
+	// the pins of the verified chain, leaf first
+	Got []string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("certificate pin mismatch for %s, got %s", e.Host, strings.Join(e.Got, ","))
+}
+
+// IsPinError check if err is caused by certificate pin mismatch
+func IsPinError(err error) bool {
+	var pinErr *PinError
+	return errors.As(err, &pinErr)
+}
+
+// TLSPolicy the CA bundle and SPKI pins of some hosts.
+// The system roots are used if RootCAs is nil, pins are not checked if empty
+type TLSPolicy struct {
+	Hosts   []string
+	RootCAs *x509.CertPool
+	// sha256 of SubjectPublicKeyInfo, any of them match is accepted, so the pins can be rotated
+	Pins [][]byte
+}
+
+// NewTLSPolicy load the CA bundle and parse pins in 'sha256/<base64>' format
+func NewTLSPolicy(hosts []string, caFile string, pins []string) (*TLSPolicy, error) {
+	policy := &TLSPolicy{Hosts: hosts}
+
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		policy.RootCAs = x509.NewCertPool()
+		if !policy.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+
+	for _, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("pin %s: %w", pin, err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("pin %s is not a sha256", pin)
+		}
+		policy.Pins = append(policy.Pins, b)
+	}
+
+	return policy, nil
+}
+
+// SPKIPin return the pin of certificate in 'sha256/<base64>' format
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// TLSConfig return the tls config of host, the chain is verified by RootCAs before pins
+func (p *TLSPolicy) TLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		ServerName: host,
+		RootCAs:    p.RootCAs,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return p.verifyPins(host, cs.VerifiedChains)
+		},
+	}
+}
+
+func (p *TLSPolicy) verifyPins(host string, chains [][]*x509.Certificate) error {
+	if len(p.Pins) == 0 {
+		return nil
+	}
+
+	var got []string
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range p.Pins {
+				if string(pin) == string(sum[:]) {
+					return nil
+				}
+			}
+			got = append(got, SPKIPin(cert))
+		}
+	}
+
+	return &PinError{Host: host, Got: got}
+}
+
+// SetTLSPolicies replace the policies, the hosts without policy use the system roots
+func (d *DNSRoundTripper) SetTLSPolicies(policies []*TLSPolicy) {
+	transports := make(map[string]*http.Transport)
+	for _, policy := range policies {
+		for _, host := range policy.Hosts {
+			transports[strings.ToLower(host)] = &http.Transport{
+				Proxy:           d.Proxy,
+				DialContext:     d.dailContext,
+				TLSClientConfig: policy.TLSConfig(host),
+			}
+		}
+	}
+
+	d.tlsLock.Lock()
+	old := d.tlsTransports
+	d.tlsTransports = transports
+	d.tlsLock.Unlock()
+
+	for _, t := range old {
+		t.CloseIdleConnections()
+	}
+	if t, ok := d.Transport.(*http.Transport); ok {
+		// the idle connections may be verified by old policy
+		t.CloseIdleConnections()
+	}
+}
+
+// HasTLSPolicy check if host has custom CA or pins
+func (d *DNSRoundTripper) HasTLSPolicy(host string) bool {
+	return d.tlsTransport(host) != nil
+}
+
+// TLSClientConfig return the tls config with custom CA or pins of host, nil if host has no policy
+func (d *DNSRoundTripper) TLSClientConfig(host string) *tls.Config {
+	if t := d.tlsTransport(host); t != nil {
+		return t.TLSClientConfig
+	}
+	return nil
+}
+
+func (d *DNSRoundTripper) tlsTransport(host string) *http.Transport {
+	d.tlsLock.RLock()
+	defer d.tlsLock.RUnlock()
+
+	return d.tlsTransports[strings.ToLower(host)]
+}
+
+// PinFailures return how many requests failed by certificate pin mismatch
+func (d *DNSRoundTripper) PinFailures() uint64 {
+	return d.pinFailures.Load()
+}
+
+func (d *DNSRoundTripper) checkPinError(err error) {
+	var pinErr *PinError
+	if errors.As(err, &pinErr) {
+		d.pinFailures.Add(1)
+		log.Errorf("DNSRoundTripper %s", pinErr.Error())
+	}
+}
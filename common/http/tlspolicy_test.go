@@ -0,0 +1,69 @@
+package http
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(server.URL)
+	host := u.Hostname()
+	goodPin := SPKIPin(server.Certificate())
+	oldPin := "sha256/" + "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	rt := NewDNSRoundTripper()
+	client := &http.Client{Timeout: 5 * time.Second, Transport: rt}
+
+	// the test CA is not trusted by system
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatalf("expect unknown authority")
+	}
+
+	// overlapping pins when rotating
+	policy, err := NewTLSPolicy([]string{host}, caFile, []string{oldPin, goodPin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.SetTLSPolicies([]*TLSPolicy{policy})
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	policy, err = NewTLSPolicy([]string{host}, caFile, []string{oldPin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.SetTLSPolicies([]*TLSPolicy{policy})
+
+	_, err = client.Get(server.URL)
+	if !IsPinError(err) {
+		t.Fatalf("expect pin error, got %v", err)
+	}
+	if rt.PinFailures() != 1 {
+		t.Fatalf("pin failures %d", rt.PinFailures())
+	}
+
+	if _, err := NewTLSPolicy([]string{host}, "", []string{"sha256/abc"}); err == nil {
+		t.Fatalf("expect invalid pin")
+	}
+}
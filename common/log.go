@@ -48,16 +48,27 @@ func NewLogRotator(ctx context.Context, dir, basename string, period time.Durati
 
 // Start begins the log rotation and collection process
 func (lr *LogRotator) Start() error {
+	if err := lr.Open(); err != nil {
+		return err
+	}
+	lr.Run()
+	return nil
+}
+
+// Open create the log file of current time slice, so the caller can check
+// the error before handing the readers to Run
+func (lr *LogRotator) Open() error {
 	if lr.period <= 0 {
 		return errors.New("log rotation period must be positive")
 	}
 
 	// Align to current time slice
 	lr.currentTime = lr.alignTime(time.Now())
-	if err := lr.rotateLog(); err != nil {
-		return err
-	}
+	return lr.rotateLog()
+}
 
+// Run rotate the log and collect the readers until they are closed, Open must be called first
+func (lr *LogRotator) Run() {
 	go lr.runRotator()
 
 	var wg sync.WaitGroup
@@ -70,7 +81,6 @@ func (lr *LogRotator) Start() error {
 	}
 
 	wg.Wait()
-	return nil
 }
 
 // alignTime rounds the given time to the nearest time slice boundary
@@ -158,8 +168,10 @@ func (lr *LogRotator) cleanupOldLogs() error {
 	return nil
 }
 
-// runRotator manages the periodic rotation
+// runRotator manages the periodic rotation, the log file is closed when ctx done
 func (lr *LogRotator) runRotator() {
+	defer lr.closeLog()
+
 	// Calculate time until next rotation
 	now := time.Now()
 	next := lr.alignTime(now).Add(lr.period)
@@ -188,23 +200,44 @@ func (lr *LogRotator) runRotator() {
 	}
 }
 
-// collectLogs reads from the input reader and writes to current log file
+// closeLog close the current log file, the logs after it are discarded
+func (lr *LogRotator) closeLog() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if lr.currentFile != nil {
+		_ = lr.currentFile.Close()
+	}
+	lr.currentFile = nil
+	lr.currentWriter = nil
+}
+
+// collectLogs reads from the input reader and writes to current log file.
+// The reader is drained until EOF even if ctx done, so the writer never block on it.
+// A line longer than the buffer is written in chunks
 func (lr *LogRotator) collectLogs(r io.Reader) {
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		select {
-		case <-lr.ctx.Done():
-			return
-		default:
-			line := scanner.Text()
+	br := bufio.NewReaderSize(r, 64*1024)
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) > 0 {
 			lr.mu.Lock()
 			if lr.currentWriter != nil {
-				_, _ = fmt.Fprintln(lr.currentWriter, line)
+				_, _ = lr.currentWriter.Write(chunk)
 			}
 			lr.mu.Unlock()
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Log collection error: %v\n", err)
+
+		if err == nil || err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != io.EOF {
+			fmt.Fprintf(os.Stderr, "Log collection error: %v\n", err)
+			// unblock the writer of pipe
+			if pr, ok := r.(*io.PipeReader); ok {
+				pr.CloseWithError(err)
+			}
+		}
+		return
 	}
 }
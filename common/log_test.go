@@ -0,0 +1,85 @@
+package common
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRotatorLongLine(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader, writer := io.Pipe()
+	lr := NewLogRotator(ctx, dir, "app.log", 24*time.Hour, 0, reader)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- lr.Start()
+	}()
+
+	long := strings.Repeat("x", 200*1024)
+	written := make(chan error, 1)
+	go func() {
+		if _, err := io.WriteString(writer, long+"\n"); err != nil {
+			written <- err
+			return
+		}
+		_, err := io.WriteString(writer, "short\n")
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked by long line")
+	}
+
+	writer.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "app-*.log"))
+	if len(files) != 1 {
+		t.Fatalf("expect 1 log file, got %v", files)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != long+"\nshort\n" {
+		t.Fatalf("unexpected log content of %d bytes", len(b))
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lr.mu.Lock()
+		closed := lr.currentFile == nil
+		lr.mu.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log file not closed after ctx done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLogRotatorOpenError(t *testing.T) {
+	// the log file under a missing dir, like an absolute log-file joined to log-path
+	lr := NewLogRotator(context.Background(), t.TempDir(), "tmp/agent.log", 24*time.Hour, 3)
+	if err := lr.Open(); err == nil {
+		t.Fatal("expect error to open log file in missing dir")
+	}
+}
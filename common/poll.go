@@ -0,0 +1,183 @@
+package common
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// failures count before enter offline mode
+	defaultOfflineThreshold = 3
+	// jitter ratio of the normal poll interval
+	pollJitterRatio = 0.1
+)
+
+// PollScheduler decide when to poll the server next time.
+// On failures it backoff exponentially with jitter, so the fleet will not retry in lockstep
+// after a server outage. The server can change the interval by Retry-After or next-keepalive-interval
+type PollScheduler struct {
+	name       string
+	interval   time.Duration
+	maxBackoff time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// interval hint from server, used by next poll only
+	hint         time.Duration
+	offline      bool
+	offlineSince time.Time
+	rand         *rand.Rand
+}
+
+// NewPollScheduler create a scheduler
+// name: used in log
+// interval: poll interval when server is ok
+// maxBackoff: the max interval when failed
+func NewPollScheduler(name string, interval, maxBackoff time.Duration) *PollScheduler {
+	if maxBackoff < interval {
+		maxBackoff = interval
+	}
+
+	return &PollScheduler{
+		name:       name,
+		interval:   interval,
+		maxBackoff: maxBackoff,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next return the duration to wait before next poll
+func (ps *PollScheduler) Next() time.Duration {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	hint := ps.hint
+	ps.hint = 0
+
+	if ps.failures == 0 {
+		d := ps.interval
+		if hint > 0 {
+			d = hint
+		}
+		return ps.jitter(d, pollJitterRatio)
+	}
+
+	backoff := ps.interval
+	for i := 1; i < ps.failures && backoff < ps.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > ps.maxBackoff {
+		backoff = ps.maxBackoff
+	}
+
+	// equal jitter, wait between backoff/2 and backoff
+	d := backoff/2 + time.Duration(ps.rand.Int63n(int64(backoff/2)+1))
+	if hint > d {
+		d = hint
+	}
+	return d
+}
+
+func (ps *PollScheduler) jitter(d time.Duration, ratio float64) time.Duration {
+	delta := int64(float64(d) * ratio)
+	if delta <= 0 {
+		return d
+	}
+	return d - time.Duration(delta) + time.Duration(ps.rand.Int63n(2*delta+1))
+}
+
+// SetInterval change the normal poll interval, used by config reload
+func (ps *PollScheduler) SetInterval(interval time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.interval = interval
+	if ps.maxBackoff < interval {
+		ps.maxBackoff = interval
+	}
+}
+
+// SetHint set the interval that server want us to wait
+func (ps *PollScheduler) SetHint(hint time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.hint = hint
+}
+
+// Success reset the backoff, leave offline mode if in it
+func (ps *PollScheduler) Success() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.offline {
+		log.Infof("%s reconnect to server after %s offline", ps.name, time.Since(ps.offlineSince).Round(time.Second))
+	}
+
+	ps.failures = 0
+	ps.offline = false
+	ps.offlineSince = time.Time{}
+}
+
+// Failure increase the backoff, enter offline mode after too many failures
+func (ps *PollScheduler) Failure() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.failures == 0 {
+		ps.offlineSince = time.Now()
+	}
+	ps.failures++
+
+	if !ps.offline && ps.failures >= defaultOfflineThreshold {
+		ps.offline = true
+		log.Warnf("%s enter offline mode after %d failures, keep running with cached config", ps.name, ps.failures)
+	}
+}
+
+// Offline return true if in offline mode
+func (ps *PollScheduler) Offline() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.offline
+}
+
+// OfflineDuration return how long the server can not reach, 0 if server is ok
+func (ps *PollScheduler) OfflineDuration() time.Duration {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.failures == 0 {
+		return 0
+	}
+	return time.Since(ps.offlineSince)
+}
+
+// ParseRetryHint get the interval from Retry-After or next-keepalive-interval header, 0 if not set
+func ParseRetryHint(header http.Header) time.Duration {
+	if v := header.Get("Retry-After"); len(v) > 0 {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+
+		if t, err := http.ParseTime(v); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+		}
+	}
+
+	if v := header.Get("next-keepalive-interval"); len(v) > 0 {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return 0
+}
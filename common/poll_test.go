@@ -0,0 +1,58 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPollSchedulerBackoff(t *testing.T) {
+	ps := NewPollScheduler("test", 10*time.Second, 80*time.Second)
+
+	if d := ps.Next(); d < 9*time.Second || d > 11*time.Second {
+		t.Fatalf("normal interval out of range: %s", d)
+	}
+
+	maxes := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 80 * time.Second}
+	for i, max := range maxes {
+		ps.Failure()
+		if d := ps.Next(); d < max/2 || d > max {
+			t.Fatalf("failures %d backoff out of range: %s", i+1, d)
+		}
+	}
+
+	if !ps.Offline() {
+		t.Fatal("should enter offline mode")
+	}
+
+	if ps.OfflineDuration() <= 0 {
+		t.Fatal("offline duration should > 0")
+	}
+
+	ps.SetHint(120 * time.Second)
+	if d := ps.Next(); d != 120*time.Second {
+		t.Fatalf("hint should be used when backoff is shorter: %s", d)
+	}
+
+	ps.Success()
+	if ps.Offline() || ps.OfflineDuration() != 0 {
+		t.Fatal("should leave offline mode")
+	}
+}
+
+func TestParseRetryHint(t *testing.T) {
+	header := http.Header{}
+	if d := ParseRetryHint(header); d != 0 {
+		t.Fatalf("expect 0, got %s", d)
+	}
+
+	header.Set("next-keepalive-interval", "60")
+	if d := ParseRetryHint(header); d != 60*time.Second {
+		t.Fatalf("expect 60s, got %s", d)
+	}
+
+	header.Set("Retry-After", "30")
+	if d := ParseRetryHint(header); d != 30*time.Second {
+		t.Fatalf("expect 30s, got %s", d)
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// path flags are converted to absolute path, the service run in other working dir.
+// The log-file of agent is a file name under log-path, the controller convert its own by AbsFlagArgs
+var pathFlags = map[string]bool{"working-dir": true, "config": true, "log-path": true}
+
+// FlagArgs convert the flags set by command line, env or config file to service args.
+// If explicit is not nil, only the flags in it are converted, so the values from
+// config file still can be changed by editing the file
+func FlagArgs(cctx *cli.Context, flags []cli.Flag, explicit map[string]bool, exclude ...string) []string {
+	excluded := make(map[string]bool)
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+
+	args := make([]string, 0, len(flags))
+	for _, f := range flags {
+		name := f.Names()[0]
+		if excluded[name] || !cctx.IsSet(name) {
+			continue
+		}
+		if explicit != nil && !explicit[name] {
+			continue
+		}
+
+		for _, value := range flagValues(cctx, f, name) {
+			if pathFlags[name] && len(value) > 0 {
+				if abs, err := filepath.Abs(value); err == nil {
+					value = abs
+				}
+			}
+			args = append(args, fmt.Sprintf("--%s=%s", name, value))
+		}
+	}
+	return args
+}
+
+// AbsFlagArgs convert the values of named flags in args to absolute path
+func AbsFlagArgs(args []string, names ...string) []string {
+	for i, arg := range args {
+		for _, name := range names {
+			prefix := "--" + name + "="
+			value, ok := strings.CutPrefix(arg, prefix)
+			if !ok || len(value) == 0 {
+				continue
+			}
+			if abs, err := filepath.Abs(value); err == nil {
+				args[i] = prefix + abs
+			}
+		}
+	}
+	return args
+}
+
+// flagValues return the values of flag, the slice flag is repeated once per element.
+// The values are quoted when the unit is rendered
+func flagValues(cctx *cli.Context, f cli.Flag, name string) []string {
+	switch f.(type) {
+	case *cli.StringSliceFlag:
+		return cctx.StringSlice(name)
+	case *cli.IntSliceFlag:
+		values := make([]string, 0)
+		for _, v := range cctx.IntSlice(name) {
+			values = append(values, strconv.Itoa(v))
+		}
+		return values
+	case *cli.Int64SliceFlag:
+		values := make([]string, 0)
+		for _, v := range cctx.Int64Slice(name) {
+			values = append(values, strconv.FormatInt(v, 10))
+		}
+		return values
+	default:
+		return []string{fmt.Sprintf("%v", cctx.Value(name))}
+	}
+}
+
+// Executable return the absolute path of current binary
+func Executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// CommandFlags return the flags of install-service and uninstall-service
+func CommandFlags(defaultName string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "service-name",
+			Usage: "--service-name " + defaultName,
+			Value: defaultName,
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "--dry-run print the unit instead of install it",
+		},
+		&cli.StringFlag{
+			Name:   "root",
+			Usage:  "--root / install under the root dir",
+			Value:  "/",
+			Hidden: true,
+		},
+	}
+}
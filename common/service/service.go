@@ -0,0 +1,387 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+type InitSystem string
+
+const (
+	Systemd InitSystem = "systemd"
+	OpenRC  InitSystem = "openrc"
+	SysV    InitSystem = "sysv"
+)
+
+// Spec describe the service to install
+type Spec struct {
+	Name        string
+	Description string
+	// absolute path of the binary
+	ExecPath   string
+	Args       []string
+	WorkingDir string
+	// seconds to wait before restart
+	RestartSec int
+	// seconds the process need to stop gracefully, the init system kill it a bit later
+	StopTimeout int
+}
+
+// stopTimeoutMargin the extra seconds before init system kill the process, so the
+// graceful stop is not cut off at the same time as it give up
+const stopTimeoutMargin = 15
+
+// TimeoutStopSec return the seconds before init system kill the process
+func (spec *Spec) TimeoutStopSec() int {
+	return spec.StopTimeout + stopTimeoutMargin
+}
+
+// Command return the exec path and args
+func (spec *Spec) Command() []string {
+	return append([]string{spec.ExecPath}, spec.Args...)
+}
+
+// Service install the service under root, root is '/' except in test
+type Service struct {
+	Root string
+	Init InitSystem
+	// only print what will do when true
+	DryRun bool
+	Out    io.Writer
+}
+
+// New detect the init system under root
+func New(root string, dryRun bool, out io.Writer) *Service {
+	return &Service{Root: root, Init: DetectInitSystem(root), DryRun: dryRun, Out: out}
+}
+
+// DetectInitSystem systemd first, then openrc, sysv as fallback
+func DetectInitSystem(root string) InitSystem {
+	if exists(filepath.Join(root, "run/systemd/system")) {
+		return Systemd
+	}
+
+	if exists(filepath.Join(root, "sbin/openrc-run")) || exists(filepath.Join(root, "sbin/openrc")) {
+		return OpenRC
+	}
+
+	return SysV
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// UnitPath return the path of unit or init script
+func (s *Service) UnitPath(name string) string {
+	switch s.Init {
+	case Systemd:
+		return filepath.Join(s.Root, "etc/systemd/system", name+".service")
+	default:
+		return filepath.Join(s.Root, "etc/init.d", name)
+	}
+}
+
+// Render generate the unit or init script
+func (s *Service) Render(spec *Spec) (string, error) {
+	if len(spec.Name) == 0 || len(spec.ExecPath) == 0 {
+		return "", fmt.Errorf("service name and exec path can not be empty")
+	}
+
+	if spec.RestartSec <= 0 {
+		spec.RestartSec = 10
+	}
+
+	if spec.StopTimeout <= 0 {
+		spec.StopTimeout = 60
+	}
+
+	var tmpl string
+	switch s.Init {
+	case Systemd:
+		tmpl = systemdTemplate
+	case OpenRC:
+		tmpl = openrcTemplate
+	default:
+		tmpl = sysvTemplate
+	}
+
+	t, err := template.New(string(s.Init)).Funcs(template.FuncMap{"shell": quoteShell, "systemd": quoteSystemd}).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, spec); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (s *Service) checkPermission() error {
+	if s.DryRun || s.Root != "/" {
+		return nil
+	}
+
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("service install only support linux")
+	}
+
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("service install must run as root")
+	}
+	return nil
+}
+
+// Install write the unit and enable it
+func (s *Service) Install(spec *Spec) error {
+	if err := s.checkPermission(); err != nil {
+		return err
+	}
+
+	content, err := s.Render(spec)
+	if err != nil {
+		return err
+	}
+
+	unitPath := s.UnitPath(spec.Name)
+	if s.DryRun {
+		fmt.Fprintf(s.Out, "# %s\n%s", unitPath, content)
+		for _, cmd := range s.enableCommands(spec.Name) {
+			fmt.Fprintf(s.Out, "# run: %s\n", strings.Join(cmd, " "))
+		}
+		return nil
+	}
+
+	// the args may contain node key, only root can read the unit
+	mode := os.FileMode(0700)
+	if s.Init == Systemd {
+		mode = 0600
+	}
+
+	if err := os.MkdirAll(filepath.Dir(unitPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(unitPath, []byte(content), mode); err != nil {
+		return err
+	}
+	// WriteFile keep the mode of existing file
+	if err := os.Chmod(unitPath, mode); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.Out, "write %s\n", unitPath)
+
+	return s.run(s.enableCommands(spec.Name))
+}
+
+// Uninstall stop and disable the service, then remove the unit
+func (s *Service) Uninstall(name string) error {
+	if err := s.checkPermission(); err != nil {
+		return err
+	}
+
+	unitPath := s.UnitPath(name)
+	if s.DryRun {
+		for _, cmd := range s.disableCommands(name) {
+			fmt.Fprintf(s.Out, "# run: %s\n", strings.Join(cmd, " "))
+		}
+		fmt.Fprintf(s.Out, "# remove %s\n", unitPath)
+		return nil
+	}
+
+	if err := s.run(s.disableCommands(name)); err != nil {
+		fmt.Fprintf(s.Out, "disable service failed: %v\n", err)
+	}
+
+	if err := os.Remove(unitPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Fprintf(s.Out, "remove %s\n", unitPath)
+
+	if s.Init == Systemd {
+		return s.run([][]string{{"systemctl", "daemon-reload"}})
+	}
+	return nil
+}
+
+func (s *Service) enableCommands(name string) [][]string {
+	switch s.Init {
+	case Systemd:
+		return [][]string{{"systemctl", "daemon-reload"}, {"systemctl", "enable", "--now", name}}
+	case OpenRC:
+		return [][]string{{"rc-update", "add", name, "default"}, {"rc-service", name, "start"}}
+	default:
+		if exists(filepath.Join(s.Root, "usr/sbin/update-rc.d")) {
+			return [][]string{{"update-rc.d", name, "defaults"}, {"service", name, "start"}}
+		}
+		return [][]string{{"chkconfig", "--add", name}, {"service", name, "start"}}
+	}
+}
+
+func (s *Service) disableCommands(name string) [][]string {
+	switch s.Init {
+	case Systemd:
+		return [][]string{{"systemctl", "disable", "--now", name}}
+	case OpenRC:
+		return [][]string{{"rc-service", name, "stop"}, {"rc-update", "del", name, "default"}}
+	default:
+		if exists(filepath.Join(s.Root, "usr/sbin/update-rc.d")) {
+			return [][]string{{"service", name, "stop"}, {"update-rc.d", "-f", name, "remove"}}
+		}
+		return [][]string{{"service", name, "stop"}, {"chkconfig", "--del", name}}
+	}
+}
+
+// run the commands only when install to the real root
+func (s *Service) run(cmds [][]string) error {
+	if s.Root != "/" {
+		return nil
+	}
+
+	for _, args := range cmds {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = s.Out
+		cmd.Stderr = s.Out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(args, " "), err)
+		}
+	}
+	return nil
+}
+
+// quoteShell quote the args for sh
+func quoteShell(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`;&|<>(){}*?#~") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quoteSystemd quote the args for ExecStart, '%' and '$' are special in systemd
+func quoteSystemd(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\;") {
+			arg = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(arg) + "\""
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+const systemdTemplate = `[Unit]
+Description={{.Description}}
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{systemd .Command}}
+WorkingDirectory={{.WorkingDir}}
+Restart=always
+RestartSec={{.RestartSec}}
+KillMode=process
+TimeoutStopSec={{.TimeoutStopSec}}
+StandardOutput=journal
+StandardError=journal
+SyslogIdentifier={{.Name}}
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const openrcTemplate = `#!/sbin/openrc-run
+
+name="{{.Name}}"
+description="{{.Description}}"
+command="{{.ExecPath}}"
+command_args="{{shell .Args}}"
+command_background=true
+directory="{{.WorkingDir}}"
+pidfile="/run/${RC_SVCNAME}.pid"
+output_log="/var/log/${RC_SVCNAME}.log"
+error_log="/var/log/${RC_SVCNAME}.log"
+supervisor=supervise-daemon
+respawn_delay={{.RestartSec}}
+respawn_max=0
+retry="TERM/{{.TimeoutStopSec}}/KILL/5"
+
+depend() {
+	need net
+	after firewall
+}
+`
+
+const sysvTemplate = `#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          {{.Name}}
+# Required-Start:    $network $remote_fs
+# Required-Stop:     $network $remote_fs
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Description:       {{.Description}}
+### END INIT INFO
+
+NAME="{{.Name}}"
+WORKING_DIR="{{.WorkingDir}}"
+PIDFILE="/var/run/$NAME.pid"
+LOGFILE="/var/log/$NAME.log"
+RESTART_SEC={{.RestartSec}}
+
+# keep the process running, restart it when exit
+supervise() {
+	while true; do
+		cd "$WORKING_DIR" && {{shell .Command}} >> "$LOGFILE" 2>&1
+		sleep $RESTART_SEC
+	done
+}
+
+start() {
+	if [ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null; then
+		echo "$NAME is already running"
+		return 0
+	fi
+	supervise &
+	echo $! > "$PIDFILE"
+	echo "$NAME started"
+}
+
+stop() {
+	if [ -f "$PIDFILE" ]; then
+		PID=$(cat "$PIDFILE")
+		pkill -TERM -P "$PID" 2>/dev/null
+		kill -TERM "$PID" 2>/dev/null
+		rm -f "$PIDFILE"
+	fi
+	echo "$NAME stopped"
+}
+
+case "$1" in
+	start) start ;;
+	stop) stop ;;
+	restart) stop; sleep 1; start ;;
+	status)
+		if [ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null; then
+			echo "$NAME is running"
+		else
+			echo "$NAME is not running"
+			exit 3
+		fi
+		;;
+	*) echo "Usage: $0 {start|stop|restart|status}"; exit 1 ;;
+esac
+`
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func testSpec() *Spec {
+	return &Spec{
+		Name:        "titan-agent",
+		Description: "Titan agent",
+		ExecPath:    "/usr/local/bin/agent",
+		Args:        []string{"--working-dir=/data/titan agent", "--server-url=https://example.com"},
+		WorkingDir:  "/data/titan agent",
+	}
+}
+
+func TestDetectInitSystem(t *testing.T) {
+	root := t.TempDir()
+	if init := DetectInitSystem(root); init != SysV {
+		t.Fatalf("expect sysv, got %s", init)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sbin/openrc-run"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if init := DetectInitSystem(root); init != OpenRC {
+		t.Fatalf("expect openrc, got %s", init)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "run/systemd/system"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if init := DetectInitSystem(root); init != Systemd {
+		t.Fatalf("expect systemd, got %s", init)
+	}
+}
+
+func TestInstallSystemd(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "run/systemd/system"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	s := New(root, false, out)
+	if err := s.Install(testSpec()); err != nil {
+		t.Fatal(err)
+	}
+
+	unitPath := filepath.Join(root, "etc/systemd/system/titan-agent.service")
+	b, err := os.ReadFile(unitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit := string(b)
+	for _, want := range []string{
+		`ExecStart=/usr/local/bin/agent "--working-dir=/data/titan agent" --server-url=https://example.com`,
+		"WorkingDirectory=/data/titan agent",
+		"Restart=always",
+		"RestartSec=10",
+		"KillMode=process",
+		"TimeoutStopSec=75",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Fatalf("unit missing %q:\n%s", want, unit)
+		}
+	}
+
+	info, err := os.Stat(unitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("unit should only be readable by root, got %v", info.Mode().Perm())
+	}
+
+	if err := s.Uninstall("titan-agent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(unitPath); !os.IsNotExist(err) {
+		t.Fatal("unit should be removed")
+	}
+}
+
+func TestInstallDryRun(t *testing.T) {
+	root := t.TempDir()
+
+	out := &bytes.Buffer{}
+	s := New(root, true, out)
+	if err := s.Install(testSpec()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "etc/init.d/titan-agent")); !os.IsNotExist(err) {
+		t.Fatal("dry run should not write file")
+	}
+
+	if !strings.Contains(out.String(), `cd "$WORKING_DIR" && /usr/local/bin/agent '--working-dir=/data/titan agent'`) {
+		t.Fatalf("unexpect sysv script:\n%s", out.String())
+	}
+}
+
+func TestFlagArgs(t *testing.T) {
+	flags := []cli.Flag{
+		&cli.StringFlag{Name: "key"},
+		&cli.StringSliceFlag{Name: "net-include"},
+		&cli.IntFlag{Name: "shutdown-timeout", Value: 60},
+	}
+
+	var args []string
+	app := &cli.App{
+		Flags: flags,
+		Action: func(cctx *cli.Context) error {
+			args = FlagArgs(cctx, flags, nil)
+			return nil
+		},
+	}
+	if err := app.Run([]string{"agent", "--key", "a b", "--net-include", "eth0", "--net-include", "wlan*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"--key=a b", "--net-include=eth0", "--net-include=wlan*"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Fatalf("expect %v, got %v", want, args)
+	}
+
+	spec := testSpec()
+	spec.Args = args
+	unit, err := (&Service{Init: Systemd}).Render(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(unit, `ExecStart=/usr/local/bin/agent "--key=a b" --net-include=eth0 --net-include=wlan*`) {
+		t.Fatalf("unexpect unit:\n%s", unit)
+	}
+
+	script, err := (&Service{Init: SysV}).Render(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, `/usr/local/bin/agent '--key=a b' --net-include=eth0 '--net-include=wlan*'`) {
+		t.Fatalf("unexpect script:\n%s", script)
+	}
+}
+
+func TestFlagArgsLogFile(t *testing.T) {
+	flags := []cli.Flag{
+		&cli.StringFlag{Name: "log-path"},
+		&cli.StringFlag{Name: "log-file"},
+	}
+
+	var args []string
+	app := &cli.App{
+		Flags: flags,
+		Action: func(cctx *cli.Context) error {
+			args = FlagArgs(cctx, flags, nil)
+			return nil
+		},
+	}
+	if err := app.Run([]string{"agent", "--log-path", "logs", "--log-file", "agent.log"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the log-file of agent is a file name under log-path
+	logPath, _ := filepath.Abs("logs")
+	want := []string{"--log-path=" + logPath, "--log-file=agent.log"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Fatalf("expect %v, got %v", want, args)
+	}
+
+	// the log-file of controller is a path
+	args = AbsFlagArgs(args, "log-file")
+	logFile, _ := filepath.Abs("agent.log")
+	if args[1] != "--log-file="+logFile || args[0] != want[0] {
+		t.Fatalf("unexpect abs args %v", args)
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"github.com/gbrlsnchs/jwt/v3"
 )
 
+// JwtPayload the claims of node token, exp/iat/nbf are set by server on login
 type JwtPayload struct {
+	jwt.Payload
 	NodeID string
 }
 
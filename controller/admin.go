@@ -0,0 +1,446 @@
+package controller
+
+import (
+	"agent/agent"
+	ahttp "agent/common/http"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	adminSocketFile = "controller.sock"
+	adminTokenFile  = "admin.token"
+	// the address that admin api listen on, format: unix:/path/to/sock or tcp:127.0.0.1:port
+	adminAddrFile = "admin.addr"
+
+	adminCmdTimeout = 30 * time.Second
+)
+
+// AppStatus is the app info return by admin api
+type AppStatus struct {
+	AppName        string `json:"appName"`
+	State          string `json:"state"`
+	StateReason    string `json:"stateReason,omitempty"`
+	ScriptMD5      string `json:"scriptMD5"`
+	StartTime      int64  `json:"startTime"`
+	Uptime         int64  `json:"uptime"`
+	LastMetric     string `json:"lastMetric"`
+	LastMetricTime int64  `json:"lastMetricTime"`
+	LastError      string `json:"lastError"`
+
+	Health []agent.HealthResult `json:"health,omitempty"`
+}
+
+// ControllerStatus is the controller info return by admin api
+type ControllerStatus struct {
+	Version        string `json:"version"`
+	NodeID         string `json:"nodeID"`
+	ServerURL      string `json:"serverURL"`
+	WorkingDir     string `json:"workingDir"`
+	Uptime         int64  `json:"uptime"`
+	Offline        bool   `json:"offline"`
+	OfflineSeconds int64  `json:"offlineSeconds"`
+	AppCount       int    `json:"appCount"`
+	PinFailures    uint64 `json:"pinFailures"`
+	// the control channel to server is connected
+	Control bool `json:"control"`
+}
+
+// serveAdmin start the local admin api, it listen on unix socket in working dir by default,
+// the token in admin.token must be used to access it
+func (c *Controller) serveAdmin(ctx context.Context) {
+	listener, addr, err := c.adminListen()
+	if err != nil {
+		log.Errorf("Controller.serveAdmin listen failed:%v", err)
+		return
+	}
+
+	token, err := c.writeAdminFiles(addr)
+	if err != nil {
+		log.Errorf("Controller.serveAdmin write admin files failed:%v", err)
+		listener.Close()
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", c.handleAdminStatus)
+	mux.HandleFunc("GET /apps", c.handleAdminApps)
+	mux.HandleFunc("POST /apps/{name}/{action}", c.handleAdminAppAction)
+	mux.HandleFunc("POST /diag", c.handleAdminDiag)
+
+	srv := &http.Server{Handler: adminAuth(token, mux)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Infof("Controller admin api listen on %s", addr)
+	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Controller.serveAdmin serve failed:%v", err)
+	}
+}
+
+func (c *Controller) adminDir() string {
+	return filepath.Join(c.args.WorkingDir, agtConfigPath)
+}
+
+func (c *Controller) adminListen() (net.Listener, string, error) {
+	if len(c.args.AdminAddr) > 0 {
+		listener, err := net.Listen("tcp", c.args.AdminAddr)
+		if err != nil {
+			return nil, "", err
+		}
+
+		tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok || !tcpAddr.IP.IsLoopback() {
+			listener.Close()
+			return nil, "", fmt.Errorf("admin addr %s must be loopback", c.args.AdminAddr)
+		}
+		return listener, "tcp:" + listener.Addr().String(), nil
+	}
+
+	if err := os.MkdirAll(c.adminDir(), 0700); err != nil {
+		return nil, "", err
+	}
+
+	sockPath := filepath.Join(c.adminDir(), adminSocketFile)
+	// remove the socket left by last run
+	os.Remove(sockPath)
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := os.Chmod(sockPath, 0600); err != nil {
+		listener.Close()
+		return nil, "", err
+	}
+	return listener, "unix:" + sockPath, nil
+}
+
+// writeAdminFiles generate a new token on every start
+func (c *Controller) writeAdminFiles(addr string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	if err := os.WriteFile(filepath.Join(c.adminDir(), adminTokenFile), []byte(token), 0600); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(c.adminDir(), adminAddrFile), []byte(addr), 0600); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runInLoop run the function in controller Run loop, the apps only can be touched in it
+func (c *Controller) runInLoop(ctx context.Context, fn func() (interface{}, error)) (interface{}, error) {
+	type result struct {
+		v   interface{}
+		err error
+	}
+
+	ch := make(chan result, 1)
+	cmd := func() {
+		v, err := fn()
+		ch <- result{v: v, err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, adminCmdTimeout)
+	defer cancel()
+
+	select {
+	case c.cmdCh <- cmd:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Controller) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	v, err := c.runInLoop(r.Context(), func() (interface{}, error) {
+		return c.status(), nil
+	})
+	adminResult(w, v, err)
+}
+
+// status return the controller status, it must be called in Run loop
+func (c *Controller) status() *ControllerStatus {
+	status := &ControllerStatus{
+		Version:        Version,
+		ServerURL:      c.args.ServerURL,
+		WorkingDir:     c.args.WorkingDir,
+		Uptime:         int64(time.Since(c.startTime).Seconds()),
+		Offline:        c.pollScheduler.Offline(),
+		OfflineSeconds: int64(c.pollScheduler.OfflineDuration().Seconds()),
+		AppCount:       len(c.apps),
+		PinFailures:    ahttp.DefaultDNSRountTripper.PinFailures(),
+		Control:        c.control.Load() != nil,
+	}
+	if c.Config != nil {
+		status.NodeID = c.Config.AgentID
+	}
+	return status
+}
+
+func (c *Controller) handleAdminApps(w http.ResponseWriter, r *http.Request) {
+	v, err := c.runInLoop(r.Context(), func() (interface{}, error) {
+		return c.appStatuses(), nil
+	})
+	adminResult(w, v, err)
+}
+
+// appStatuses return the status of all apps, it must be called in Run loop
+func (c *Controller) appStatuses() []*AppStatus {
+	apps := make([]*AppStatus, 0, len(c.apps))
+	for _, app := range c.apps {
+		apps = append(apps, app.status())
+	}
+	return apps
+}
+
+func (c *Controller) handleAdminAppAction(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	action := r.PathValue("action")
+
+	v, err := c.runInLoop(r.Context(), func() (interface{}, error) {
+		return c.appAction(name, action)
+	})
+	if err != nil {
+		adminResult(w, nil, err)
+		return
+	}
+
+	// stop and restart do not block Run loop, wait the apps stopped here
+	if stopping, ok := v.(chan struct{}); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), appStopTimeout+adminCmdTimeout)
+		defer cancel()
+
+		select {
+		case <-stopping:
+		case <-ctx.Done():
+			adminResult(w, nil, fmt.Errorf("wait app %s stop: %w", name, ctx.Err()))
+			return
+		}
+
+		v, err = c.runInLoop(r.Context(), func() (interface{}, error) {
+			return c.appActionStopped(name, action)
+		})
+	}
+	adminResult(w, v, err)
+}
+
+// appAction stop/start/restart/reload app, it must be called in Run loop.
+// It return the channel closed when the stop is done for stop and restart,
+// then appActionStopped complete the action
+func (c *Controller) appAction(name, action string) (interface{}, error) {
+	app, ok := c.apps[name]
+	if !ok {
+		return nil, fmt.Errorf("app %s not exist", name)
+	}
+	if app.isStopping() {
+		return nil, fmt.Errorf("app %s is stopping", name)
+	}
+
+	switch action {
+	case "stop", "restart":
+		// the dependents start again when the app is ready
+		stopping := c.stopAppAsync(app, c.detachDependents(name))
+		if action == "stop" {
+			app.waiting = false
+		}
+		return stopping, nil
+	case "start":
+		if err := c.startApp(app); err != nil {
+			return nil, err
+		}
+	case "reload":
+		if app.app == nil {
+			return nil, fmt.Errorf("app %s is stopped", name)
+		}
+		app.app.Reload()
+	default:
+		return nil, fmt.Errorf("unsupported action %s", action)
+	}
+
+	log.Infof("Controller %s app %s", action, name)
+	return app.status(), nil
+}
+
+// appActionStopped start the app again for restart after it stopped, it must be called in Run loop
+func (c *Controller) appActionStopped(name, action string) (*AppStatus, error) {
+	app, ok := c.apps[name]
+	if !ok {
+		return nil, fmt.Errorf("app %s not exist", name)
+	}
+
+	if action == "restart" {
+		if err := c.startApp(app); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Infof("Controller %s app %s", action, name)
+	return app.status(), nil
+}
+
+// detachDependents mark the dependents of app waiting and take their applications out,
+// the dependents of them are taken first
+func (c *Controller) detachDependents(name string) []*Application {
+	applications := make([]*Application, 0)
+	for _, app := range c.apps {
+		if app.waiting || app.app == nil || !dependsOn(app.appConfig, name) {
+			continue
+		}
+
+		app.waiting = true
+		applications = append(applications, c.detachDependents(app.appConfig.AppName)...)
+
+		log.Infof("Controller.detachDependents stop %s, it depends on %s", app.appConfig.AppName, name)
+		applications = append(applications, app.app)
+		app.app = nil
+	}
+	return applications
+}
+
+// stopAppAsync stop the app and its dependents out of Run loop. The app is not started
+// again until the stop is done, the returned channel is closed then
+func (c *Controller) stopAppAsync(app *App, dependents []*Application) chan struct{} {
+	stopping := make(chan struct{})
+	app.stopping = stopping
+
+	application := app.app
+	app.app = nil
+
+	go func() {
+		defer close(stopping)
+
+		// the dependents are stopped before the app
+		for _, dependent := range dependents {
+			dependent.Stop()
+		}
+		if application != nil {
+			application.Stop()
+		}
+	}()
+	return stopping
+}
+
+// handleAdminDiag collect the diagnostics bundle, upload it unless upload=false
+func (c *Controller) handleAdminDiag(w http.ResponseWriter, r *http.Request) {
+	logMB, _ := strconv.Atoi(r.URL.Query().Get("logMB"))
+	upload := r.URL.Query().Get("upload") != "false"
+
+	result, err := c.runDiag(r.Context(), logMB, upload, "admin")
+	adminResult(w, result, err)
+}
+
+// stopApp stop the app but keep it in apps, it will not start until start by admin or config change
+func (c *Controller) stopApp(app *App) {
+	// wait the stop started by admin
+	if app.stopping != nil {
+		<-app.stopping
+		app.stopping = nil
+	}
+
+	if app.app == nil {
+		return
+	}
+
+	app.app.Stop()
+	app.app = nil
+}
+
+func (c *Controller) startApp(app *App) error {
+	if app.app != nil {
+		return nil
+	}
+	if app.isStopping() {
+		return fmt.Errorf("app %s is stopping", app.appConfig.AppName)
+	}
+
+	application, err := c.runApplication(app.appConfig)
+	if err != nil {
+		return err
+	}
+	app.app = application
+	app.waiting = false
+	return nil
+}
+
+// isStopping check if the stop started by admin is still in progress
+func (app *App) isStopping() bool {
+	if app.stopping == nil {
+		return false
+	}
+
+	select {
+	case <-app.stopping:
+		app.stopping = nil
+		return false
+	default:
+		return true
+	}
+}
+
+func (app *App) status() *AppStatus {
+	var status *AppStatus
+	if app.app == nil {
+		status = &AppStatus{AppName: app.appConfig.AppName, ScriptMD5: app.appConfig.ScriptMD5}
+	} else {
+		status = app.app.Status()
+	}
+
+	lifecycle := app.lifecycle.status()
+	status.State = lifecycle.State
+	status.StateReason = lifecycle.StateReason
+	return status
+}
+
+func adminResult(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Controller admin encode result failed:%v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AdminClient talk to the admin api of running controller
+type AdminClient struct {
+	token  string
+	client *http.Client
+	// base url for http request
+	baseURL string
+}
+
+// NewAdminClient read the address and token of admin api from working dir
+func NewAdminClient(workingDir string) (*AdminClient, error) {
+	dir := filepath.Join(workingDir, agtConfigPath)
+
+	addr, err := os.ReadFile(filepath.Join(dir, adminAddrFile))
+	if err != nil {
+		return nil, fmt.Errorf("controller is not running or admin api is disabled: %w", err)
+	}
+
+	token, err := os.ReadFile(filepath.Join(dir, adminTokenFile))
+	if err != nil {
+		return nil, err
+	}
+
+	network, address, ok := strings.Cut(strings.TrimSpace(string(addr)), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid admin addr %s", string(addr))
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+
+	return &AdminClient{
+		token:   strings.TrimSpace(string(token)),
+		client:  &http.Client{Transport: transport, Timeout: adminCmdTimeout + 5*time.Second},
+		baseURL: "http://controller",
+	}, nil
+}
+
+func (ac *AdminClient) Status() (*ControllerStatus, error) {
+	status := &ControllerStatus{}
+	if err := ac.do("GET", "/status", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (ac *AdminClient) Apps() ([]*AppStatus, error) {
+	apps := make([]*AppStatus, 0)
+	if err := ac.do("GET", "/apps", &apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// AppAction action: stop, start, restart, reload
+func (ac *AdminClient) AppAction(appName, action string) (*AppStatus, error) {
+	status := &AppStatus{}
+	uri := fmt.Sprintf("/apps/%s/%s", url.PathEscape(appName), url.PathEscape(action))
+	// stop and restart wait the app stopped
+	if err := ac.doTimeout("POST", uri, status, appStopTimeout+2*adminCmdTimeout+5*time.Second); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Diag collect the diagnostics bundle, it is uploaded to server if upload is true
+func (ac *AdminClient) Diag(logMB int, upload bool) (*DiagResult, error) {
+	result := &DiagResult{}
+	uri := fmt.Sprintf("/diag?logMB=%d&upload=%t", logMB, upload)
+	if err := ac.doTimeout("POST", uri, result, diagTimeout+5*time.Second); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (ac *AdminClient) do(method, uri string, result interface{}) error {
+	return ac.doTimeout(method, uri, result, ac.client.Timeout)
+}
+
+func (ac *AdminClient) doTimeout(method, uri string, result interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, ac.baseURL+uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ac.token)
+
+	client := *ac.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		errResult := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(body, &errResult) == nil && len(errResult.Error) > 0 {
+			return fmt.Errorf("%s", errResult.Error)
+		}
+		return fmt.Errorf("status code: %d, msg: %s", resp.StatusCode, string(body))
+	}
+
+	return json.Unmarshal(body, result)
+}
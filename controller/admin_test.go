@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppActionStopping(t *testing.T) {
+	app := &App{appConfig: &AppConfig{AppName: "x"}, lifecycle: newAppLifecycle("x")}
+	c := &Controller{apps: map[string]*App{"x": app}}
+
+	v, err := c.appAction("x", "stop")
+	if err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	stopping, ok := v.(chan struct{})
+	if !ok {
+		t.Fatalf("expect stop return channel, got %T", v)
+	}
+
+	select {
+	case <-stopping:
+	case <-time.After(time.Second):
+		t.Fatal("stop of stopped app should be done at once")
+	}
+	if app.isStopping() || app.stopping != nil {
+		t.Fatal("stop is done")
+	}
+
+	// the app can not start before the stop is done
+	app.stopping = make(chan struct{})
+	if _, err := c.appAction("x", "start"); err == nil {
+		t.Fatal("expect error to start a stopping app")
+	}
+	if err := c.startApp(app); err == nil {
+		t.Fatal("expect error to start a stopping app")
+	}
+
+	close(app.stopping)
+	if app.isStopping() {
+		t.Fatal("stop is done")
+	}
+}
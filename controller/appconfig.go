@@ -1,5 +1,7 @@
 package controller
 
+import "agent/agent"
+
 type AppConfig struct {
 	AppName string `json:"appName"`
 	// relative app dir
@@ -7,4 +9,10 @@ type AppConfig struct {
 	ScriptName string `json:"scriptName"`
 	ScriptMD5  string `json:"scriptMD5"`
 	ScriptURL  string `json:"scriptURL"`
+	// seconds for the new version to be ready before revert, use the controller default if 0
+	CanaryTimeout int `json:"canaryTimeout,omitempty"`
+	// the apps must meet the condition before this app start
+	DependsOn []AppDependency `json:"dependsOn,omitempty"`
+	// the probes run by controller independently of the script
+	HealthChecks []agent.HealthCheck `json:"healthChecks,omitempty"`
 }
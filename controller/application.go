@@ -5,12 +5,23 @@ import (
 	"context"
 	"crypto/md5"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// the default budget for an app to stop
+	appStopTimeout = 30 * time.Second
+	// time to kill the processes after the lua 'stop' function timeout
+	appStopKillMargin = time.Second
+)
+
 type AppArguments struct {
 	ControllerArgs *ConrollerArgs
 	AppConfig      *AppConfig
@@ -28,10 +39,31 @@ type Application struct {
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 	stopCh    chan bool
+	// the budget of script stop, set before ctxCancel
+	stopCtx context.Context
 
 	controller *Controller
 
-	//
+	// keep the usage across script reload
+	usageTracker *agent.UsageTracker
+	// the health checks in app config, run until app stop
+	healthChecker *agent.HealthChecker
+
+	reloadCh chan struct{}
+
+	lifecycle *appLifecycle
+	// the last script error that has been reported as degraded
+	lastScriptError string
+	// the failed health check that turned the app to degraded
+	healthReason string
+	// the script called agent.ready() or sent metric without error
+	ready atomic.Bool
+
+	// protect the fields read by admin api
+	mu             sync.Mutex
+	startTime      time.Time
+	lastMetric     string
+	lastMetricTime time.Time
 }
 
 func NewApplication(args *AppArguments, controller *Controller) (*Application, error) {
@@ -50,20 +82,35 @@ func NewApplication(args *AppArguments, controller *Controller) (*Application, e
 	info := agent.NewBaseInfo(nil, appInfo)
 
 	if controller != nil {
-		info.SetToken(controller.token)
+		info.SetToken(controller.tokens.Token())
 	}
 
+	var lifecycle *appLifecycle
+	if controller != nil {
+		lifecycle = controller.lifecycles.get(args.AppConfig.AppName)
+	} else {
+		lifecycle = newAppLifecycle(args.AppConfig.AppName)
+	}
+	lifecycle.setState(appStateStarting, "")
+
 	ctx, cancel := context.WithCancel(context.Background())
+	usageTracker := agent.NewUsageTracker()
 	app := &Application{
-		baseInfo:   info,
-		args:       args,
-		stopCh:     make(chan bool),
-		ctx:        ctx,
-		ctxCancel:  cancel,
-		controller: controller,
+		baseInfo:      info,
+		args:          args,
+		stopCh:        make(chan bool, 1),
+		ctx:           ctx,
+		ctxCancel:     cancel,
+		controller:    controller,
+		usageTracker:  usageTracker,
+		healthChecker: agent.NewHealthChecker(args.AppConfig.HealthChecks, usageTracker),
+		reloadCh:      make(chan struct{}, 1),
+		startTime:     time.Now(),
+		lifecycle:     lifecycle,
 	}
 
 	if err := app.loadScript(); err != nil {
+		lifecycle.setState(appStateFailed, fmt.Sprintf("load script: %s", err.Error()))
 		return nil, err
 	}
 
@@ -72,23 +119,81 @@ func NewApplication(args *AppArguments, controller *Controller) (*Application, e
 	return app, nil
 }
 
+// Stop stop the app in appStopTimeout
 func (app *Application) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), appStopTimeout)
+	defer cancel()
+
+	if err := app.StopContext(ctx); err != nil {
+		log.Error(err)
+	}
+}
+
+// StopContext stop the app, return error if the app not stop before ctx done
+func (app *Application) StopContext(ctx context.Context) error {
 	// app.eventsChan <- &StopEvent{}
+	app.mu.Lock()
+	app.stopCtx = ctx
+	app.mu.Unlock()
+
+	app.lifecycle.setState(appStateStopping, "")
 	app.ctxCancel()
-	<-app.stopCh
-	log.Printf("app %s stop", app.args.AppConfig.AppName)
+
+	select {
+	case <-app.stopCh:
+		log.Printf("app %s stop", app.args.AppConfig.AppName)
+		app.lifecycle.setState(appStateStopped, "")
+		return nil
+	case <-ctx.Done():
+		err := fmt.Errorf("app %s stop timeout: %w", app.args.AppConfig.AppName, ctx.Err())
+		app.lifecycle.setState(appStateFailed, err.Error())
+		return err
+	}
+}
+
+// scriptStopContext leave time to kill the processes before the stop budget,
+// the script reserve the SIGTERM grace period of it before the lua 'stop' function
+func (app *Application) scriptStopContext() (context.Context, context.CancelFunc) {
+	app.mu.Lock()
+	ctx := app.stopCtx
+	app.mu.Unlock()
+
+	if ctx == nil {
+		return context.WithTimeout(context.Background(), appStopTimeout)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, deadline.Add(-appStopKillMargin))
+	}
+	return context.WithCancel(ctx)
 }
 
 func (app *Application) Run() error {
 	loop := true
 
+	app.lifecycle.setState(appStateRunning, "")
+	app.checkScriptError()
+
+	app.healthChecker.Run(app.ctx)
+	app.usageTracker.Run(app.ctx)
+
 	for loop {
 		script := app.currentScript()
 		select {
 		case ev := <-script.Events():
 			script.HandleEvent(ev)
+			app.checkScriptError()
 		case metric := <-script.Metric():
 			log.Info("metric:", metric)
+			app.mu.Lock()
+			app.lastMetric = metric
+			app.lastMetricTime = time.Now()
+			app.mu.Unlock()
+
+			if app.lifecycle.current() == appStateRunning {
+				app.ready.Store(true)
+			}
+
 			appMetric := AppMetric{
 				AppConfig: AppConfig{AppName: app.args.AppConfig.AppName},
 				Metric:    metric,
@@ -97,8 +202,29 @@ func (app *Application) Run() error {
 			if app.controller != nil {
 				app.controller.pushMetric(appMetric)
 			}
+		case <-app.healthChecker.Changed():
+			app.checkHealth()
+		case <-script.Ready():
+			log.Infof("app %s is ready", app.args.AppConfig.AppName)
+			app.ready.Store(true)
+		case <-app.reloadCh:
+			if err := app.loadScript(); err != nil {
+				log.Errorf("app %s reload script failed:%v", app.args.AppConfig.AppName, err)
+				continue
+			}
+			app.renewScript()
+			if app.controller != nil {
+				app.controller.stats.scriptReloads.Add(1)
+			}
+
+			// the new script start without error
+			app.lastScriptError = ""
+			app.lifecycle.setState(appStateRunning, "script reloaded")
+			app.checkScriptError()
 		case <-app.ctx.Done():
-			script.Stop()
+			ctx, cancel := app.scriptStopContext()
+			script.StopContext(ctx)
+			cancel()
 			loop = false
 			log.Info("ctx done, Run() will quit")
 		}
@@ -108,6 +234,58 @@ func (app *Application) Run() error {
 	return nil
 }
 
+// checkScriptError turn the app to degraded when the script has new error,
+// it is called in Run after the script code executed
+func (app *Application) checkScriptError() {
+	lastError := app.currentScript().LastError()
+	if len(lastError) == 0 || lastError == app.lastScriptError {
+		return
+	}
+
+	app.lastScriptError = lastError
+	app.lifecycle.setState(appStateDegraded, lastError)
+}
+
+// checkHealth turn the running app to degraded when its health checks fail,
+// and back to running when they recover, it is called in Run
+func (app *Application) checkHealth() {
+	reason := app.healthChecker.Unhealthy()
+	state := app.lifecycle.current()
+
+	if len(reason) > 0 {
+		if state == appStateRunning {
+			app.healthReason = reason
+			app.lifecycle.setState(appStateDegraded, reason)
+		}
+		return
+	}
+
+	// only recover the degraded state caused by health checks
+	if state == appStateDegraded && len(app.healthReason) > 0 && app.lifecycle.status().StateReason == app.healthReason {
+		app.lifecycle.setState(appStateRunning, "health checks recovered")
+	}
+	app.healthReason = ""
+}
+
+// IsReady check if the app report it is ready and all its health checks pass
+func (app *Application) IsReady() bool {
+	return app.ready.Load() && app.healthChecker.Healthy()
+}
+
+// Usage return the resource usage of processes started by app
+func (app *Application) Usage() agent.AppUsage {
+	return app.usageTracker.Usage()
+}
+
+// Health return the latest results of health checks, nil if app has no health check
+func (app *Application) Health() []agent.HealthResult {
+	results := app.healthChecker.Results()
+	if len(results) == 0 {
+		return nil
+	}
+	return results
+}
+
 func (app *Application) currentScript() *agent.Script {
 	return app.script
 }
@@ -120,9 +298,68 @@ func (app *Application) renewScript() {
 
 	// appDir := path.Join(app.args.AppsWorkingDir, app.args.AppConfig.AppDir)
 	script := agent.NewScript(app.baseInfo, app.scriptFileMD5, app.scriptFileContent)
+	script.SetLogger(app.newLogger())
+	script.SetUsageTracker(app.usageTracker)
+	script.SetHealthChecker(app.healthChecker)
 	script.Start()
 
+	app.mu.Lock()
 	app.script = script
+	app.mu.Unlock()
+}
+
+// EventQueueLen return the number of script events wait to handle
+func (app *Application) EventQueueLen() int {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	return app.script.EventQueueLen()
+}
+
+// Reload load the script from disk and restart it, without restart the app
+func (app *Application) Reload() {
+	select {
+	case app.reloadCh <- struct{}{}:
+	default:
+	}
+}
+
+// Status return the app status for admin api
+func (app *Application) Status() *AppStatus {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	status := &AppStatus{
+		AppName:    app.args.AppConfig.AppName,
+		State:      app.lifecycle.current(),
+		ScriptMD5:  app.script.FileMD5(),
+		StartTime:  app.startTime.Unix(),
+		Uptime:     int64(time.Since(app.startTime).Seconds()),
+		LastMetric: app.lastMetric,
+		LastError:  app.script.LastError(),
+		Health:     app.Health(),
+	}
+
+	if !app.lastMetricTime.IsZero() {
+		status.LastMetricTime = app.lastMetricTime.Unix()
+	}
+
+	return status
+}
+
+// newLogger return a logger that tag the output with app name and script md5.
+// The entries are forwarded to the std logger, so a reloaded log level or
+// format applies to the app logs too
+func (app *Application) newLogger() *log.Logger {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.SetFormatter(discardFormatter{})
+	logger.SetLevel(log.TraceLevel)
+	logger.AddHook(&StdLogHook{
+		Fields: log.Fields{"app": app.args.AppConfig.AppName, "scriptMD5": app.scriptFileMD5},
+	})
+
+	return logger
 }
 
 func (app *Application) loadScript() error {
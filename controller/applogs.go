@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"agent/agent"
+	ahttp "agent/common/http"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// header set by server when it want the app logs, format: app1=200,app2=100
+	uploadAppLogsHeader = "Upload-App-Logs"
+	defaultAppLogLines  = 200
+	maxAppLogLines      = 5000
+)
+
+// parseUploadAppLogs parse the header value to map[appName]lines
+func parseUploadAppLogs(value string) map[string]int {
+	reqs := make(map[string]int)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		appName, linesStr, _ := strings.Cut(item, "=")
+		lines, err := strconv.Atoi(linesStr)
+		if err != nil || lines <= 0 {
+			lines = defaultAppLogLines
+		}
+		if lines > maxAppLogLines {
+			lines = maxAppLogLines
+		}
+
+		reqs[appName] = lines
+	}
+	return reqs
+}
+
+// uploadAppLogs run out of Run loop, the app configs are got in it
+func (c *Controller) uploadAppLogs(value string) {
+	reqs := parseUploadAppLogs(value)
+	v, err := c.runInLoop(context.Background(), func() (interface{}, error) {
+		appConfigs := make(map[string]*AppConfig)
+		for appName := range reqs {
+			if appConfig := c.findAppConfig(appName); appConfig != nil {
+				appConfigs[appName] = appConfig
+			}
+		}
+		return appConfigs, nil
+	})
+	if err != nil {
+		log.Errorf("Controller.uploadAppLogs get app configs failed: %s", err.Error())
+		return
+	}
+	appConfigs := v.(map[string]*AppConfig)
+
+	for appName, lines := range reqs {
+		appConfig := appConfigs[appName]
+		if appConfig == nil {
+			log.Errorf("Controller.uploadAppLogs app %s not exist", appName)
+			continue
+		}
+
+		appDir := path.Join(c.args.WorkingDir, c.args.RelAppsDir, appConfig.AppDir)
+		logs, err := agent.TailAppLog(appDir, lines)
+		if err != nil {
+			log.Errorf("Controller.uploadAppLogs tail %s log failed: %s", appName, err.Error())
+			continue
+		}
+
+		if err := c.pushAppLogs(appName, logs); err != nil {
+			log.Errorf("Controller.uploadAppLogs push %s log failed: %s", appName, err.Error())
+		}
+	}
+}
+
+// findAppConfig it must be called in Run loop
+func (c *Controller) findAppConfig(appName string) *AppConfig {
+	for _, appConfig := range c.appConfigs {
+		if appConfig.AppName == appName {
+			return appConfig
+		}
+	}
+	return nil
+}
+
+func (c *Controller) pushAppLogs(appName string, lines []string) error {
+	url := fmt.Sprintf("%s%s?app=%s", c.args.ServerURL, "/push/applogs", url.QueryEscape(appName))
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+	defer cancel()
+
+	body := strings.Join(lines, "\n")
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader([]byte(body)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		return req, nil
+	}
+
+	client := &http.Client{
+		Timeout:   httpTimeout,
+		Transport: ahttp.DefaultDNSRountTripper,
+	}
+
+	resp, err := c.doWithToken(client, newReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pushAppLogs status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+	}
+
+	return nil
+}
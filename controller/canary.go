@@ -0,0 +1,348 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	ahttp "agent/common/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the time for new version to be ready, it can be changed by controller args or app config
+	defaultCanaryTimeout = 5 * time.Minute
+
+	rolloutCommitted = "committed"
+	rolloutReverted  = "reverted"
+
+	// the canaries and rejected configs are saved next to the app configs, so they survive a restart
+	canaryStateFileName = "canary.json"
+)
+
+// appCanary the new version of app on trial, the previous version is restored if it is not ready in time
+type appCanary struct {
+	prevConfig *AppConfig
+	// the script of previous version, the new one has overwritten it on disk
+	prevScript []byte
+	newConfig  *AppConfig
+	start      time.Time
+	deadline   time.Time
+}
+
+// savedCanary the persisted appCanary, the trial is restarted after the controller restart
+type savedCanary struct {
+	PrevConfig *AppConfig `json:"prevConfig"`
+	PrevScript []byte     `json:"prevScript"`
+	NewConfig  *AppConfig `json:"newConfig"`
+}
+
+type canaryState struct {
+	Canaries map[string]*savedCanary `json:"canaries,omitempty"`
+	Rejected map[string]*AppConfig   `json:"rejected,omitempty"`
+}
+
+// RolloutResult the outcome of app config change, reported to server
+type RolloutResult struct {
+	AppName  string `json:"appName"`
+	FromMD5  string `json:"fromMD5"`
+	ToMD5    string `json:"toMD5"`
+	Result   string `json:"result"`
+	Reason   string `json:"reason,omitempty"`
+	Duration int64  `json:"duration"`
+	Time     int64  `json:"time"`
+}
+
+func (c *Controller) canaryTimeout(appConfig *AppConfig) time.Duration {
+	if appConfig.CanaryTimeout > 0 {
+		return time.Duration(appConfig.CanaryTimeout) * time.Second
+	}
+	if c.args.CanaryTimeout > 0 {
+		return time.Duration(c.args.CanaryTimeout) * time.Second
+	}
+	return defaultCanaryTimeout
+}
+
+// upgradeApp replace the running app with new config, the old one is stopped first
+// because they share the app dir. The new version is committed when ready, or reverted by checkCanaries
+func (c *Controller) upgradeApp(app *App, appConfig *AppConfig) {
+	canary, ok := c.canaries[appConfig.AppName]
+	if !ok {
+		// the new version is on trial, the last good version is still the previous one
+		canary = &appCanary{prevConfig: app.appConfig, prevScript: app.app.scriptFileContent}
+	}
+	canary.newConfig = appConfig
+	canary.start = time.Now()
+	canary.deadline = canary.start.Add(c.canaryTimeout(appConfig))
+	c.canaries[appConfig.AppName] = canary
+	c.saveCanaries(nil)
+
+	c.stopApp(app)
+
+	log.Infof("Controller.upgradeApp %s %s -> %s, wait ready in %s", appConfig.AppName, canary.prevConfig.ScriptMD5, appConfig.ScriptMD5, canary.deadline.Sub(canary.start))
+	application, err := c.runApplication(appConfig)
+	if err != nil {
+		delete(c.apps, appConfig.AppName)
+		c.revertCanary(canary, fmt.Sprintf("start failed: %s", err.Error()))
+		return
+	}
+	c.apps[appConfig.AppName] = &App{appConfig: appConfig, app: application, lifecycle: c.lifecycles.get(appConfig.AppName)}
+	c.stats.scriptReloads.Add(1)
+}
+
+// checkCanaries commit the ready canaries and revert the failed or timeout ones, it must be called in Run loop
+func (c *Controller) checkCanaries() {
+	for name, canary := range c.canaries {
+		app, ok := c.apps[name]
+		if !ok || app.appConfig != canary.newConfig {
+			// removed or replaced by another config
+			delete(c.canaries, name)
+			c.saveCanaries(nil)
+			continue
+		}
+
+		if app.waiting {
+			// restored at startup, wait the dependencies
+			continue
+		}
+
+		if app.app == nil {
+			// stopped by admin, the new config is kept
+			log.Infof("Controller.checkCanaries %s stopped, give up the canary", name)
+			delete(c.canaries, name)
+			c.saveCanaries(nil)
+			continue
+		}
+
+		state := app.lifecycle.current()
+		switch {
+		case state == appStateRunning && app.app.IsReady():
+			c.commitCanary(canary)
+		case state == appStateDegraded || state == appStateFailed:
+			c.revertCanary(canary, fmt.Sprintf("app %s: %s", state, app.lifecycle.status().StateReason))
+		case time.Now().After(canary.deadline):
+			c.revertCanary(canary, fmt.Sprintf("not ready in %s", canary.deadline.Sub(canary.start)))
+		}
+	}
+}
+
+func (c *Controller) commitCanary(canary *appCanary) {
+	name := canary.newConfig.AppName
+	delete(c.canaries, name)
+	c.saveCanaries(nil)
+
+	log.Infof("Controller.commitCanary %s %s committed", name, canary.newConfig.ScriptMD5)
+	c.reportRollout(canary, rolloutCommitted, "")
+}
+
+// revertCanary restore the previous script and config, the new config is rejected until server change it
+func (c *Controller) revertCanary(canary *appCanary, reason string) {
+	name := canary.newConfig.AppName
+	delete(c.canaries, name)
+
+	log.Errorf("Controller.revertCanary %s %s -> %s: %s", name, canary.newConfig.ScriptMD5, canary.prevConfig.ScriptMD5, reason)
+	c.reportRollout(canary, rolloutReverted, reason)
+
+	if app, ok := c.apps[name]; ok {
+		c.stopDependents(name)
+		c.stopApp(app)
+		delete(c.apps, name)
+	}
+
+	c.rejectedConfigs[name] = canary.newConfig
+	c.saveCanaries(nil)
+
+	if err := c.saveScript(canary.prevScript, canary.prevConfig); err != nil {
+		log.Errorf("Controller.revertCanary restore script of %s failed: %s", name, err.Error())
+		return
+	}
+
+	for i, appConfig := range c.appConfigs {
+		if appConfig.AppName == name {
+			c.appConfigs[i] = canary.prevConfig
+		}
+	}
+	if err := c.saveAppConfigs(c.appConfigs); err != nil {
+		log.Errorf("Controller.revertCanary save app configs failed: %s", err.Error())
+	}
+	c.appConfigsMD5 = c.configMD5(c.appConfigs)
+
+	application, err := c.runApplication(canary.prevConfig)
+	if err != nil {
+		log.Errorf("Controller.revertCanary start %s failed: %s", name, err.Error())
+		return
+	}
+	c.apps[name] = &App{appConfig: canary.prevConfig, app: application, lifecycle: c.lifecycles.get(name)}
+}
+
+// filterRejectedConfigs keep the current config of apps that the new config has been reverted,
+// the rejected config is forgotten when server send a different one
+func (c *Controller) filterRejectedConfigs(appConfigs []*AppConfig) []*AppConfig {
+	filtered := make([]*AppConfig, 0, len(appConfigs))
+	for _, appConfig := range appConfigs {
+		rejected, ok := c.rejectedConfigs[appConfig.AppName]
+		if ok && !c.isAppConfigChange(rejected, appConfig) {
+			if app, ok := c.apps[appConfig.AppName]; ok {
+				filtered = append(filtered, app.appConfig)
+				continue
+			}
+		} else if ok {
+			delete(c.rejectedConfigs, appConfig.AppName)
+		}
+		filtered = append(filtered, appConfig)
+	}
+	return filtered
+}
+
+func (c *Controller) canaryStatePath() string {
+	return path.Join(c.args.WorkingDir, c.args.RelAppsDir, canaryStateFileName)
+}
+
+// saveCanaryState write the canaries and rejected configs to disk, the pending canaries
+// are the upgrades whose script is about to be overwritten
+func (c *Controller) saveCanaryState(pending map[string]*appCanary) error {
+	state := &canaryState{
+		Canaries: make(map[string]*savedCanary, len(c.canaries)+len(pending)),
+		Rejected: c.rejectedConfigs,
+	}
+	for _, canaries := range []map[string]*appCanary{c.canaries, pending} {
+		for name, canary := range canaries {
+			state.Canaries[name] = &savedCanary{PrevConfig: canary.prevConfig, PrevScript: canary.prevScript, NewConfig: canary.newConfig}
+		}
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	filePath := c.canaryStatePath()
+	if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// replaced atomically, a torn file would lose the last good script
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+func (c *Controller) saveCanaries(pending map[string]*appCanary) {
+	if err := c.saveCanaryState(pending); err != nil {
+		log.Errorf("Controller.saveCanaryState failed: %s", err.Error())
+	}
+}
+
+// loadCanaryState restore the canaries and rejected configs saved before restart, it must be called
+// before the apps start. The canary of an app still with the new config is on trial again,
+// the previous script is written back if the new config had not been saved
+func (c *Controller) loadCanaryState(appConfigs []*AppConfig) {
+	b, err := os.ReadFile(c.canaryStatePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Controller.loadCanaryState read failed: %s", err.Error())
+		}
+		return
+	}
+
+	state := &canaryState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		log.Errorf("Controller.loadCanaryState unmarshal failed: %s", err.Error())
+		return
+	}
+
+	for name, rejected := range state.Rejected {
+		c.rejectedConfigs[name] = rejected
+	}
+
+	now := time.Now()
+	for _, appConfig := range appConfigs {
+		saved, ok := state.Canaries[appConfig.AppName]
+		if !ok || saved.PrevConfig == nil || saved.NewConfig == nil {
+			continue
+		}
+
+		switch {
+		case !c.isAppConfigChange(saved.NewConfig, appConfig):
+			log.Infof("Controller.loadCanaryState %s %s -> %s on trial again", appConfig.AppName, saved.PrevConfig.ScriptMD5, appConfig.ScriptMD5)
+			c.canaries[appConfig.AppName] = &appCanary{
+				prevConfig: saved.PrevConfig,
+				prevScript: saved.PrevScript,
+				newConfig:  appConfig,
+				start:      now,
+				deadline:   now.Add(c.canaryTimeout(appConfig)),
+			}
+		case !c.isAppConfigChange(saved.PrevConfig, appConfig):
+			log.Infof("Controller.loadCanaryState %s restore script %s", appConfig.AppName, appConfig.ScriptMD5)
+			if err := c.saveScript(saved.PrevScript, appConfig); err != nil {
+				log.Errorf("Controller.loadCanaryState restore script of %s failed: %s", appConfig.AppName, err.Error())
+			}
+		}
+	}
+}
+
+func (c *Controller) reportRollout(canary *appCanary, result, reason string) {
+	rollout := &RolloutResult{
+		AppName:  canary.newConfig.AppName,
+		FromMD5:  canary.prevConfig.ScriptMD5,
+		ToMD5:    canary.newConfig.ScriptMD5,
+		Result:   result,
+		Reason:   reason,
+		Duration: int64(time.Since(canary.start).Seconds()),
+		Time:     time.Now().Unix(),
+	}
+
+	go func() {
+		if err := c.pushRollout(rollout); err != nil {
+			log.Errorf("Controller.reportRollout %s failed: %s", rollout.AppName, err.Error())
+		}
+	}()
+}
+
+func (c *Controller) pushRollout(rollout *RolloutResult) error {
+	buf, err := json.Marshal(rollout)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s%s", c.args.ServerURL, "/push/rollout")
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+	defer cancel()
+
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+
+	client := &http.Client{
+		Timeout:   httpTimeout,
+		Transport: ahttp.DefaultDNSRountTripper,
+	}
+
+	resp, err := c.doWithToken(client, newReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pushRollout status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilterRejectedConfigs(t *testing.T) {
+	prev := &AppConfig{AppName: "app", ScriptMD5: "v1"}
+	rejected := &AppConfig{AppName: "app", ScriptMD5: "v2"}
+
+	c := &Controller{
+		apps:            map[string]*App{"app": {appConfig: prev}},
+		rejectedConfigs: map[string]*AppConfig{"app": rejected},
+	}
+
+	// the reverted config is ignored until server change it
+	filtered := c.filterRejectedConfigs([]*AppConfig{{AppName: "app", ScriptMD5: "v2"}, {AppName: "other"}})
+	if len(filtered) != 2 || filtered[0] != prev {
+		t.Fatalf("rejected config should be replaced by current one, got %+v", filtered[0])
+	}
+	if _, ok := c.rejectedConfigs["app"]; !ok {
+		t.Fatalf("rejected config should be kept")
+	}
+
+	next := &AppConfig{AppName: "app", ScriptMD5: "v3"}
+	filtered = c.filterRejectedConfigs([]*AppConfig{next})
+	if filtered[0] != next {
+		t.Fatalf("new config should be used, got %+v", filtered[0])
+	}
+	if _, ok := c.rejectedConfigs["app"]; ok {
+		t.Fatalf("rejected config should be forgotten when server change it")
+	}
+}
+
+func TestCanaryTimeout(t *testing.T) {
+	c := &Controller{args: &ConrollerArgs{}}
+	if d := c.canaryTimeout(&AppConfig{}); d != defaultCanaryTimeout {
+		t.Fatalf("expect default timeout, got %s", d)
+	}
+
+	c.args.CanaryTimeout = 60
+	if d := c.canaryTimeout(&AppConfig{}); d != time.Minute {
+		t.Fatalf("expect controller timeout, got %s", d)
+	}
+	if d := c.canaryTimeout(&AppConfig{CanaryTimeout: 10}); d != 10*time.Second {
+		t.Fatalf("expect app timeout, got %s", d)
+	}
+}
+
+func TestCanaryStateRestore(t *testing.T) {
+	args := &ConrollerArgs{WorkingDir: t.TempDir(), RelAppsDir: "apps"}
+	prev := &AppConfig{AppName: "app", AppDir: "app", ScriptName: "main.lua", ScriptMD5: "v1"}
+	rejected := &AppConfig{AppName: "other", ScriptMD5: "v3"}
+
+	c := &Controller{
+		args:            args,
+		canaries:        map[string]*appCanary{},
+		rejectedConfigs: map[string]*AppConfig{"other": rejected},
+	}
+	pending := map[string]*appCanary{
+		"app": {prevConfig: prev, prevScript: []byte("v1 script"), newConfig: &AppConfig{AppName: "app", AppDir: "app", ScriptName: "main.lua", ScriptMD5: "v2"}},
+	}
+	if err := c.saveCanaryState(pending); err != nil {
+		t.Fatalf("saveCanaryState: %v", err)
+	}
+
+	// restarted after the new config is saved, the new version is on trial again
+	restored := &Controller{args: args, canaries: map[string]*appCanary{}, rejectedConfigs: map[string]*AppConfig{}}
+	loaded := &AppConfig{AppName: "app", AppDir: "app", ScriptName: "main.lua", ScriptMD5: "v2"}
+	restored.loadCanaryState([]*AppConfig{loaded})
+
+	canary, ok := restored.canaries["app"]
+	if !ok {
+		t.Fatalf("canary should be restored")
+	}
+	if canary.newConfig != loaded || canary.prevConfig.ScriptMD5 != "v1" || string(canary.prevScript) != "v1 script" {
+		t.Fatalf("unexpected canary %+v", canary)
+	}
+	if canary.deadline.Sub(canary.start) != defaultCanaryTimeout {
+		t.Fatalf("unexpected deadline %s", canary.deadline.Sub(canary.start))
+	}
+	if r, ok := restored.rejectedConfigs["other"]; !ok || r.ScriptMD5 != "v3" {
+		t.Fatalf("rejected config should be restored, got %+v", restored.rejectedConfigs)
+	}
+
+	// restarted before the new config is saved, the overwritten script is written back
+	restored = &Controller{args: args, canaries: map[string]*appCanary{}, rejectedConfigs: map[string]*AppConfig{}}
+	restored.loadCanaryState([]*AppConfig{{AppName: "app", AppDir: "app", ScriptName: "main.lua", ScriptMD5: "v1"}})
+	if len(restored.canaries) != 0 {
+		t.Fatalf("canary should not be restored for previous config")
+	}
+	b, err := os.ReadFile(filepath.Join(args.WorkingDir, "apps", "app", "main.lua"))
+	if err != nil || string(b) != "v1 script" {
+		t.Fatalf("previous script should be restored, got %q %v", b, err)
+	}
+}
@@ -0,0 +1,257 @@
+package controller
+
+import (
+	"agent/common"
+	ahttp "agent/common/http"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the first retry of control channel, it backoff to maxControlBackoff
+	controlRetryInterval = 5 * time.Second
+	maxControlBackoff    = 5 * time.Minute
+	// controller ping server in this interval, the channel is down if no pong in controlPongWait
+	controlPingInterval = 30 * time.Second
+	controlPongWait     = 75 * time.Second
+	controlWriteWait    = 10 * time.Second
+	// the budget to run a command from server, diag has its own
+	controlCmdTimeout = time.Minute
+	maxControlMessage = 1 << 20
+)
+
+// controlConn the connected control channel, the writes are serialized
+type controlConn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (cc *controlConn) write(msg *common.ControlMessage) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.ws.SetWriteDeadline(time.Now().Add(controlWriteWait))
+	return cc.ws.WriteJSON(msg)
+}
+
+func (cc *controlConn) ping() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return cc.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(controlWriteWait))
+}
+
+// controlURL return the websocket url of control channel on server
+func (c *Controller) controlURL() (string, error) {
+	u, err := url.Parse(c.args.ServerURL)
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = u.Path + "/control/ws"
+	return u.String(), nil
+}
+
+// runControlChannel keep the control channel to server until ctx done, the apps are still
+// polled from server when the channel is down
+func (c *Controller) runControlChannel(ctx context.Context) {
+	scheduler := common.NewPollScheduler("control", controlRetryInterval, maxControlBackoff)
+	for {
+		err := c.connectControl(ctx, scheduler)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			scheduler.Failure()
+			log.Errorf("Controller.runControlChannel: %s", err.Error())
+		}
+
+		timer := time.NewTimer(scheduler.Next())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// connectControl dial server and serve the commands until the channel is down
+func (c *Controller) connectControl(ctx context.Context, scheduler *common.PollScheduler) error {
+	u, err := c.controlURL()
+	if err != nil {
+		return err
+	}
+
+	ws, err := c.dialControl(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	scheduler.Success()
+	log.Infof("Controller control channel connected to %s", u)
+
+	cc := &controlConn{ws: ws}
+	c.control.Store(cc)
+	defer c.control.CompareAndSwap(cc, nil)
+
+	// close the connection to stop ReadJSON
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		ws.Close()
+	}()
+
+	ws.SetReadLimit(maxControlMessage)
+	ws.SetReadDeadline(time.Now().Add(controlPongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(controlPongWait))
+	})
+
+	go func() {
+		ticker := time.NewTicker(controlPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := cc.ping(); err != nil {
+					log.Errorf("Controller control channel ping: %s", err.Error())
+					cancel()
+					return
+				}
+			case <-connCtx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		msg := &common.ControlMessage{}
+		if err := ws.ReadJSON(msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("control channel down: %w", err)
+		}
+
+		if msg.Type != common.ControlTypeCommand {
+			log.Warnf("Controller control channel ignore message type %s", msg.Type)
+			continue
+		}
+
+		go func() {
+			result := c.handleControlCommand(connCtx, msg)
+			if err := cc.write(result); err != nil {
+				log.Errorf("Controller control channel reply %s %s: %s", msg.Command, msg.ID, err.Error())
+			}
+		}()
+	}
+}
+
+// dialControl open the websocket with the same resolver, proxy and tls policy as the http clients,
+// login again if server reject the token
+func (c *Controller) dialControl(ctx context.Context, u string) (*websocket.Conn, error) {
+	rt := ahttp.DefaultDNSRountTripper
+	dialer := &websocket.Dialer{
+		Proxy:            rt.Proxy,
+		NetDialContext:   rt.DialContext,
+		HandshakeTimeout: httpTimeout,
+	}
+	if parsed, err := url.Parse(u); err == nil {
+		dialer.TLSClientConfig = rt.TLSClientConfig(parsed.Hostname())
+	}
+
+	for attempt := 0; ; attempt++ {
+		token := c.tokens.Token()
+		header := http.Header{}
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		ws, resp, err := dialer.DialContext(ctx, u, header)
+		if err == nil {
+			return ws, nil
+		}
+
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return nil, err
+		}
+
+		if _, err := c.tokens.Refresh(ctx, token); err != nil {
+			return nil, fmt.Errorf("login again: %w", err)
+		}
+	}
+}
+
+// handleControlCommand run the command from server and return the result
+func (c *Controller) handleControlCommand(ctx context.Context, cmd *common.ControlMessage) *common.ControlMessage {
+	log.Infof("Controller control command %s %s %v", cmd.Command, cmd.ID, cmd.Args)
+
+	timeout := controlCmdTimeout
+	if cmd.Command == common.ControlCmdDiag {
+		timeout = diagTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := &common.ControlMessage{ID: cmd.ID, Type: common.ControlTypeResult, Command: cmd.Command}
+
+	v, err := c.runControlCommand(ctx, cmd)
+	if err == nil && v != nil {
+		result.Data, err = json.Marshal(v)
+	}
+	if err != nil {
+		log.Errorf("Controller control command %s %s: %s", cmd.Command, cmd.ID, err.Error())
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (c *Controller) runControlCommand(ctx context.Context, cmd *common.ControlMessage) (interface{}, error) {
+	switch cmd.Command {
+	case common.ControlCmdRefresh:
+		return c.runInLoop(ctx, func() (interface{}, error) {
+			isUpdate := c.pollApps()
+			if isUpdate {
+				c.renewApps()
+			}
+			return map[string]bool{"updated": isUpdate}, nil
+		})
+	case common.ControlCmdRestart:
+		name := cmd.Args["app"]
+		if name == "" {
+			return nil, fmt.Errorf("app is required")
+		}
+		return c.runInLoop(ctx, func() (interface{}, error) {
+			return c.appAction(name, "restart")
+		})
+	case common.ControlCmdStatus:
+		return c.runInLoop(ctx, func() (interface{}, error) {
+			return struct {
+				*ControllerStatus
+				Apps []*AppStatus `json:"apps"`
+			}{c.status(), c.appStatuses()}, nil
+		})
+	case common.ControlCmdDiag:
+		logMB, _ := strconv.Atoi(cmd.Args["logMB"])
+		return c.runDiag(ctx, logMB, true, "control")
+	default:
+		return nil, fmt.Errorf("unsupported command %s", cmd.Command)
+	}
+}
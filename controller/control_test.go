@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"agent/common"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestControlURL(t *testing.T) {
+	for serverURL, expect := range map[string]string{
+		"https://example.com":      "wss://example.com/control/ws",
+		"http://127.0.0.1:8080/v1": "ws://127.0.0.1:8080/v1/control/ws",
+	} {
+		c := &Controller{args: &ConrollerArgs{ServerURL: serverURL}}
+		u, err := c.controlURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != expect {
+			t.Fatalf("expect %s, got %s", expect, u)
+		}
+	}
+}
+
+func TestControlChannel(t *testing.T) {
+	now := time.Now().Unix()
+	token := testToken(now, now+100)
+
+	results := make(chan *common.ControlMessage, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		upgrader := websocket.Upgrader{}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		ws.WriteJSON(&common.ControlMessage{ID: "1", Type: common.ControlTypeCommand, Command: common.ControlCmdStatus})
+		ws.WriteJSON(&common.ControlMessage{ID: "2", Type: common.ControlTypeCommand, Command: "unknown"})
+		for i := 0; i < 2; i++ {
+			msg := &common.ControlMessage{}
+			if err := ws.ReadJSON(msg); err != nil {
+				return
+			}
+			results <- msg
+		}
+	}))
+	defer srv.Close()
+
+	c := &Controller{
+		args:          &ConrollerArgs{ServerURL: srv.URL},
+		apps:          make(map[string]*App),
+		cmdCh:         make(chan func()),
+		pollScheduler: common.NewPollScheduler("test", time.Minute, time.Minute),
+	}
+	// the first token is rejected, login again
+	c.tokens = newTokenManager(testToken(now-100, now-1), func(ctx context.Context) (string, error) {
+		return token, nil
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		for {
+			select {
+			case cmd := <-c.cmdCh:
+				cmd()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go c.connectControl(ctx, common.NewPollScheduler("control", time.Second, time.Second))
+
+	byID := make(map[string]*common.ControlMessage)
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-results:
+			byID[msg.ID] = msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait results timeout")
+		}
+	}
+
+	status := byID["1"]
+	if status.Type != common.ControlTypeResult || status.Error != "" {
+		t.Fatalf("unexpected status result %+v", status)
+	}
+	var data ControllerStatus
+	if err := json.Unmarshal(status.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if !data.Control {
+		t.Fatal("expect control channel connected")
+	}
+
+	if byID["2"].Error == "" {
+		t.Fatal("expect error on unknown command")
+	}
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"agent/agent"
+	"agent/common"
 	ahttp "agent/common/http"
 	"agent/common/wallet"
 	"bytes"
@@ -17,6 +18,10 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -27,6 +32,16 @@ const (
 	Version             = "0.1.1"
 	httpTimeout         = 20 * time.Second
 	pushMetricsInterval = 120 * time.Second
+	// the first retry of metrics push, it backoff to maxMetricsBackoff
+	metricsRetryInterval = 15 * time.Second
+	maxMetricsBackoff    = 10 * time.Minute
+	maxPollBackoff       = 30 * time.Minute
+	// the first retry of regist and login at startup, it backoff to maxPollBackoff
+	connectRetryInterval = 10 * time.Second
+	// the default deadline of shutdown
+	defaultShutdownTimeout = 60 * time.Second
+	// the interval to start the apps waiting dependencies and check the canaries
+	appCheckInterval = 2 * time.Second
 )
 
 type ConrollerArgs struct {
@@ -39,16 +54,40 @@ type ConrollerArgs struct {
 
 	WebServerUrl string
 	KEY          string
+
+	// loopback address for admin api, use unix socket in working dir if empty
+	AdminAddr string
+	// address for prometheus /metrics, disabled if empty
+	MetricsAddr string
+	// seconds to stop all apps and flush metrics, default 60
+	ShutdownTimeout int
+	// glob patterns of network interfaces to count traffic,
+	// agent.DefaultInterfaceExclude is used if exclude is empty
+	NetInclude []string
+	NetExclude []string
+	// seconds for the new version of app to be ready before revert, default 300
+	CanaryTimeout int
+	// the log file of controller, collected by diag
+	LogFile string
 }
 
 type App struct {
 	appConfig *AppConfig
 	app       *Application
+	lifecycle *appLifecycle
+	// the app is not started until its dependencies are ready
+	waiting bool
+	// closed when the stop started by admin is done, nil if no stop in progress
+	stopping chan struct{}
 }
 
 type AppMetric struct {
 	AppConfig
-	Metric string `json:"metric"`
+	AppLifecycleStatus
+	Metric string          `json:"metric"`
+	Usage  *agent.AppUsage `json:"usage,omitempty"`
+	// the results of health checks in app config
+	Health []agent.HealthResult `json:"health,omitempty"`
 }
 
 type Controller struct {
@@ -56,13 +95,35 @@ type Controller struct {
 	args          *ConrollerArgs
 	appConfigs    []*AppConfig
 	appConfigsMD5 string
-	apps          map[string]*App
-	metricCh      chan AppMetric
-	appMetrics    map[string]string
+	// touched in Run loop only, use runInLoop in other goroutines
+	apps map[string]*App
+	// the lifecycles of the apps in config, include the apps fail to start
+	lifecycles *appLifecycles
+	metricCh   chan AppMetric
+	appMetrics map[string]string
+	// the unsent metrics reports, flushCh trigger the delivery
+	spool            *metricsSpool
+	flushCh          chan struct{}
+	metricsScheduler *common.PollScheduler
+	pollScheduler    *common.PollScheduler
+	// run the commands from admin api in Run loop
+	cmdCh     chan func()
+	startTime time.Time
+	stats     controllerStats
+	// the apps on trial of new config, and the configs reverted that are ignored until server change them
+	canaries        map[string]*appCanary
+	rejectedConfigs map[string]*AppConfig
+	// the connected control channel, nil if it is down
+	control atomic.Pointer[controlConn]
+	// only one diagnostics bundle is collected at a time
+	diagMu sync.Mutex
+	// the diag requested by server is not run again before diagRetryAt(unix nano) after a failure
+	diagScheduler *common.PollScheduler
+	diagRetryAt   atomic.Int64
 
 	//
 	Config *Config
-	token  string
+	tokens *tokenManager
 
 	//
 	WsConn *websocket.Conn
@@ -89,41 +150,86 @@ func New(args *ConrollerArgs) (*Controller, error) {
 		Channel:         args.Channel,
 	}
 
-	info := agent.NewBaseInfo(nil, &agent.AppInfo{ControllerInfo: controllerInfo})
+	info := agent.NewBaseInfo(nil, &agent.AppInfo{ControllerInfo: controllerInfo, AppRootDir: appsDir})
+
+	spool, err := newMetricsSpool(path.Join(args.WorkingDir, metricsSpoolDir))
+	if err != nil {
+		return nil, err
+	}
 
 	c := &Controller{
 		apps:       make(map[string]*App),
+		lifecycles: newAppLifecycles(),
 		args:       args,
 		baseInfo:   info,
 		appMetrics: make(map[string]string),
 		metricCh:   make(chan AppMetric, 64),
+		spool:      spool,
+		flushCh:    make(chan struct{}, 1),
 		Config:     config,
-	}
 
-	if err := c.regist(context.Background()); err != nil {
-		return nil, fmt.Errorf("[Regist error] %s", err.Error())
+		cmdCh:            make(chan func()),
+		startTime:        time.Now(),
+		canaries:         make(map[string]*appCanary),
+		rejectedConfigs:  make(map[string]*AppConfig),
+		pollScheduler:    common.NewPollScheduler("controller", time.Second*time.Duration(args.ScriptUpdateInterval), maxPollBackoff),
+		metricsScheduler: common.NewPollScheduler("metrics", metricsRetryInterval, maxMetricsBackoff),
+		diagScheduler:    common.NewPollScheduler("diag", diagRetryInterval, maxDiagBackoff),
 	}
-	log.Info("Node regist success")
 
-	token, err := c.login(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("[Login error] %s", err.Error())
-	}
-	log.Info("Node login success")
+	// the node regist and login in Run, the cached apps start before it
+	c.tokens = newTokenManager("", c.login, c.onTokenChange)
+
+	return c, nil
+}
+
+// connect regist, login and bind the node, retry with backoff until success or ctx done
+func (c *Controller) connect(ctx context.Context) error {
+	scheduler := common.NewPollScheduler("connect", connectRetryInterval, maxPollBackoff)
+	registered, bound := false, false
+	for {
+		err := func() error {
+			if !registered {
+				if err := c.regist(ctx); err != nil {
+					return fmt.Errorf("[Regist error] %s", err.Error())
+				}
+				registered = true
+				log.Info("Node regist success")
+			}
 
-	c.token = token
-	c.baseInfo.SetToken(token)
+			// may be logged in by the requests on 401 meanwhile
+			if _, err := c.tokens.Refresh(ctx, ""); err != nil {
+				return fmt.Errorf("[Login error] %s", err.Error())
+			}
+			log.Info("Node login success")
 
-	if !info.IsBox() {
-		if err := c.registBindInfo(context.Background()); err != nil {
-			return nil, fmt.Errorf("[Bind Error]: %s", err.Error())
+			if !bound {
+				if c.baseInfo.IsBox() {
+					log.Info("Box Node, skip bind")
+				} else if err := c.registBindInfo(ctx); err != nil {
+					return fmt.Errorf("[Bind Error]: %s", err.Error())
+				} else {
+					log.Info("Node bind success")
+				}
+				bound = true
+			}
+			return nil
+		}()
+		if err == nil {
+			return nil
 		}
-		log.Info("Node bind success")
-	} else {
-		log.Info("Box Node, skip bind")
-	}
 
-	return c, nil
+		scheduler.Failure()
+		log.Errorf("Controller.connect: %s", err.Error())
+
+		timer := time.NewTimer(scheduler.Next())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
 }
 
 func (c *Controller) registBindInfo(ctx context.Context) error {
@@ -210,7 +316,7 @@ func (c *Controller) login(ctx context.Context) (string, error) {
 		return "", err
 	}
 
-	url := fmt.Sprintf("%s%s?node_id=%s&sign=%s", c.args.ServerURL, "/node/login", c.Config.AgentID, hex.EncodeToString(sign))
+	url := fmt.Sprintf("%s%s?node_id=%s&sign=%s&fingerprint=%s&relogin=true", c.args.ServerURL, "/node/login", c.Config.AgentID, hex.EncodeToString(sign), url.QueryEscape(agent.HardwareFingerprint().String()))
 
 	ctx, cancel := context.WithTimeout(ctx, httpTimeout)
 	defer cancel()
@@ -291,40 +397,78 @@ func (c *Controller) regist(ctx context.Context) error {
 
 }
 
+// SetPollInterval change the interval to poll server, used by config reload
+func (c *Controller) SetPollInterval(interval time.Duration) {
+	c.pollScheduler.SetInterval(interval)
+}
+
 func (c *Controller) Run(ctx context.Context) error {
+	// the cached apps keep running when server can not reach, even at startup
 	c.loadLocal()
-	c.updateAppsFromServer()
 	c.newApps()
 
-	go c.handleMetric(ctx)
-
-	go c.handleWsssh(ctx)
+	// metrics are flushed after apps stop, so it is not stopped by ctx
+	metricsCtx, metricsCancel := context.WithCancel(context.Background())
+	metricsDone := make(chan struct{})
+	go func() {
+		c.handleMetric(metricsCtx)
+		close(metricsDone)
+	}()
+
+	connected := make(chan struct{})
+	go func() {
+		if err := c.connect(ctx); err == nil {
+			close(connected)
+		}
+	}()
 
 	go c.collectTraffic(ctx)
 
-	scriptUpdateinterval := time.Second * time.Duration(c.args.ScriptUpdateInterval)
-	ticker := time.NewTicker(scriptUpdateinterval)
-	defer ticker.Stop()
+	go c.serveAdmin(ctx)
+
+	if len(c.args.MetricsAddr) > 0 {
+		go c.serveMetrics(ctx)
+	}
+
+	// poll server after connected
+	timer := time.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
+
+	appTicker := time.NewTicker(appCheckInterval)
+	defer appTicker.Stop()
 
-	appUpdateTime := time.Now()
 	for {
 		select {
-		case <-ticker.C:
-			elapsed := time.Since(appUpdateTime)
-			if elapsed > scriptUpdateinterval {
-				isUpdate, err := c.updateAppsFromServer()
-				if err != nil {
-					log.Infof("Controller.Run updateAppsFromServer %s", err.Error())
-				} else if isUpdate {
-					log.Infof("Controller.Run updateAppsFromServer renew apps")
-					c.renewApps()
-				} else {
-					log.Infof("Controller.Run updateAppsFromServer no apps change")
-				}
-				appUpdateTime = time.Now()
+		case <-connected:
+			connected = nil
+
+			go c.tokens.Run(ctx)
+
+			go c.runControlChannel(ctx)
+
+			go c.handleWsssh(ctx)
+
+			if isUpdate := c.pollApps(); isUpdate {
+				c.renewApps()
 			}
+			timer.Reset(c.pollScheduler.Next())
+		case <-timer.C:
+			if isUpdate := c.pollApps(); isUpdate {
+				log.Infof("Controller.Run updateAppsFromServer renew apps")
+				c.renewApps()
+			}
+			timer.Reset(c.pollScheduler.Next())
+		case <-appTicker.C:
+			c.startWaitingApps()
+			c.checkCanaries()
+		case cmd := <-c.cmdCh:
+			cmd()
 		case <-ctx.Done():
-			c.onStop()
+			c.onStop(func() {
+				metricsCancel()
+				<-metricsDone
+			})
 			return nil
 		}
 
@@ -332,10 +476,34 @@ func (c *Controller) Run(ctx context.Context) error {
 
 }
 
+// pollApps update apps from server, and feed the result to poll scheduler
+func (c *Controller) pollApps() bool {
+	isUpdate, err := c.updateAppsFromServer()
+	if err != nil {
+		c.pollScheduler.Failure()
+		c.stats.pollFailures.Add(1)
+		log.Infof("Controller.Run updateAppsFromServer %s", err.Error())
+		return false
+	}
+
+	c.pollScheduler.Success()
+	if !isUpdate {
+		log.Infof("Controller.Run updateAppsFromServer no apps change")
+	}
+	return isUpdate
+}
+
 func (c *Controller) handleMetric(ctx context.Context) {
 	ticker := time.NewTicker(pushMetricsInterval)
 	defer ticker.Stop()
 
+	deliverDone := make(chan struct{})
+	go func() {
+		c.deliverMetrics(ctx)
+		close(deliverDone)
+	}()
+	defer func() { <-deliverDone }()
+
 	for {
 		select {
 		case <-ticker.C:
@@ -346,11 +514,19 @@ func (c *Controller) handleMetric(ctx context.Context) {
 			}
 
 			go func() {
-				if err := c.pushMetrics(metrics); err != nil {
-					log.Error("handleMetric pushMetrics failed:", err.Error())
+				// the apps are owned by Run loop
+				v, err := c.runInLoop(ctx, func() (interface{}, error) {
+					return c.collectAppMetrics(metrics), nil
+				})
+				if err != nil {
+					log.Error("handleMetric collect app metrics failed:", err.Error())
+					return
 				}
-			}()
 
+				if err := c.reportMetrics(v.([]*AppMetric)); err != nil {
+					log.Error("handleMetric reportMetrics failed:", err.Error())
+				}
+			}()
 		case metric := <-c.metricCh:
 			c.appMetrics[metric.AppName] = metric.Metric
 
@@ -363,18 +539,42 @@ func (c *Controller) handleMetric(ctx context.Context) {
 
 // ./controller run --working-dir=./devctr --server-url=http://localhost:8080 --web-url=http://google.com --key=xxxxxx
 
-func (c *Controller) pushMetrics(metrics map[string]string) error {
-	// if len(metrics) == 0 {
-	// 	return nil
-	// }
-	if len(c.apps) == 0 {
-		return nil
-	}
-
+// collectAppMetrics return the metrics and states of apps, it must be called in Run loop
+func (c *Controller) collectAppMetrics(metrics map[string]string) []*AppMetric {
 	appMetrics := make([]*AppMetric, 0, len(c.apps))
 	for _, app := range c.apps {
 		metric := metrics[app.appConfig.AppName]
-		appMetrics = append(appMetrics, &AppMetric{AppConfig: *app.appConfig, Metric: metric})
+		appMetric := &AppMetric{AppConfig: *app.appConfig, AppLifecycleStatus: app.lifecycle.status(), Metric: metric}
+		// app stopped by admin has no usage
+		if app.app != nil {
+			usage := app.app.Usage()
+			appMetric.Usage = &usage
+			appMetric.Health = app.app.Health()
+		}
+		appMetrics = append(appMetrics, appMetric)
+	}
+
+	// the apps that are downloading or fail to start
+	for name, lifecycle := range c.lifecycles.all() {
+		if _, ok := c.apps[name]; ok {
+			continue
+		}
+
+		appMetric := &AppMetric{AppConfig: AppConfig{AppName: name}, AppLifecycleStatus: lifecycle.status()}
+		if appConfig := c.findAppConfig(name); appConfig != nil {
+			appMetric.AppConfig = *appConfig
+		}
+		appMetrics = append(appMetrics, appMetric)
+	}
+
+	sort.Slice(appMetrics, func(i, j int) bool { return appMetrics[i].AppName < appMetrics[j].AppName })
+	return appMetrics
+}
+
+// reportMetrics save the metrics of apps in spool, they are sent in order by deliverMetrics
+func (c *Controller) reportMetrics(appMetrics []*AppMetric) error {
+	if len(appMetrics) == 0 {
+		return nil
 	}
 
 	buf, err := json.Marshal(appMetrics)
@@ -382,35 +582,134 @@ func (c *Controller) pushMetrics(metrics map[string]string) error {
 		return err
 	}
 
-	url := fmt.Sprintf("%s%s?uuid=%s", c.args.ServerURL, "/push/metrics", c.baseInfo.UUID())
+	if _, err := c.spool.enqueue(buf, time.Now()); err != nil {
+		return err
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
-	defer cancel()
+	select {
+	case c.flushCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deliverMetrics send the spooled reports when a new one is saved, the reports left by last run are sent on start.
+// It retry with backoff when server can not reach, the new reports wait in spool meanwhile
+func (c *Controller) deliverMetrics(ctx context.Context) {
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	backoff := false
+	for {
+		select {
+		case <-c.flushCh:
+			if backoff {
+				continue
+			}
+		case <-retry.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := c.flushMetrics(ctx); err != nil {
+			c.stats.pushMetricsFails.Add(1)
+			c.metricsScheduler.Failure()
+			backoff = true
+
+			next := c.metricsScheduler.Next()
+			log.Errorf("deliverMetrics push metrics failed, retry in %s: %s", next.Round(time.Second), err.Error())
+			retry.Reset(next)
+			continue
+		}
+
+		c.metricsScheduler.Success()
+		backoff = false
+	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, bytes.NewReader(buf))
+// flushMetrics send the spooled reports oldest first, stop at the first failure
+func (c *Controller) flushMetrics(ctx context.Context) error {
+	reports, err := c.spool.reports()
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	if len(reports) > 1 {
+		log.Infof("Controller.flushMetrics replay %d reports since %s", len(reports), reports[0].time.Format(time.RFC3339))
+	}
+
+	for _, r := range reports {
+		if err := c.pushMetrics(ctx, r); err != nil {
+			return err
+		}
+
+		if err := c.spool.remove(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushMetrics send a spooled report, the server dedupe the reports by epoch and seq
+func (c *Controller) pushMetrics(ctx context.Context, r *spoolReport) error {
+	buf, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		// dropped by spool
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s%s?uuid=%s", c.args.ServerURL, "/push/metrics", c.baseInfo.UUID())
+
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout)
+	defer cancel()
+
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set(metricsEpochHeader, c.spool.epoch)
+		req.Header.Set(metricsSeqHeader, strconv.FormatUint(r.seq, 10))
+		req.Header.Set(metricsTimeHeader, strconv.FormatInt(r.time.Unix(), 10))
+		return req, nil
+	}
 
 	client := &http.Client{
 		Timeout:   httpTimeout,
 		Transport: ahttp.DefaultDNSRountTripper,
 	}
 
-	resp, err := client.Do(req)
+	resp, err := c.doWithToken(client, newReq)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusBadRequest {
+		// the report can not be accepted, do not block the reports after it
+		body, _ := io.ReadAll(resp.Body)
+		log.Errorf("Controller.pushMetrics drop report %d: %s", r.seq, string(body))
+		return nil
+	}
+
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("getScriptInfoFromServer status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+		return fmt.Errorf("pushMetrics status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+	}
+
+	if v := resp.Header.Get(uploadAppLogsHeader); len(v) > 0 {
+		go c.uploadAppLogs(v)
 	}
 
-	// log.Infof("push metrics")
+	if v := resp.Header.Get(uploadDiagHeader); len(v) > 0 {
+		go c.uploadDiag(v)
+	}
 
 	return nil
 }
@@ -426,6 +725,8 @@ func (c *Controller) loadLocal() {
 		return
 	}
 
+	c.loadCanaryState(appConfigs)
+
 	c.appConfigsMD5 = c.configMD5(appConfigs)
 	c.appConfigs = appConfigs
 }
@@ -445,17 +746,25 @@ func (c *Controller) newApps() {
 		return
 	}
 
-	for _, appConfig := range c.appConfigs {
-		app, err := NewApplication(&AppArguments{ControllerArgs: c.args, AppConfig: appConfig}, c)
-		if err != nil {
-			log.Errorf("Controller.newApps NewApplication failed:%s", err.Error())
-			continue
-		}
-		c.apps[appConfig.AppName] = &App{appConfig: appConfig, app: app}
+	ordered, errs := orderAppConfigs(c.appConfigs)
+	c.reportConfigErrors(errs)
 
-		go app.Run()
+	// the apps start in order when their dependencies are ready
+	for _, appConfig := range ordered {
+		c.apps[appConfig.AppName] = &App{appConfig: appConfig, lifecycle: c.lifecycles.get(appConfig.AppName), waiting: true}
+	}
+	c.startWaitingApps()
+}
+
+// runApplication create the app and run it, the app is failed if it can not be created
+func (c *Controller) runApplication(appConfig *AppConfig) (*Application, error) {
+	app, err := NewApplication(&AppArguments{ControllerArgs: c.args, AppConfig: appConfig}, c)
+	if err != nil {
+		return nil, err
 	}
 
+	go app.Run()
+	return app, nil
 }
 
 func (c *Controller) renewApps() {
@@ -463,12 +772,16 @@ func (c *Controller) renewApps() {
 		return
 	}
 
+	// the apps with config error are removed
+	ordered, errs := orderAppConfigs(c.appConfigs)
 	appConfigMap := make(map[string]*AppConfig)
-	for _, appConfig := range c.appConfigs {
+	for _, appConfig := range ordered {
 		appConfigMap[appConfig.AppName] = appConfig
 	}
 
 	removeApps := make([]*App, 0, len(c.apps))
+	// the running apps with config change, they are reverted if the new version is not ready
+	upgradeApps := make(map[string]*App)
 	for _, app := range c.apps {
 		appConfig, ok := appConfigMap[app.appConfig.AppName]
 		if !ok {
@@ -476,32 +789,65 @@ func (c *Controller) renewApps() {
 			continue
 		}
 
-		if c.isAppConfigChange(app.appConfig, appConfig) {
+		if !c.isAppConfigChange(app.appConfig, appConfig) {
+			continue
+		}
+
+		if app.app != nil {
+			upgradeApps[appConfig.AppName] = app
+		} else {
 			removeApps = append(removeApps, app)
 		}
 	}
 
-	// remove apps
+	// remove apps, the dependents are stopped first
 	for _, app := range removeApps {
-		app.app.Stop()
+		c.stopDependents(app.appConfig.AppName)
+		c.stopApp(app)
 		delete(c.apps, app.appConfig.AppName)
 	}
 
-	// new apps
+	// the apps fail to start and then removed from config
+	configured := make(map[string]bool)
 	for _, appConfig := range c.appConfigs {
+		configured[appConfig.AppName] = true
+	}
+	for name := range c.lifecycles.all() {
+		if !configured[name] {
+			c.lifecycles.remove(name)
+		}
+	}
+
+	c.reportConfigErrors(errs)
+
+	// new apps
+	for _, appConfig := range ordered {
 		_, ok := c.apps[appConfig.AppName]
 		if !ok {
-			app, err := NewApplication(&AppArguments{ControllerArgs: c.args, AppConfig: appConfig}, c)
-			if err != nil {
-				log.Errorf("Controller.newApps NewApplication failed:%s", err.Error())
-				continue
-			}
-			c.apps[appConfig.AppName] = &App{appConfig: appConfig, app: app}
+			c.apps[appConfig.AppName] = &App{appConfig: appConfig, lifecycle: c.lifecycles.get(appConfig.AppName), waiting: true}
+			c.stats.scriptReloads.Add(1)
+		}
+	}
 
-			go app.Run()
+	// upgrade after new apps, the reverted app must not be started again with new config.
+	// The dependents wait until the new version is ready
+	for _, appConfig := range ordered {
+		app, ok := upgradeApps[appConfig.AppName]
+		if !ok {
+			continue
+		}
+
+		c.stopDependents(appConfig.AppName)
+		if app.app == nil {
+			// stopped as dependent of the app upgraded before
+			c.apps[appConfig.AppName] = &App{appConfig: appConfig, lifecycle: app.lifecycle, waiting: true}
+			c.stats.scriptReloads.Add(1)
+			continue
 		}
+		c.upgradeApp(app, appConfig)
 	}
 
+	c.startWaitingApps()
 }
 
 func (c *Controller) loadLocalAppConfigs() ([]*AppConfig, error) {
@@ -539,27 +885,75 @@ func (c *Controller) updateAppsFromServer() (bool, error) {
 		appConfigMap[appConfig.AppName] = appConfig
 		newAppConfigs = append(newAppConfigs, appConfig)
 	}
+	newAppConfigs = c.filterRejectedConfigs(newAppConfigs)
 
 	if !c.isAppsConfigChange(newAppConfigs) {
 		return false, nil
 	}
 
+	// the last good version of upgraded apps is saved before the script is overwritten,
+	// so it can be restored if the controller restart during the upgrade
+	pending := make(map[string]*appCanary)
+	for _, appConfig := range newAppConfigs {
+		app, ok := c.apps[appConfig.AppName]
+		if !ok || app.app == nil || !c.isAppConfigChange(app.appConfig, appConfig) {
+			continue
+		}
+		prevConfig, prevScript := app.appConfig, app.app.scriptFileContent
+		if canary, ok := c.canaries[appConfig.AppName]; ok {
+			// on trial, the last good version is still the previous one
+			prevConfig, prevScript = canary.prevConfig, canary.prevScript
+		}
+		pending[appConfig.AppName] = &appCanary{prevConfig: prevConfig, prevScript: prevScript, newConfig: appConfig}
+	}
+	if err := c.saveCanaryState(pending); err != nil {
+		log.Errorf("Controller.updateAppConfigAndScriptFromServer saveCanaryState faile %v", err.Error())
+		return false, err
+	}
+
+	// the apps will be started after download, the running apps keep their state until restart
+	downloading := make(map[string]*appLifecycle)
+	for _, appConfig := range newAppConfigs {
+		app, ok := c.apps[appConfig.AppName]
+		if ok && (app.app != nil || !c.isAppConfigChange(app.appConfig, appConfig)) {
+			continue
+		}
+
+		lifecycle := c.lifecycles.get(appConfig.AppName)
+		lifecycle.setState(appStateDownloading, "")
+		downloading[appConfig.AppName] = lifecycle
+	}
+
+	// the failed app is marked failed, others wait next poll
+	abortDownload := func(appName, reason string) {
+		for name, lifecycle := range downloading {
+			if len(appName) == 0 || name == appName {
+				lifecycle.setState(appStateFailed, reason)
+			} else {
+				lifecycle.setState(appStatePending, "download aborted: "+reason)
+			}
+		}
+	}
+
 	for _, appConfig := range newAppConfigs {
 		scriptContent, err := c.getScriptFromServer(appConfig.ScriptURL)
 		if err != nil {
 			log.Errorf("Controller.updateAppConfigAndScriptFromServer getScriptFromServer faile %v", err.Error())
+			abortDownload(appConfig.AppName, fmt.Sprintf("download script: %s", err.Error()))
 			return false, err
 		}
 
 		newMD5 := fmt.Sprintf("%x", md5.Sum(scriptContent))
 		if newMD5 != appConfig.ScriptMD5 {
 			log.Errorf("Controller.updateAppConfigAndScriptFromServer script md5 not match, AppName: %s. server md5: %s. download md5: %s", appConfig.AppName, appConfig.ScriptMD5, newMD5)
+			abortDownload(appConfig.AppName, fmt.Sprintf("script md5 %s not match %s", newMD5, appConfig.ScriptMD5))
 			return false, err
 		}
 
 		err = c.saveScript(scriptContent, appConfig)
 		if err != nil {
 			log.Errorf("Controller.updateAppConfigAndScriptFromServer saveScript faile %v", err.Error())
+			abortDownload(appConfig.AppName, fmt.Sprintf("save script: %s", err.Error()))
 			return false, err
 		}
 
@@ -570,6 +964,7 @@ func (c *Controller) updateAppsFromServer() (bool, error) {
 		if _, ok := appConfigMap[appConfig.AppName]; !ok {
 			if err = c.removeAppDir(appConfig); err != nil {
 				log.Errorf("Controller.updateAppConfigAndScriptFromServer removeAppDir %s", err.Error())
+				abortDownload("", fmt.Sprintf("remove app dir: %s", err.Error()))
 				return false, err
 			}
 		}
@@ -577,6 +972,7 @@ func (c *Controller) updateAppsFromServer() (bool, error) {
 
 	if err = c.saveAppConfigs(newAppConfigs); err != nil {
 		log.Errorf("Controller.updateAppConfigAndScriptFromServer saveAppConfigs faile %v", err.Error())
+		abortDownload("", fmt.Sprintf("save app configs: %s", err.Error()))
 		return false, err
 	}
 
@@ -637,29 +1033,32 @@ func (c *Controller) isAppConfigChange(appConfig1 *AppConfig, appConfig2 *AppCon
 
 func (c *Controller) getAppConfigsFromServer() ([]*AppConfig, error) {
 	queryString := c.baseInfo.ToURLQuery()
+	if d := c.pollScheduler.OfflineDuration(); d > 0 {
+		queryString.Set("offlineSeconds", fmt.Sprintf("%d", int64(d.Seconds())))
+	}
 
 	url := fmt.Sprintf("%s%s?%s", c.args.ServerURL, "/config/apps", queryString.Encode())
 
 	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
+	newReq := func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.token))
 
 	client := &http.Client{
 		Timeout:   httpTimeout,
 		Transport: ahttp.DefaultDNSRountTripper,
 	}
 
-	resp, err := client.Do(req)
+	resp, err := c.doWithToken(client, newReq)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	c.pollScheduler.SetHint(common.ParseRetryHint(resp.Header))
+
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
 		return nil, fmt.Errorf("getScriptInfoFromServer status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
@@ -758,21 +1157,114 @@ func (c *Controller) removeAppDir(appConfig *AppConfig) error {
 	return os.RemoveAll(appDir)
 }
 
-func (c *Controller) onStop() {
-	c.stopAllApps()
+// onStop stop all apps in parallel, then flush the last metrics to server,
+// all of them must be done before the shutdown deadline
+func (c *Controller) onStop(stopMetrics func()) {
+	timeout := defaultShutdownTimeout
+	if c.args.ShutdownTimeout > 0 {
+		timeout = time.Duration(c.args.ShutdownTimeout) * time.Second
+	}
 
-	log.Infof("Controller.onStop abc")
-}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	log.Infof("Controller.onStop shutdown in %s", timeout)
+
+	c.stopAllApps(ctx)
+
+	// the metrics loop own appMetrics, wait it quit before read
+	stopMetrics()
+
+	metrics := make(map[string]string)
+	for appName, metric := range c.appMetrics {
+		metrics[appName] = metric
+	}
+	// the reports not sent are kept in spool for next run
+	if err := c.reportMetrics(c.collectAppMetrics(metrics)); err != nil {
+		log.Errorf("Controller.onStop save metrics failed: %v", err)
+	} else if err := c.flushMetrics(ctx); err != nil {
+		log.Errorf("Controller.onStop flush metrics failed: %v", err)
+	} else {
+		log.Infof("Controller.onStop metrics flushed")
+	}
 
-func (c *Controller) stopAllApps() {
 	for _, app := range c.apps {
-		app.app.Stop()
+		app.app = nil
+	}
+
+	log.Infof("Controller.onStop shutdown complete in %s", time.Since(start))
+}
+
+// stopAllApps stop apps in parallel, the dependents are stopped before their dependencies.
+// Every app has appStopTimeout at most, the app is left as it is after stop so the last usage can be reported
+func (c *Controller) stopAllApps(ctx context.Context) {
+	var stopped atomic.Int32
+
+	remaining := make(map[string]*App)
+	for name, app := range c.apps {
+		if app.app != nil {
+			remaining[name] = app
+		}
 	}
+	total := len(remaining)
+
+	log.Infof("Controller.stopAllApps stopping %d apps", total)
+	for len(remaining) > 0 {
+		// the apps that no remaining app depends on
+		wave := make([]*App, 0, len(remaining))
+		for name, app := range remaining {
+			if !hasDependent(remaining, name) {
+				wave = append(wave, app)
+			}
+		}
+		if len(wave) == 0 {
+			// the config has been checked, but do not hang on cycle
+			for _, app := range remaining {
+				wave = append(wave, app)
+			}
+		}
+
+		var wg sync.WaitGroup
+		for _, app := range wave {
+			delete(remaining, app.appConfig.AppName)
+
+			wg.Add(1)
+			go func(app *App) {
+				defer wg.Done()
 
+				appCtx, cancel := context.WithTimeout(ctx, appStopTimeout)
+				defer cancel()
+
+				start := time.Now()
+				if err := app.app.StopContext(appCtx); err != nil {
+					log.Errorf("Controller.stopAllApps %v", err)
+					return
+				}
+
+				stopped.Add(1)
+				log.Infof("Controller.stopAllApps app %s stopped in %s", app.appConfig.AppName, time.Since(start))
+			}(app)
+		}
+		wg.Wait()
+	}
+
+	// the stops started by admin
+	for _, app := range c.apps {
+		if app.stopping == nil {
+			continue
+		}
+		select {
+		case <-app.stopping:
+		case <-ctx.Done():
+		}
+	}
+	log.Infof("Controller.stopAllApps %d/%d apps stopped", stopped.Load(), total)
 }
 
 func (c *Controller) collectTraffic(ctx context.Context) {
-	statsChan, err := agent.MonitorNetworkStats(ctx, 1*time.Minute)
+	filter := agent.NewInterfaceFilter(c.args.NetInclude, c.args.NetExclude)
+	statsChan, err := agent.MonitorNetworkStats(ctx, 1*time.Minute, filter)
 	if err != nil {
 		log.Errorf("collect network stats error: %v", err)
 		return
@@ -784,8 +1276,11 @@ func (c *Controller) collectTraffic(ctx context.Context) {
 			log.Info("collectTraffic quit")
 			return
 		case stats := <-statsChan:
+			cpuUsage := agent.GetCpuRealtimeUsage()
 			c.baseInfo.SetTraffice(stats)
-			c.baseInfo.SetCpuUsage(agent.GetCpuRealtimeUsage())
+			c.baseInfo.SetCpuUsage(cpuUsage)
+			c.baseInfo.RefreshDiskUsage()
+			c.stats.setTraffic(stats, cpuUsage)
 		}
 	}
 }
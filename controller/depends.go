@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The conditions that dependency must meet before the dependent app start
+const (
+	// the script of dependency is loaded
+	depConditionStarted = "started"
+	// the dependency is running, it is the default
+	depConditionRunning = "running"
+	// the dependency called agent.ready() or sent metric
+	depConditionReady = "ready"
+)
+
+// AppDependency an app that must meet the condition first
+type AppDependency struct {
+	AppName   string `json:"appName"`
+	Condition string `json:"condition,omitempty"`
+}
+
+func (d AppDependency) condition() string {
+	if len(d.Condition) == 0 {
+		return depConditionRunning
+	}
+	return d.Condition
+}
+
+func dependsOn(appConfig *AppConfig, name string) bool {
+	for _, dep := range appConfig.DependsOn {
+		if dep.AppName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// orderAppConfigs sort the configs so that the dependencies come before the dependents, the config order is kept otherwise.
+// The apps with missing dependency, unknown condition, in cycle or depend on these apps are returned as errors
+func orderAppConfigs(appConfigs []*AppConfig) ([]*AppConfig, map[string]error) {
+	byName := make(map[string]*AppConfig, len(appConfigs))
+	for _, appConfig := range appConfigs {
+		byName[appConfig.AppName] = appConfig
+	}
+
+	errs := make(map[string]error)
+	for _, appConfig := range appConfigs {
+		for _, dep := range appConfig.DependsOn {
+			if dep.AppName == appConfig.AppName {
+				errs[appConfig.AppName] = fmt.Errorf("depends on itself")
+				break
+			}
+			if _, ok := byName[dep.AppName]; !ok {
+				errs[appConfig.AppName] = fmt.Errorf("depends on missing app %s", dep.AppName)
+				break
+			}
+
+			switch dep.condition() {
+			case depConditionStarted, depConditionRunning, depConditionReady:
+			default:
+				errs[appConfig.AppName] = fmt.Errorf("unknown condition %s of dependency %s", dep.Condition, dep.AppName)
+			}
+		}
+	}
+
+	placed := make(map[string]bool, len(appConfigs))
+	ordered := make([]*AppConfig, 0, len(appConfigs))
+	for progress := true; progress; {
+		progress = false
+		for _, appConfig := range appConfigs {
+			name := appConfig.AppName
+			if placed[name] || !dependenciesPlaced(appConfig, byName, placed) {
+				continue
+			}
+
+			placed[name] = true
+			progress = true
+
+			if _, ok := errs[name]; !ok {
+				for _, dep := range appConfig.DependsOn {
+					if _, ok := errs[dep.AppName]; ok {
+						errs[name] = fmt.Errorf("dependency %s has config error", dep.AppName)
+						break
+					}
+				}
+			}
+
+			if _, ok := errs[name]; !ok {
+				ordered = append(ordered, appConfig)
+			}
+		}
+	}
+
+	// the apps left are in cycle, or depend on the apps in cycle
+	cycle := make([]string, 0)
+	for _, appConfig := range appConfigs {
+		if !placed[appConfig.AppName] {
+			cycle = append(cycle, appConfig.AppName)
+		}
+	}
+	sort.Strings(cycle)
+	for _, name := range cycle {
+		if _, ok := errs[name]; !ok {
+			errs[name] = fmt.Errorf("dependency cycle among %s", strings.Join(cycle, ","))
+		}
+	}
+
+	return ordered, errs
+}
+
+// dependenciesPlaced check the dependencies are placed, the missing and self ones are ignored because they are errors already
+func dependenciesPlaced(appConfig *AppConfig, byName map[string]*AppConfig, placed map[string]bool) bool {
+	for _, dep := range appConfig.DependsOn {
+		if _, ok := byName[dep.AppName]; !ok || dep.AppName == appConfig.AppName {
+			continue
+		}
+		if !placed[dep.AppName] {
+			return false
+		}
+	}
+	return true
+}
+
+// reportConfigErrors turn the apps with config error to failed, they will not start until the config is fixed
+func (c *Controller) reportConfigErrors(errs map[string]error) {
+	for name, err := range errs {
+		log.Errorf("Controller app %s config error: %s", name, err.Error())
+
+		lifecycle := c.lifecycles.get(name)
+		if lifecycle.current() == appStateStopped {
+			// a stopped app receive the new config before it fails
+			lifecycle.setState(appStatePending, "")
+		}
+		lifecycle.setState(appStateFailed, "config error: "+err.Error())
+	}
+}
+
+// dependencyReady check the dependency meets its condition
+func (c *Controller) dependencyReady(dep AppDependency) bool {
+	app, ok := c.apps[dep.AppName]
+	if !ok || app.app == nil {
+		return false
+	}
+
+	switch dep.condition() {
+	case depConditionStarted:
+		return true
+	case depConditionRunning:
+		return isAppUp(app.lifecycle.current())
+	case depConditionReady:
+		return isAppUp(app.lifecycle.current()) && app.app.IsReady()
+	}
+	return false
+}
+
+// startWaitingApps start the apps that their dependencies are ready, it must be called in Run loop
+func (c *Controller) startWaitingApps() {
+	ordered, _ := orderAppConfigs(c.appConfigs)
+	for _, appConfig := range ordered {
+		app, ok := c.apps[appConfig.AppName]
+		if !ok || !app.waiting || app.isStopping() {
+			continue
+		}
+
+		if notReady := c.notReadyDependency(appConfig); len(notReady) > 0 {
+			app.lifecycle.setState(appStatePending, "waiting for "+notReady)
+			continue
+		}
+
+		application, err := c.runApplication(appConfig)
+		if err != nil {
+			log.Errorf("Controller.startWaitingApps NewApplication failed:%s", err.Error())
+			delete(c.apps, appConfig.AppName)
+			continue
+		}
+		app.app = application
+		app.waiting = false
+	}
+}
+
+// notReadyDependency return the first dependency not meet its condition
+func (c *Controller) notReadyDependency(appConfig *AppConfig) string {
+	for _, dep := range appConfig.DependsOn {
+		if !c.dependencyReady(dep) {
+			return dep.AppName
+		}
+	}
+	return ""
+}
+
+// stopDependents stop the apps that depend on app, the dependents of them are stopped first.
+// They wait to start again until app is ready, the apps stopped by admin are kept stopped
+func (c *Controller) stopDependents(name string) {
+	for _, app := range c.apps {
+		if app.waiting || app.app == nil || !dependsOn(app.appConfig, name) {
+			continue
+		}
+
+		app.waiting = true
+		c.stopDependents(app.appConfig.AppName)
+
+		log.Infof("Controller.stopDependents stop %s, it depends on %s", app.appConfig.AppName, name)
+		c.stopApp(app)
+	}
+}
+
+// hasDependent check if any of apps depends on the app
+func hasDependent(apps map[string]*App, name string) bool {
+	for _, app := range apps {
+		if app.appConfig.AppName != name && dependsOn(app.appConfig, name) {
+			return true
+		}
+	}
+	return false
+}
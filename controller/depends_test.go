@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrderAppConfigs(t *testing.T) {
+	appConfigs := []*AppConfig{
+		{AppName: "app", DependsOn: []AppDependency{{AppName: "tunnel", Condition: depConditionReady}, {AppName: "vm"}}},
+		{AppName: "tunnel", DependsOn: []AppDependency{{AppName: "vm"}}},
+		{AppName: "vm"},
+		{AppName: "standalone"},
+	}
+
+	ordered, errs := orderAppConfigs(appConfigs)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+
+	names := make([]string, 0, len(ordered))
+	for _, appConfig := range ordered {
+		names = append(names, appConfig.AppName)
+	}
+	if strings.Join(names, ",") != "vm,standalone,tunnel,app" {
+		t.Fatalf("unexpected order %v", names)
+	}
+}
+
+func TestOrderAppConfigsErrors(t *testing.T) {
+	appConfigs := []*AppConfig{
+		{AppName: "a", DependsOn: []AppDependency{{AppName: "b"}}},
+		{AppName: "b", DependsOn: []AppDependency{{AppName: "a"}}},
+		{AppName: "c", DependsOn: []AppDependency{{AppName: "a"}}},
+		{AppName: "d", DependsOn: []AppDependency{{AppName: "missing"}}},
+		{AppName: "e", DependsOn: []AppDependency{{AppName: "d"}}},
+		{AppName: "f", DependsOn: []AppDependency{{AppName: "g", Condition: "healthy"}}},
+		{AppName: "g"},
+		{AppName: "h", DependsOn: []AppDependency{{AppName: "h"}}},
+	}
+
+	ordered, errs := orderAppConfigs(appConfigs)
+	if len(ordered) != 1 || ordered[0].AppName != "g" {
+		t.Fatalf("only g is valid, got %v", ordered)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "h"} {
+		if errs[name] == nil {
+			t.Fatalf("%s should has config error", name)
+		}
+	}
+	if !strings.Contains(errs["a"].Error(), "cycle") {
+		t.Fatalf("a should be in cycle: %v", errs["a"])
+	}
+	if !strings.Contains(errs["d"].Error(), "missing") {
+		t.Fatalf("d depends on missing app: %v", errs["d"])
+	}
+	if !strings.Contains(errs["e"].Error(), "dependency d") {
+		t.Fatalf("e depends on app with error: %v", errs["e"])
+	}
+}
+
+func TestHasDependent(t *testing.T) {
+	apps := map[string]*App{
+		"vm":  {appConfig: &AppConfig{AppName: "vm"}},
+		"app": {appConfig: &AppConfig{AppName: "app", DependsOn: []AppDependency{{AppName: "vm"}}}},
+	}
+
+	if !hasDependent(apps, "vm") {
+		t.Fatalf("app depends on vm")
+	}
+	if hasDependent(apps, "app") {
+		t.Fatalf("nothing depends on app")
+	}
+}
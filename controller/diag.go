@@ -0,0 +1,633 @@
+package controller
+
+import (
+	"agent/agent"
+	ahttp "agent/common/http"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gnet "github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the MB of each log collected, the controller log and the log of every app
+	defaultDiagLogMB = 2
+	maxDiagLogMB     = 16
+	// the logs in a bundle share this budget, so the bundle stay below the upload limit of server
+	maxDiagLogsBytes = 24 << 20
+	// server reject the bundle larger than 32MB
+	maxDiagUploadSize = 30 << 20
+	// the requested diag that failed is retried with backoff, not on every metrics push
+	diagRetryInterval = 10 * time.Minute
+	maxDiagBackoff    = 6 * time.Hour
+	// the bundles kept in working dir
+	diagDir        = "diag"
+	maxDiagBundles = 3
+	// header set by server when it want the diagnostics bundle, the value is log MB
+	uploadDiagHeader = "Upload-Diag"
+	// the budget to collect and upload the bundle
+	diagTimeout = 3 * time.Minute
+	// the entries listed in each app dir
+	maxDiagDirEntries = 2000
+
+	redactedText = "[REDACTED]"
+)
+
+var errDiagRunning = fmt.Errorf("diag is running")
+
+// DiagInfo the runtime state of controller in diagnostics bundle
+type DiagInfo struct {
+	Status     *ControllerStatus `json:"status"`
+	Apps       []*AppStatus      `json:"apps"`
+	Goroutines int               `json:"goroutines"`
+	HeapAlloc  uint64            `json:"heapAlloc"`
+	// the unsent metrics reports
+	SpoolReports int `json:"spoolReports"`
+}
+
+// DiagResult the bundle saved in working dir and its upload result
+type DiagResult struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Uploaded    bool   `json:"uploaded"`
+	UploadError string `json:"uploadError,omitempty"`
+}
+
+var (
+	// the jwt, e.g. token in url or log
+	jwtPattern    = regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]+`)
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)\S+`)
+	// "key": "value" or key=value of the secret fields
+	secretFieldPattern = regexp.MustCompile(`(?i)("?(?:key|token|secret|password|passwd|private_?key)"?\s*[:=]\s*"?)([^"&\s,}]+)`)
+	// user:pass in url
+	userinfoPattern = regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`)
+)
+
+// redactor remove the secrets from the files in diagnostics bundle
+type redactor struct {
+	secrets []string
+}
+
+func (r *redactor) redact(b []byte) []byte {
+	for _, secret := range r.secrets {
+		if len(secret) > 0 {
+			b = bytes.ReplaceAll(b, []byte(secret), []byte(redactedText))
+		}
+	}
+
+	b = jwtPattern.ReplaceAll(b, []byte(redactedText))
+	b = bearerPattern.ReplaceAll(b, []byte("${1}"+redactedText))
+	b = secretFieldPattern.ReplaceAll(b, []byte("${1}"+redactedText))
+	b = userinfoPattern.ReplaceAll(b, []byte("${1}"+redactedText+"@"))
+	return b
+}
+
+// diagBundle the zip of diagnostics, the errors of collectors are written to errors.txt
+type diagBundle struct {
+	buf      bytes.Buffer
+	zw       *zip.Writer
+	redactor *redactor
+	errs     []string
+}
+
+func newDiagBundle(r *redactor) *diagBundle {
+	b := &diagBundle{redactor: r}
+	b.zw = zip.NewWriter(&b.buf)
+	return b
+}
+
+func (b *diagBundle) add(name string, data []byte) {
+	w, err := b.zw.Create(name)
+	if err != nil {
+		b.errs = append(b.errs, fmt.Sprintf("%s: %s", name, err.Error()))
+		return
+	}
+	if _, err := w.Write(b.redactor.redact(data)); err != nil {
+		b.errs = append(b.errs, fmt.Sprintf("%s: %s", name, err.Error()))
+	}
+}
+
+func (b *diagBundle) addJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.errs = append(b.errs, fmt.Sprintf("%s: %s", name, err.Error()))
+		return
+	}
+	b.add(name, data)
+}
+
+func (b *diagBundle) addError(name string, err error) {
+	b.errs = append(b.errs, fmt.Sprintf("%s: %s", name, err.Error()))
+}
+
+func (b *diagBundle) close() ([]byte, error) {
+	if len(b.errs) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errs, "\n")))
+	}
+	if err := b.zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.buf.Bytes(), nil
+}
+
+// runDiag collect the diagnostics bundle, save it in working dir and upload it to server.
+// Only one diag run at a time
+func (c *Controller) runDiag(ctx context.Context, logMB int, upload bool, reason string) (*DiagResult, error) {
+	if !c.diagMu.TryLock() {
+		return nil, errDiagRunning
+	}
+	defer c.diagMu.Unlock()
+
+	if logMB <= 0 {
+		logMB = defaultDiagLogMB
+	}
+	logMB = min(logMB, maxDiagLogMB)
+
+	ctx, cancel := context.WithTimeout(ctx, diagTimeout)
+	defer cancel()
+
+	bundle, err := c.collectDiag(ctx, int64(logMB)<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	bundlePath, err := c.saveDiag(bundle)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Controller diag bundle %s, size %d", bundlePath, len(bundle))
+
+	result := &DiagResult{Path: bundlePath, Size: int64(len(bundle))}
+	if upload && len(bundle) > maxDiagUploadSize {
+		result.UploadError = fmt.Sprintf("bundle size %d exceed the upload limit %d", len(bundle), maxDiagUploadSize)
+		log.Errorf("Controller.runDiag %s", result.UploadError)
+	} else if upload {
+		if err := c.pushDiag(ctx, bundle, reason); err != nil {
+			log.Errorf("Controller.runDiag upload failed: %s", err.Error())
+			result.UploadError = err.Error()
+		} else {
+			result.Uploaded = true
+		}
+	}
+	return result, nil
+}
+
+// collectDiag pack the logs, configs and states of controller and apps into a zip, the secrets are redacted
+func (c *Controller) collectDiag(ctx context.Context, logBytes int64) ([]byte, error) {
+	// the apps are touched in Run loop only
+	v, err := c.runInLoop(ctx, func() (interface{}, error) {
+		appConfigs := make([]*AppConfig, len(c.appConfigs))
+		copy(appConfigs, c.appConfigs)
+		return appConfigs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	appConfigs := v.([]*AppConfig)
+
+	bundle := newDiagBundle(&redactor{secrets: []string{c.args.KEY, c.tokens.Token()}})
+
+	// the newest part of every log is kept when the logs exceed the budget
+	logBytes = min(logBytes, diagLogBudget(len(appConfigs)+1))
+
+	if info, err := c.diagInfo(ctx); err != nil {
+		bundle.addError("status.json", err)
+	} else {
+		bundle.addJSON("status.json", info)
+	}
+
+	baseInfo := make(map[string]string)
+	for k, values := range c.baseInfo.ToURLQuery() {
+		baseInfo[k] = strings.Join(values, ",")
+	}
+	bundle.addJSON("baseinfo.json", baseInfo)
+
+	configPath := path.Join(c.args.WorkingDir, c.args.RelAppsDir, c.args.AppConfigsFileName)
+	if b, err := os.ReadFile(configPath); err != nil {
+		bundle.addError(c.args.AppConfigsFileName, err)
+	} else {
+		bundle.add(c.args.AppConfigsFileName, b)
+	}
+
+	if len(c.args.LogFile) > 0 {
+		if b, err := tailFiles([]string{c.args.LogFile}, logBytes); err != nil {
+			bundle.addError("controller.log", err)
+		} else {
+			bundle.add("controller.log", b)
+		}
+	}
+
+	scripts := make([]string, 0, len(appConfigs))
+	for _, appConfig := range appConfigs {
+		appDir := path.Join(c.args.WorkingDir, c.args.RelAppsDir, appConfig.AppDir)
+
+		files, err := agent.AppLogFiles(appDir)
+		if err == nil {
+			var b []byte
+			if b, err = tailFiles(files, logBytes); err == nil {
+				bundle.add(path.Join("apps", appConfig.AppName, "app.log"), b)
+			}
+		}
+		if err != nil {
+			bundle.addError(path.Join("apps", appConfig.AppName, "app.log"), err)
+		}
+
+		bundle.add(path.Join("apps", appConfig.AppName, "files.txt"), listDir(appDir))
+
+		diskMD5 := "-"
+		if b, err := os.ReadFile(path.Join(appDir, appConfig.ScriptName)); err == nil {
+			diskMD5 = fmt.Sprintf("%x", md5.Sum(b))
+		}
+		scripts = append(scripts, fmt.Sprintf("%s\t%s\tconfig=%s\tdisk=%s", appConfig.AppName, appConfig.ScriptName, appConfig.ScriptMD5, diskMD5))
+	}
+	bundle.add("scripts.txt", []byte(strings.Join(scripts, "\n")))
+
+	if b, err := processTree(ctx); err != nil {
+		bundle.addError("processes.txt", err)
+	} else {
+		bundle.add("processes.txt", b)
+	}
+
+	bundle.addJSON("network.json", c.diagNetwork(ctx))
+	bundle.addJSON("dns.json", c.diagDNS(ctx))
+
+	if clock, err := c.diagClock(ctx); err != nil {
+		bundle.addError("clock.json", err)
+	} else {
+		bundle.addJSON("clock.json", clock)
+	}
+
+	return bundle.close()
+}
+
+// saveDiag write the bundle to working dir, the oldest bundles are removed
+func (c *Controller) saveDiag(bundle []byte) (string, error) {
+	dir := path.Join(c.args.WorkingDir, diagDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	bundlePath := path.Join(dir, fmt.Sprintf("diag-%d.zip", time.Now().Unix()))
+	if err := os.WriteFile(bundlePath, bundle, 0600); err != nil {
+		return "", err
+	}
+
+	bundles, err := filepath.Glob(path.Join(dir, "diag-*.zip"))
+	if err != nil {
+		return bundlePath, nil
+	}
+	sort.Strings(bundles)
+	for i := 0; i < len(bundles)-maxDiagBundles; i++ {
+		os.Remove(bundles[i])
+	}
+	return bundlePath, nil
+}
+
+func (c *Controller) pushDiag(ctx context.Context, bundle []byte, reason string) error {
+	url := fmt.Sprintf("%s%s?reason=%s", c.args.ServerURL, "/push/diag", url.QueryEscape(reason))
+
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bundle))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/zip")
+		return req, nil
+	}
+
+	client := &http.Client{
+		Timeout:   diagTimeout,
+		Transport: ahttp.DefaultDNSRountTripper,
+	}
+
+	resp, err := c.doWithToken(client, newReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pushDiag status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+	}
+	return nil
+}
+
+// uploadDiag run diag requested by server in metrics response. Server keep asking until the
+// bundle is uploaded, so the failed one is retried after backoff instead of every push
+func (c *Controller) uploadDiag(value string) {
+	if time.Now().UnixNano() < c.diagRetryAt.Load() {
+		return
+	}
+
+	logMB, _ := strconv.Atoi(value)
+	result, err := c.runDiag(context.Background(), logMB, true, "requested")
+	if err == errDiagRunning {
+		return
+	}
+	if err == nil && result.Uploaded {
+		c.diagScheduler.Success()
+		c.diagRetryAt.Store(0)
+		return
+	}
+
+	if err == nil {
+		err = fmt.Errorf("%s", result.UploadError)
+	}
+
+	c.diagScheduler.Failure()
+	next := c.diagScheduler.Next()
+	c.diagRetryAt.Store(time.Now().Add(next).UnixNano())
+	log.Errorf("Controller.uploadDiag: %s, retry after %s", err.Error(), next)
+}
+
+// diagLogBudget return the bytes of each log when there are n logs
+func diagLogBudget(n int) int64 {
+	if n <= 0 {
+		n = 1
+	}
+	return maxDiagLogsBytes / int64(n)
+}
+
+// tailFiles return the last n bytes of files, the files are in time order
+func tailFiles(files []string, n int64) ([]byte, error) {
+	chunks := make([][]byte, 0, len(files))
+	for i := len(files) - 1; i >= 0 && n > 0; i-- {
+		b, err := tailFile(files[i], n)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, b)
+		n -= int64(len(b))
+	}
+
+	var buf bytes.Buffer
+	for i := len(chunks) - 1; i >= 0; i-- {
+		buf.Write(chunks[i])
+	}
+	return buf.Bytes(), nil
+}
+
+func tailFile(name string, n int64) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := max(info.Size()-n, 0)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(f, n))
+}
+
+// listDir list the files of dir with size, relative to dir
+func listDir(dir string) []byte {
+	var buf bytes.Buffer
+	entries := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Fprintf(&buf, "%s\terror: %s\n", p, err.Error())
+			return nil
+		}
+
+		entries++
+		if entries > maxDiagDirEntries {
+			fmt.Fprintf(&buf, "... more than %d entries\n", maxDiagDirEntries)
+			return filepath.SkipAll
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		if d.IsDir() {
+			fmt.Fprintf(&buf, "%s/\n", rel)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			fmt.Fprintf(&buf, "%s\terror: %s\n", rel, err.Error())
+			return nil
+		}
+		fmt.Fprintf(&buf, "%s\t%d\t%s\n", rel, info.Size(), info.ModTime().Format(time.RFC3339))
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(&buf, "error: %s\n", err.Error())
+	}
+	return buf.Bytes()
+}
+
+// processTree print the processes as tree by parent pid
+func processTree(ctx context.Context) ([]byte, error) {
+	procs, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type procInfo struct {
+		pid, ppid int32
+		line      string
+	}
+
+	infos := make(map[int32]*procInfo)
+	children := make(map[int32][]int32)
+	for _, p := range procs {
+		ppid, _ := p.PpidWithContext(ctx)
+		name, _ := p.NameWithContext(ctx)
+		cmdline, _ := p.CmdlineWithContext(ctx)
+		var rss uint64
+		if mem, err := p.MemoryInfoWithContext(ctx); err == nil && mem != nil {
+			rss = mem.RSS
+		}
+
+		infos[p.Pid] = &procInfo{pid: p.Pid, ppid: ppid, line: fmt.Sprintf("%d %s rss=%d %s", p.Pid, name, rss, cmdline)}
+		children[ppid] = append(children[ppid], p.Pid)
+	}
+
+	var buf bytes.Buffer
+	visited := make(map[int32]bool)
+	var walk func(pid int32, depth int)
+	walk = func(pid int32, depth int) {
+		if visited[pid] {
+			return
+		}
+		visited[pid] = true
+
+		fmt.Fprintf(&buf, "%s%s\n", strings.Repeat("  ", depth), infos[pid].line)
+
+		kids := children[pid]
+		sort.Slice(kids, func(i, j int) bool { return kids[i] < kids[j] })
+		for _, kid := range kids {
+			walk(kid, depth+1)
+		}
+	}
+
+	pids := make([]int32, 0, len(infos))
+	for pid := range infos {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	for _, pid := range pids {
+		// the parent is gone or it is the root
+		if _, ok := infos[infos[pid].ppid]; !ok || infos[pid].ppid == pid {
+			walk(pid, 0)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Controller) diagNetwork(ctx context.Context) map[string]interface{} {
+	network := make(map[string]interface{})
+
+	if interfaces, err := gnet.InterfacesWithContext(ctx); err != nil {
+		network["interfacesError"] = err.Error()
+	} else {
+		network["interfaces"] = interfaces
+	}
+
+	if counters, err := gnet.IOCountersWithContext(ctx, true); err != nil {
+		network["countersError"] = err.Error()
+	} else {
+		network["counters"] = counters
+	}
+
+	traffic, cpuUsage := c.stats.getTraffic()
+	network["traffic"] = traffic
+	network["cpuUsage"] = cpuUsage
+	return network
+}
+
+// dnsResult the resolution of host by system resolver and DoH
+type dnsResult struct {
+	Host        string   `json:"host"`
+	System      []string `json:"system,omitempty"`
+	SystemError string   `json:"systemError,omitempty"`
+	SystemMs    int64    `json:"systemMs"`
+	DoH         []string `json:"doh,omitempty"`
+	DoHError    string   `json:"dohError,omitempty"`
+	DoHMs       int64    `json:"dohMs"`
+}
+
+func (c *Controller) diagDNS(ctx context.Context) []*dnsResult {
+	hosts := make([]string, 0, 2)
+	for _, rawURL := range []string{c.args.ServerURL, c.args.WebServerUrl} {
+		if u, err := url.Parse(rawURL); err == nil && len(u.Hostname()) > 0 {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+
+	results := make([]*dnsResult, 0, len(hosts))
+	for _, host := range hosts {
+		result := &dnsResult{Host: host}
+
+		start := time.Now()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		result.SystemMs = time.Since(start).Milliseconds()
+		if err != nil {
+			result.SystemError = err.Error()
+		}
+		for _, addr := range addrs {
+			result.System = append(result.System, addr.IP.String())
+		}
+
+		start = time.Now()
+		ips, err := ahttp.DefaultDNSRountTripper.LookupIP(ctx, host)
+		result.DoHMs = time.Since(start).Milliseconds()
+		if err != nil {
+			result.DoHError = err.Error()
+		}
+		for _, ip := range ips {
+			result.DoH = append(result.DoH, ip.String())
+		}
+
+		results = append(results, result)
+	}
+	return results
+}
+
+// clockResult the offset of local clock to server, by the Date header
+type clockResult struct {
+	LocalTime     string  `json:"localTime"`
+	ServerTime    string  `json:"serverTime"`
+	OffsetSeconds float64 `json:"offsetSeconds"`
+	RTTMs         int64   `json:"rttMs"`
+}
+
+func (c *Controller) diagClock(ctx context.Context) (*clockResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", c.args.ServerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: ahttp.DefaultDNSRountTripper}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return nil, fmt.Errorf("parse Date header: %w", err)
+	}
+
+	local := start.Add(rtt / 2)
+	return &clockResult{
+		LocalTime:     local.Format(time.RFC3339Nano),
+		ServerTime:    serverTime.Format(time.RFC3339),
+		OffsetSeconds: serverTime.Sub(local).Seconds(),
+		RTTMs:         rtt.Milliseconds(),
+	}, nil
+}
+
+func (c *Controller) diagInfo(ctx context.Context) (*DiagInfo, error) {
+	v, err := c.runInLoop(ctx, func() (interface{}, error) {
+		return &DiagInfo{Status: c.status(), Apps: c.appStatuses()}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	diag := v.(*DiagInfo)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	diag.Goroutines = runtime.NumGoroutine()
+	diag.HeapAlloc = mem.HeapAlloc
+
+	if reports, err := c.spool.reports(); err == nil {
+		diag.SpoolReports = len(reports)
+	}
+	return diag, nil
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The lifecycle states of app
+const (
+	// the config is received, wait to download or start
+	appStatePending     = "pending"
+	appStateDownloading = "downloading"
+	appStateStarting    = "starting"
+	appStateRunning     = "running"
+	// the script is running but has error
+	appStateDegraded = "degraded"
+	appStateStopping = "stopping"
+	appStateStopped  = "stopped"
+	appStateFailed   = "failed"
+)
+
+// the transitions that app can make from a state
+var appTransitions = map[string][]string{
+	appStatePending:     {appStateDownloading, appStateStarting, appStateStopped, appStateFailed},
+	appStateDownloading: {appStatePending, appStateStarting, appStateStopped, appStateFailed},
+	appStateStarting:    {appStateRunning, appStateDegraded, appStateStopping, appStateFailed},
+	appStateRunning:     {appStateDegraded, appStateStopping, appStateFailed},
+	appStateDegraded:    {appStateRunning, appStateStopping, appStateFailed},
+	appStateStopping:    {appStateStopped, appStateFailed},
+	appStateStopped:     {appStatePending, appStateDownloading, appStateStarting},
+	appStateFailed:      {appStatePending, appStateDownloading, appStateStarting, appStateStopped},
+}
+
+// the transitions more than this are dropped from history
+const maxAppTransitions = 20
+
+// AppTransition a state change of app
+type AppTransition struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Time   int64  `json:"time"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// appLifecycle the state of app, it is safe to use in any goroutine
+type appLifecycle struct {
+	name string
+
+	mu      sync.Mutex
+	state   string
+	since   time.Time
+	reason  string
+	history []AppTransition
+}
+
+func newAppLifecycle(name string) *appLifecycle {
+	now := time.Now()
+	return &appLifecycle{
+		name:    name,
+		state:   appStatePending,
+		since:   now,
+		history: []AppTransition{{To: appStatePending, Time: now.Unix()}},
+	}
+}
+
+// transition change the state, the reason is recorded for failed and degraded state
+func (l *appLifecycle) transition(to, reason string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	from := l.state
+	if from == to {
+		// keep the latest reason, e.g. the dependency that app is waiting for
+		if len(reason) > 0 {
+			l.reason = reason
+		}
+		return nil
+	}
+	if !canTransition(from, to) {
+		return fmt.Errorf("app %s can not change from %s to %s", l.name, from, to)
+	}
+
+	now := time.Now()
+	l.state, l.since, l.reason = to, now, reason
+	l.history = append(l.history, AppTransition{From: from, To: to, Time: now.Unix(), Reason: reason})
+	if len(l.history) > maxAppTransitions {
+		l.history = l.history[len(l.history)-maxAppTransitions:]
+	}
+
+	if to == appStateFailed || to == appStateDegraded {
+		log.Warnf("app %s %s -> %s: %s", l.name, from, to, reason)
+	} else {
+		log.Infof("app %s %s -> %s", l.name, from, to)
+	}
+	return nil
+}
+
+// setState make the transition and log the invalid one, used where the state is informative only
+func (l *appLifecycle) setState(to, reason string) {
+	if err := l.transition(to, reason); err != nil {
+		log.Warn(err.Error())
+	}
+}
+
+func (l *appLifecycle) current() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state
+}
+
+// AppLifecycleStatus the state and recent transitions of app
+type AppLifecycleStatus struct {
+	State       string          `json:"state"`
+	StateSince  int64           `json:"stateSince"`
+	StateReason string          `json:"stateReason,omitempty"`
+	Transitions []AppTransition `json:"transitions,omitempty"`
+}
+
+func (l *appLifecycle) status() AppLifecycleStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return AppLifecycleStatus{
+		State:       l.state,
+		StateSince:  l.since.Unix(),
+		StateReason: l.reason,
+		Transitions: append([]AppTransition(nil), l.history...),
+	}
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range appTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// isAppUp check if the processes of app are running in the state
+func isAppUp(state string) bool {
+	return state == appStateRunning || state == appStateDegraded
+}
+
+// appLifecycles the lifecycles of apps by name, it is kept across the app restart
+// so the history is not lost when config change
+type appLifecycles struct {
+	mu         sync.Mutex
+	lifecycles map[string]*appLifecycle
+}
+
+func newAppLifecycles() *appLifecycles {
+	return &appLifecycles{lifecycles: make(map[string]*appLifecycle)}
+}
+
+// get return the lifecycle of app, a new one in pending state is created if not exist
+func (ls *appLifecycles) get(name string) *appLifecycle {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.lifecycles[name]
+	if !ok {
+		l = newAppLifecycle(name)
+		ls.lifecycles[name] = l
+	}
+	return l
+}
+
+func (ls *appLifecycles) remove(name string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	delete(ls.lifecycles, name)
+}
+
+// all return the lifecycles by name
+func (ls *appLifecycles) all() map[string]*appLifecycle {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	all := make(map[string]*appLifecycle, len(ls.lifecycles))
+	for name, l := range ls.lifecycles {
+		all[name] = l
+	}
+	return all
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestAppLifecycleTransition(t *testing.T) {
+	l := newAppLifecycle("test")
+
+	for _, to := range []string{appStateDownloading, appStateStarting, appStateRunning, appStateDegraded, appStateStopping, appStateStopped} {
+		if err := l.transition(to, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a stopped app must start again before running
+	if err := l.transition(appStateRunning, ""); err == nil {
+		t.Fatalf("stopped -> running should be rejected")
+	}
+	if l.current() != appStateStopped {
+		t.Fatalf("rejected transition change state to %s", l.current())
+	}
+
+	if err := l.transition(appStateFailed, "boom"); err == nil {
+		t.Fatalf("stopped -> failed should be rejected")
+	}
+
+	if err := l.transition(appStateStarting, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.transition(appStateFailed, "load script: no such file"); err != nil {
+		t.Fatal(err)
+	}
+
+	status := l.status()
+	if status.State != appStateFailed || status.StateReason != "load script: no such file" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// the initial pending and 8 transitions
+	if len(status.Transitions) != 9 {
+		t.Fatalf("expect 9 transitions, got %d", len(status.Transitions))
+	}
+	last := status.Transitions[len(status.Transitions)-1]
+	if last.From != appStateStarting || last.To != appStateFailed {
+		t.Fatalf("unexpected last transition %+v", last)
+	}
+}
+
+func TestAppLifecycleHistoryLimit(t *testing.T) {
+	l := newAppLifecycle("test")
+	l.transition(appStateStarting, "")
+	for i := 0; i < maxAppTransitions; i++ {
+		l.transition(appStateRunning, "")
+		l.transition(appStateDegraded, "error")
+	}
+
+	status := l.status()
+	if len(status.Transitions) != maxAppTransitions {
+		t.Fatalf("history should be limited to %d, got %d", maxAppTransitions, len(status.Transitions))
+	}
+	if status.Transitions[len(status.Transitions)-1].To != appStateDegraded {
+		t.Fatalf("the latest transition should be kept")
+	}
+}
@@ -22,3 +22,39 @@ func (hook *LogHook) Fire(entry *log.Entry) error {
 func (hook *LogHook) Levels() []log.Level {
 	return hook.LogLevels
 }
+
+// StdLogHook forward each entry with extra fields to the std logger, so the
+// output follow the level and format of the std logger even after a reload
+type StdLogHook struct {
+	Fields log.Fields
+}
+
+// Fire write the entry to the std logger
+func (hook *StdLogHook) Fire(entry *log.Entry) error {
+	std := log.StandardLogger()
+	if !std.IsLevelEnabled(entry.Level) {
+		return nil
+	}
+
+	data := make(log.Fields, len(entry.Data)+len(hook.Fields))
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+	for key, value := range hook.Fields {
+		data[key] = value
+	}
+	std.WithFields(data).WithTime(entry.Time).Log(entry.Level, entry.Message)
+	return nil
+}
+
+// Levels return all levels, the std logger does the filtering
+func (hook *StdLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// discardFormatter skip the formatting for loggers that only forward by hooks
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
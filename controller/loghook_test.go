@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestAppLoggerFollowStd(t *testing.T) {
+	std := log.StandardLogger()
+	out, formatter, level := std.Out, std.Formatter, std.GetLevel()
+	defer func() {
+		std.SetOutput(out)
+		std.SetFormatter(formatter)
+		std.SetLevel(level)
+	}()
+
+	var buf bytes.Buffer
+	std.SetOutput(&buf)
+	std.SetFormatter(&log.TextFormatter{DisableColors: true})
+	std.SetLevel(log.InfoLevel)
+
+	app := &Application{
+		args:          &AppArguments{AppConfig: &AppConfig{AppName: "app1"}},
+		scriptFileMD5: "abc",
+	}
+	logger := app.newLogger()
+
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("debug log should be filtered: %q", buf.String())
+	}
+
+	// simulate a reload of the log config
+	std.SetLevel(log.DebugLevel)
+	std.SetFormatter(&log.JSONFormatter{})
+
+	logger.WithField("k", "v").Debug("shown")
+	got := buf.String()
+	for _, want := range []string{`"msg":"shown"`, `"app":"app1"`, `"scriptMD5":"abc"`, `"k":"v"`, `"level":"debug"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output %q missing %s", got, want)
+		}
+	}
+}
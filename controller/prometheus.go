@@ -0,0 +1,258 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"agent/agent"
+	ahttp "agent/common/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// controllerStats the counters exported by /metrics
+type controllerStats struct {
+	scriptReloads    atomic.Int64
+	pollFailures     atomic.Int64
+	pushMetricsFails atomic.Int64
+
+	// the readings of collectTraffic
+	mu       sync.Mutex
+	traffic  agent.NetworkStatsRate
+	cpuUsage float64
+}
+
+func (cs *controllerStats) setTraffic(traffic agent.NetworkStatsRate, cpuUsage float64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.traffic = traffic
+	cs.cpuUsage = cpuUsage
+}
+
+func (cs *controllerStats) getTraffic() (agent.NetworkStatsRate, float64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.traffic, cs.cpuUsage
+}
+
+// serveMetrics export the metrics in prometheus text format
+func (c *Controller) serveMetrics(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", c.handleMetrics)
+
+	srv := &http.Server{Addr: c.args.MetricsAddr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Infof("Controller metrics listen on %s", c.args.MetricsAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Controller.serveMetrics failed:%v", err)
+	}
+}
+
+type appSnapshot struct {
+	status     *AppStatus
+	usage      *agent.AppUsage
+	eventQueue int
+}
+
+func (c *Controller) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	v, err := c.runInLoop(r.Context(), func() (interface{}, error) {
+		apps := make([]*appSnapshot, 0, len(c.apps))
+		for _, app := range c.apps {
+			snapshot := &appSnapshot{status: app.status()}
+			if app.app != nil {
+				usage := app.app.Usage()
+				snapshot.usage = &usage
+				snapshot.eventQueue = app.app.EventQueueLen()
+			}
+			apps = append(apps, snapshot)
+		}
+		return apps, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	apps := v.([]*appSnapshot)
+	sort.Slice(apps, func(i, j int) bool { return apps[i].status.AppName < apps[j].status.AppName })
+
+	pw := &promWriter{}
+
+	running := 0
+	for _, app := range apps {
+		if isAppUp(app.status.State) {
+			running++
+		}
+	}
+	pw.write("titan_controller_apps", "gauge", "Number of apps", float64(len(apps)))
+	pw.write("titan_controller_apps_running", "gauge", "Number of running apps", float64(running))
+	pw.write("titan_controller_script_reloads_total", "counter", "Number of app scripts reloaded", float64(c.stats.scriptReloads.Load()))
+	pw.write("titan_controller_poll_failures_total", "counter", "Number of failed polls to server", float64(c.stats.pollFailures.Load()))
+	pw.write("titan_controller_push_metrics_failures_total", "counter", "Number of failed metrics push to server", float64(c.stats.pushMetricsFails.Load()))
+	pw.write("titan_controller_tls_pin_failures_total", "counter", "Number of requests failed by certificate pin mismatch", float64(ahttp.DefaultDNSRountTripper.PinFailures()))
+	pw.write("titan_controller_offline_seconds", "gauge", "Seconds since the server can not reach", c.pollScheduler.OfflineDuration().Seconds())
+	pw.write("titan_controller_metric_queue_depth", "gauge", "Number of app metrics wait to handle", float64(len(c.metricCh)))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	pw.write("titan_controller_goroutines", "gauge", "Number of goroutines", float64(runtime.NumGoroutine()))
+	pw.write("titan_controller_memory_alloc_bytes", "gauge", "Bytes of allocated heap objects", float64(mem.Alloc))
+	pw.write("titan_controller_memory_sys_bytes", "gauge", "Bytes of memory obtained from the OS", float64(mem.Sys))
+
+	traffic, cpuUsage := c.stats.getTraffic()
+	pw.write("titan_node_network_receive_bytes_per_second", "gauge", "Node network receive rate", traffic.IRate)
+	pw.write("titan_node_network_transmit_bytes_per_second", "gauge", "Node network transmit rate", traffic.ORate)
+
+	pw.header("titan_node_network_interface_receive_bytes_per_second", "gauge", "Network receive rate of interface")
+	for _, nic := range traffic.Interfaces {
+		pw.sample("titan_node_network_interface_receive_bytes_per_second", nic.IRate, "interface", nic.Name)
+	}
+	pw.header("titan_node_network_interface_transmit_bytes_per_second", "gauge", "Network transmit rate of interface")
+	for _, nic := range traffic.Interfaces {
+		pw.sample("titan_node_network_interface_transmit_bytes_per_second", nic.ORate, "interface", nic.Name)
+	}
+	pw.write("titan_node_cpu_usage_percent", "gauge", "Node cpu usage", cpuUsage)
+
+	pw.header("titan_app_up", "gauge", "Whether the app is running")
+	for _, app := range apps {
+		up := 0.0
+		if isAppUp(app.status.State) {
+			up = 1
+		}
+		pw.sample("titan_app_up", up, "app", app.status.AppName)
+	}
+
+	pw.header("titan_app_uptime_seconds", "gauge", "Seconds since the app start")
+	for _, app := range apps {
+		pw.sample("titan_app_uptime_seconds", float64(app.status.Uptime), "app", app.status.AppName)
+	}
+
+	pw.header("titan_app_event_queue_depth", "gauge", "Number of script events wait to handle")
+	for _, app := range apps {
+		pw.sample("titan_app_event_queue_depth", float64(app.eventQueue), "app", app.status.AppName)
+	}
+
+	usages := []struct {
+		name string
+		typ  string
+		help string
+		get  func(u *agent.AppUsage) float64
+	}{
+		{"titan_app_cpu_seconds_total", "counter", "CPU seconds used by app processes", func(u *agent.AppUsage) float64 { return u.CPUSeconds }},
+		{"titan_app_rss_bytes", "gauge", "Resident memory of app processes", func(u *agent.AppUsage) float64 { return float64(u.RSSBytes) }},
+		{"titan_app_read_bytes_total", "counter", "Disk bytes read by app processes", func(u *agent.AppUsage) float64 { return float64(u.ReadBytes) }},
+		{"titan_app_write_bytes_total", "counter", "Disk bytes written by app processes", func(u *agent.AppUsage) float64 { return float64(u.WriteBytes) }},
+		{"titan_app_network_receive_bytes_total", "counter", "Network bytes received by app", func(u *agent.AppUsage) float64 { return float64(u.NetRxBytes) }},
+		{"titan_app_network_transmit_bytes_total", "counter", "Network bytes sent by app", func(u *agent.AppUsage) float64 { return float64(u.NetTxBytes) }},
+	}
+	for _, usage := range usages {
+		pw.header(usage.name, usage.typ, usage.help)
+		for _, app := range apps {
+			if app.usage != nil {
+				pw.sample(usage.name, usage.get(app.usage), "app", app.status.AppName)
+			}
+		}
+	}
+
+	// the numeric fields of the metric that script emit
+	pw.header("titan_app_metric", "gauge", "Numeric fields of the metric emitted by app script")
+	for _, app := range apps {
+		fields := numericMetricFields(app.status.LastMetric)
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			pw.sample("titan_app_metric", fields[name], "app", app.status.AppName, "name", name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(pw.String()))
+}
+
+// numericMetricFields parse the json metric, nested fields are joined with '_'
+func numericMetricFields(metric string) map[string]float64 {
+	fields := make(map[string]float64)
+	if len(metric) == 0 {
+		return fields
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(metric), &v); err != nil {
+		return fields
+	}
+
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch value := v.(type) {
+		case float64:
+			fields[prefix] = value
+		case bool:
+			if value {
+				fields[prefix] = 1
+			} else {
+				fields[prefix] = 0
+			}
+		case map[string]interface{}:
+			for k, child := range value {
+				name := k
+				if len(prefix) > 0 {
+					name = prefix + "_" + k
+				}
+				walk(name, child)
+			}
+		}
+	}
+	walk("", v)
+
+	return fields
+}
+
+// promWriter write the prometheus text format
+type promWriter struct {
+	strings.Builder
+}
+
+func (pw *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(pw, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(pw, "# TYPE %s %s\n", name, typ)
+}
+
+// sample labels are key value pairs
+func (pw *promWriter) sample(name string, value float64, labels ...string) {
+	pw.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+		}
+		pw.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(pw, " %g\n", value)
+}
+
+func (pw *promWriter) write(name, typ, help string, value float64) {
+	pw.header(name, typ, help)
+	pw.sample(name, value)
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metricsSpoolDir = "metrics-spool"
+	// a day of reports at pushMetricsInterval
+	maxSpoolReports = 720
+	maxSpoolBytes   = 32 << 20
+
+	spoolStateFile = "state"
+	spoolReportExt = ".json.gz"
+
+	// the headers that identify a report
+	metricsEpochHeader = "X-Metrics-Epoch"
+	metricsSeqHeader   = "X-Metrics-Seq"
+	metricsTimeHeader  = "X-Metrics-Time"
+)
+
+// spoolReport a metrics report wait to send, the file name is seq-unixtime.json.gz
+type spoolReport struct {
+	seq  uint64
+	time time.Time
+	path string
+	size int64
+}
+
+// metricsSpool keep the unsent metrics reports on disk, the oldest are dropped when it is full.
+// Every report has a monotonic sequence number in the epoch, a new epoch begin when the state is lost,
+// so server can dedupe the replayed reports
+type metricsSpool struct {
+	dir string
+
+	lock    sync.Mutex
+	epoch   string
+	lastSeq uint64
+}
+
+func newMetricsSpool(dir string) (*metricsSpool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &metricsSpool{dir: dir}
+	if b, err := os.ReadFile(filepath.Join(dir, spoolStateFile)); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) == 2 {
+			s.epoch = fields[0]
+			s.lastSeq, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+
+	if len(s.epoch) == 0 {
+		epoch := make([]byte, 8)
+		if _, err := rand.Read(epoch); err != nil {
+			return nil, err
+		}
+		s.epoch = hex.EncodeToString(epoch)
+		s.lastSeq = 0
+	}
+
+	// the state may be written before the last report
+	reports, err := s.reports()
+	if err != nil {
+		return nil, err
+	}
+	if n := len(reports); n > 0 && reports[n-1].seq > s.lastSeq {
+		s.lastSeq = reports[n-1].seq
+	}
+
+	return s, s.saveState()
+}
+
+func (s *metricsSpool) saveState() error {
+	return writeFileAtomic(filepath.Join(s.dir, spoolStateFile), []byte(fmt.Sprintf("%s %d", s.epoch, s.lastSeq)))
+}
+
+// enqueue compress the report and save it with next sequence number
+func (s *metricsSpool) enqueue(body []byte, t time.Time) (uint64, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq := s.lastSeq + 1
+	name := fmt.Sprintf("%020d-%d%s", seq, t.Unix(), spoolReportExt)
+	if err := writeFileAtomic(filepath.Join(s.dir, name), buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	s.lastSeq = seq
+	if err := s.saveState(); err != nil {
+		return 0, err
+	}
+
+	s.prune()
+	return seq, nil
+}
+
+// prune drop the oldest reports when the spool is full
+func (s *metricsSpool) prune() {
+	reports, err := s.reports()
+	if err != nil {
+		log.Errorf("metricsSpool.prune %v", err)
+		return
+	}
+
+	var total int64
+	for _, r := range reports {
+		total += r.size
+	}
+
+	dropped := 0
+	for len(reports)-dropped > maxSpoolReports || (total > maxSpoolBytes && len(reports)-dropped > 1) {
+		r := reports[dropped]
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("metricsSpool.prune %v", err)
+			return
+		}
+		total -= r.size
+		dropped++
+	}
+
+	if dropped > 0 {
+		log.Warnf("metricsSpool spool is full, drop %d oldest reports", dropped)
+	}
+}
+
+// reports return the unsent reports, oldest first
+func (s *metricsSpool) reports() ([]*spoolReport, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*spoolReport, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolReportExt) {
+			continue
+		}
+
+		seqStr, timeStr, ok := strings.Cut(strings.TrimSuffix(name, spoolReportExt), "-")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		unix, err := strconv.ParseInt(timeStr, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		r := &spoolReport{seq: seq, time: time.Unix(unix, 0), path: filepath.Join(s.dir, name)}
+		if info, err := entry.Info(); err == nil {
+			r.size = info.Size()
+		}
+		reports = append(reports, r)
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].seq < reports[j].seq })
+	return reports, nil
+}
+
+// remove delete the report after it is sent
+func (s *metricsSpool) remove(r *spoolReport) error {
+	if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic write to temp file and rename, so a crash never leave a partial file
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
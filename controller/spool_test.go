@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMetricsSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newMetricsSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := s.epoch
+
+	now := time.Now()
+	for i, body := range []string{`[{"appName":"a"}]`, `[{"appName":"b"}]`} {
+		seq, err := s.enqueue([]byte(body), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(i+1) {
+			t.Fatalf("expect seq %d, got %d", i+1, seq)
+		}
+	}
+
+	reports, err := s.reports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0].seq != 1 || reports[1].seq != 2 || reports[0].time.Unix() != now.Unix() {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+
+	b, err := os.ReadFile(reports[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(zr)
+	if string(body) != `[{"appName":"a"}]` {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	// the seq continue after restart, even the sent reports are removed
+	s.remove(reports[0])
+	s.remove(reports[1])
+	s, err = newMetricsSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.epoch != epoch {
+		t.Fatalf("epoch should be kept, %s != %s", s.epoch, epoch)
+	}
+	if seq, _ := s.enqueue([]byte(`[]`), now); seq != 3 {
+		t.Fatalf("expect seq 3 after restart, got %d", seq)
+	}
+
+	// a new epoch begin when the state is lost
+	os.Remove(dir + "/" + spoolStateFile)
+	s, err = newMetricsSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.epoch == epoch {
+		t.Fatalf("new epoch expected")
+	}
+	if s.lastSeq != 3 {
+		t.Fatalf("seq should not go back while reports left, got %d", s.lastSeq)
+	}
+}
+
+func TestMetricsSpoolPrune(t *testing.T) {
+	s, err := newMetricsSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxSpoolReports+5; i++ {
+		if _, err := s.enqueue([]byte(`[]`), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reports, err := s.reports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != maxSpoolReports {
+		t.Fatalf("expect %d reports, got %d", maxSpoolReports, len(reports))
+	}
+	if reports[0].seq != 6 {
+		t.Fatalf("the oldest reports should be dropped, first seq %d", reports[0].seq)
+	}
+}
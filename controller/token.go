@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// refresh the token when this ratio of its lifetime passed
+	tokenRefreshRatio = 0.8
+	// retry the refresh on failure, the token may still be valid
+	tokenRetryInterval = 30 * time.Second
+	// check again later if the token has no exp
+	tokenCheckInterval = time.Hour
+)
+
+// tokenManager keep the token of node, it is refreshed ahead of expiry,
+// or when server reject it. It is safe to use in any goroutine
+type tokenManager struct {
+	login func(ctx context.Context) (string, error)
+	// called after the token changed
+	onChange func(token string)
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+	// zero if the token has no exp
+	expiry time.Time
+
+	// only one login at a time
+	loginMu sync.Mutex
+}
+
+func newTokenManager(token string, login func(ctx context.Context) (string, error), onChange func(token string)) *tokenManager {
+	tm := &tokenManager{login: login, onChange: onChange}
+	tm.set(token)
+	return tm
+}
+
+func (tm *tokenManager) Token() string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	return tm.token
+}
+
+// Expiry return the expiry of token, zero if it never expire
+func (tm *tokenManager) Expiry() time.Time {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	return tm.expiry
+}
+
+func (tm *tokenManager) set(token string) {
+	issued, expiry, err := parseTokenTime(token)
+	if err != nil {
+		log.Warnf("tokenManager parse token: %s", err.Error())
+	}
+
+	tm.mu.Lock()
+	tm.token, tm.issued, tm.expiry = token, issued, expiry
+	tm.mu.Unlock()
+}
+
+// Refresh login again if the token is still the stale one, the token refreshed by others is returned otherwise
+func (tm *tokenManager) Refresh(ctx context.Context, stale string) (string, error) {
+	tm.loginMu.Lock()
+	defer tm.loginMu.Unlock()
+
+	if token := tm.Token(); token != stale {
+		return token, nil
+	}
+
+	token, err := tm.login(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	tm.set(token)
+	log.Infof("tokenManager token refreshed, expire at %s", tm.Expiry().Format(time.RFC3339))
+
+	if tm.onChange != nil {
+		tm.onChange(token)
+	}
+	return token, nil
+}
+
+// refreshIn return the time to wait before refresh
+func (tm *tokenManager) refreshIn() time.Duration {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.expiry.IsZero() {
+		return tokenCheckInterval
+	}
+
+	lifetime := tm.expiry.Sub(tm.issued)
+	return time.Until(tm.issued.Add(time.Duration(float64(lifetime) * tokenRefreshRatio)))
+}
+
+// Run refresh the token ahead of expiry until ctx done
+func (tm *tokenManager) Run(ctx context.Context) {
+	retry := false
+	for {
+		wait := tm.refreshIn()
+		if retry {
+			wait = tokenRetryInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		// refreshed on 401 meanwhile, or the token never expire
+		if !retry && tm.refreshIn() > 0 {
+			continue
+		}
+
+		_, err := tm.Refresh(ctx, tm.Token())
+		if err != nil {
+			log.Errorf("tokenManager refresh token failed: %s", err.Error())
+		}
+		retry = err != nil
+	}
+}
+
+// parseTokenTime read iat and exp of jwt without verify, the server verify it
+func parseTokenTime(token string) (time.Time, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Now(), time.Time{}, fmt.Errorf("invalid jwt")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Now(), time.Time{}, err
+	}
+
+	var claims struct {
+		IssuedAt       int64 `json:"iat"`
+		ExpirationTime int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return time.Now(), time.Time{}, err
+	}
+
+	issued := time.Now()
+	if claims.IssuedAt > 0 {
+		issued = time.Unix(claims.IssuedAt, 0)
+	}
+
+	var expiry time.Time
+	if claims.ExpirationTime > 0 {
+		expiry = time.Unix(claims.ExpirationTime, 0)
+	}
+	return issued, expiry, nil
+}
+
+// doWithToken send the request with token, login again and retry once if server reject the token.
+// newReq is called for every attempt because the body can not be reused
+func (c *Controller) doWithToken(client *http.Client, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		token := c.tokens.Token()
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		log.Warnf("Controller token rejected by %s, login again", req.URL.Path)
+		if _, err := c.tokens.Refresh(req.Context(), token); err != nil {
+			return nil, fmt.Errorf("login again: %w", err)
+		}
+	}
+}
+
+// onTokenChange propagate the new token to the apps
+func (c *Controller) onTokenChange(token string) {
+	c.baseInfo.SetToken(token)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+		defer cancel()
+
+		_, err := c.runInLoop(ctx, func() (interface{}, error) {
+			for _, app := range c.apps {
+				if app.app != nil {
+					app.app.baseInfo.SetToken(token)
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			log.Errorf("Controller.onTokenChange update apps failed: %s", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testToken(iat, exp int64) string {
+	payload := fmt.Sprintf(`{"iat":%d,"exp":%d,"NodeID":"n"}`, iat, exp)
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestParseTokenTime(t *testing.T) {
+	now := time.Now().Unix()
+	issued, expiry, err := parseTokenTime(testToken(now, now+100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Unix() != now || expiry.Unix() != now+100 {
+		t.Fatalf("unexpected iat %d exp %d", issued.Unix(), expiry.Unix())
+	}
+
+	// legacy token never expire
+	_, expiry, err = parseTokenTime(testToken(now, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.IsZero() {
+		t.Fatalf("expect no expiry, got %s", expiry)
+	}
+
+	if _, _, err := parseTokenTime("abc"); err == nil {
+		t.Fatal("expect error on invalid token")
+	}
+}
+
+func TestTokenManagerRefresh(t *testing.T) {
+	now := time.Now().Unix()
+	var logins atomic.Int32
+	login := func(ctx context.Context) (string, error) {
+		n := logins.Add(1)
+		return testToken(now, now+100+int64(n)), nil
+	}
+
+	var changed string
+	tm := newTokenManager(testToken(now-100, now), login, func(token string) { changed = token })
+
+	if in := tm.refreshIn(); in > 0 {
+		t.Fatalf("expect refresh now, got %s", in)
+	}
+
+	stale := tm.Token()
+	token, err := tm.Refresh(context.Background(), stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == stale || changed != token || tm.Token() != token {
+		t.Fatal("token not renewed")
+	}
+
+	// the stale token has been refreshed by others
+	if _, err := tm.Refresh(context.Background(), stale); err != nil {
+		t.Fatal(err)
+	}
+	if logins.Load() != 1 {
+		t.Fatalf("expect 1 login, got %d", logins.Load())
+	}
+
+	if in := tm.refreshIn(); in <= 0 || in > 100*time.Second {
+		t.Fatalf("unexpected refresh in %s", in)
+	}
+}
+
+func TestDoWithTokenRetry(t *testing.T) {
+	now := time.Now().Unix()
+	fresh := testToken(now, now+100)
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer "+fresh {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &Controller{}
+	c.tokens = newTokenManager(testToken(now-100, now-1), func(ctx context.Context) (string, error) {
+		return fresh, nil
+	}, nil)
+
+	resp, err := c.doWithToken(srv.Client(), func() (*http.Request, error) {
+		return http.NewRequest("GET", srv.URL, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || requests.Load() != 2 {
+		t.Fatalf("expect retry succeed, status %d requests %d", resp.StatusCode, requests.Load())
+	}
+}
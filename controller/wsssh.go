@@ -1,6 +1,7 @@
 package controller
 
 import (
+	ahttp "agent/common/http"
 	"context"
 	"fmt"
 	"io"
@@ -27,14 +28,15 @@ func (c *Controller) checkConnectable(ctx context.Context) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, httpTimeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return "", err
+	newReq := func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	client := &http.Client{
+		Transport: ahttp.DefaultDNSRountTripper,
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.doWithToken(client, newReq)
 	if err != nil {
 		return "", err
 	}
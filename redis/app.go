@@ -31,6 +31,21 @@ type NodeApp struct {
 	MD5              string    `redis:"md5"`
 	Metric           string    `redis:"metric"`
 	LastActivityTime time.Time `redis:"lastActivityTime"`
+	// resource usage of the processes started by app
+	CPUSeconds float64 `redis:"cpuSeconds"`
+	RSSBytes   uint64  `redis:"rssBytes"`
+	ReadBytes  uint64  `redis:"readBytes"`
+	WriteBytes uint64  `redis:"writeBytes"`
+	NetRxBytes uint64  `redis:"netRxBytes"`
+	NetTxBytes uint64  `redis:"netTxBytes"`
+	// lifecycle state of app on node
+	State       string `redis:"state"`
+	StateSince  int64  `redis:"stateSince"`
+	StateReason string `redis:"stateReason"`
+	// json of the recent transitions, [{"from":"pending","to":"downloading","time":1700000000}]
+	Transitions string `redis:"transitions"`
+	// json of the health check results, [{"name":"http-0","type":"http","healthy":true,"failures":0,"time":1700000000}]
+	Health string `redis:"health"`
 }
 
 func (redis *Redis) SetApp(ctx context.Context, app *App) error {
@@ -151,10 +166,13 @@ func (r *Redis) SetNodeApps(ctx context.Context, nodeID string, nodeApps []*Node
 	tn := time.Now()
 	for _, app := range nodeApps {
 		key := fmt.Sprintf(RedisKeyNodeApp, nodeID, app.AppName)
-		app.LastActivityTime = tn
+		// the replayed report keep the time it is collected
+		if app.LastActivityTime.IsZero() || app.LastActivityTime.After(tn) {
+			app.LastActivityTime = tn
+		}
 		pipe.HSet(ctx, key, app).Err()
 		pipe.ZAdd(ctx, RedisKeyZsNodeAppLastActiveTime, redis.Z{
-			Score:  float64(tn.Unix()),
+			Score:  float64(app.LastActivityTime.Unix()),
 			Member: fmt.Sprintf(RedisKeyZsNodeAppMember, app.AppName, nodeID),
 		}).Err()
 	}
@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	nodeAppLogsExpireTime        = 7 * 24 * time.Hour
+	nodeAppLogsRequestExpireTime = 24 * time.Hour
+)
+
+// NodeAppLogs the last lines of app log uploaded by node
+type NodeAppLogs struct {
+	Logs      string    `redis:"logs"`
+	UpdatedAt time.Time `redis:"updatedAt"`
+}
+
+// RequestNodeAppLogs ask node to upload the last lines of app log on next contact
+func (r *Redis) RequestNodeAppLogs(ctx context.Context, nodeid, appName string, lines int) error {
+	if len(nodeid) == 0 || len(appName) == 0 {
+		return fmt.Errorf("Redis.RequestNodeAppLogs: nodeid and app can not empty")
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeAppLogsRequest, nodeid)
+	if err := r.client.HSet(ctx, key, appName, lines).Err(); err != nil {
+		return err
+	}
+	return r.client.Expire(ctx, key, nodeAppLogsRequestExpireTime).Err()
+}
+
+// GetNodeAppLogsRequest return the pending requests, format: app1=200,app2=100
+func (r *Redis) GetNodeAppLogsRequest(ctx context.Context, nodeid string) (string, error) {
+	key := fmt.Sprintf(RedisKeyNodeAppLogsRequest, nodeid)
+	reqs, err := r.client.HGetAll(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	items := make([]string, 0, len(reqs))
+	for appName, lines := range reqs {
+		if _, err := strconv.Atoi(lines); err != nil {
+			continue
+		}
+		items = append(items, fmt.Sprintf("%s=%s", appName, lines))
+	}
+
+	return strings.Join(items, ","), nil
+}
+
+// SetNodeAppLogs save app logs and finish the request
+func (r *Redis) SetNodeAppLogs(ctx context.Context, nodeid, appName, logs string) error {
+	if len(nodeid) == 0 || len(appName) == 0 {
+		return fmt.Errorf("Redis.SetNodeAppLogs: nodeid and app can not empty")
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeAppLogs, nodeid, appName)
+
+	pipe := r.client.Pipeline()
+	pipe.HSet(ctx, key, &NodeAppLogs{Logs: logs, UpdatedAt: time.Now()})
+	pipe.Expire(ctx, key, nodeAppLogsExpireTime)
+	pipe.HDel(ctx, fmt.Sprintf(RedisKeyNodeAppLogsRequest, nodeid), appName)
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *Redis) GetNodeAppLogs(ctx context.Context, nodeid, appName string) (*NodeAppLogs, error) {
+	key := fmt.Sprintf(RedisKeyNodeAppLogs, nodeid, appName)
+	res := r.client.HGetAll(ctx, key)
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	if len(res.Val()) == 0 {
+		return nil, nil
+	}
+
+	var logs NodeAppLogs
+	if err := res.Scan(&logs); err != nil {
+		return nil, err
+	}
+
+	return &logs, nil
+}
@@ -0,0 +1,88 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// the bundle files are removed by server after it too
+	NodeDiagExpireTime        = 7 * 24 * time.Hour
+	nodeDiagRequestExpireTime = 24 * time.Hour
+)
+
+// NodeDiag the last diagnostics bundle uploaded by node, the zip is saved in file by server
+type NodeDiag struct {
+	File      string    `redis:"file" json:"file"`
+	Size      int64     `redis:"size" json:"size"`
+	Reason    string    `redis:"reason" json:"reason"`
+	UpdatedAt time.Time `redis:"updatedAt" json:"updatedAt"`
+}
+
+// RequestNodeDiag ask node to upload the diagnostics bundle on next contact
+func (r *Redis) RequestNodeDiag(ctx context.Context, nodeid string, logMB int) error {
+	if len(nodeid) == 0 {
+		return fmt.Errorf("Redis.RequestNodeDiag: nodeid can not empty")
+	}
+
+	return r.client.Set(ctx, fmt.Sprintf(RedisKeyNodeDiagRequest, nodeid), logMB, nodeDiagRequestExpireTime).Err()
+}
+
+// GetNodeDiagRequest return the log MB of pending request, 0 if no request
+func (r *Redis) GetNodeDiagRequest(ctx context.Context, nodeid string) (int, error) {
+	v, err := r.client.Get(ctx, fmt.Sprintf(RedisKeyNodeDiagRequest, nodeid)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	logMB, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	return logMB, nil
+}
+
+// SetNodeDiag save the bundle info and finish the request
+func (r *Redis) SetNodeDiag(ctx context.Context, nodeid string, diag *NodeDiag) error {
+	if len(nodeid) == 0 {
+		return fmt.Errorf("Redis.SetNodeDiag: nodeid can not empty")
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeDiag, nodeid)
+
+	pipe := r.client.Pipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, diag)
+	pipe.Expire(ctx, key, NodeDiagExpireTime)
+	pipe.Del(ctx, fmt.Sprintf(RedisKeyNodeDiagRequest, nodeid))
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetNodeDiag return the last bundle info of node, nil if node has no bundle
+func (r *Redis) GetNodeDiag(ctx context.Context, nodeid string) (*NodeDiag, error) {
+	key := fmt.Sprintf(RedisKeyNodeDiag, nodeid)
+
+	res := r.client.HMGet(ctx, key, "file", "size", "reason", "updatedAt")
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	if res.Val()[0] == nil {
+		return nil, nil
+	}
+
+	diag := &NodeDiag{}
+	if err := res.Scan(diag); err != nil {
+		return nil, err
+	}
+	return diag, nil
+}
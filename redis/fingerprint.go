@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"agent/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	NodeIdentityClone     = "clone"
+	NodeIdentityReinstall = "reinstall"
+
+	// the events of node more than this are dropped
+	maxNodeIdentityEvents = 50
+)
+
+// NodeIdentityEvent a suspected clone or reinstall found on node login
+type NodeIdentityEvent struct {
+	Type   string `json:"type"`
+	NodeID string `json:"nodeID"`
+	// the node that has the same hardware, for reinstall
+	RelatedNodeID string `json:"relatedNodeID,omitempty"`
+	// the fingerprint that reported by login
+	Fingerprint string `json:"fingerprint"`
+	Time        int64  `json:"time"`
+}
+
+// GetNodeFingerprint return nil if node has not reported fingerprint
+func (r *Redis) GetNodeFingerprint(ctx context.Context, nodeid string) (common.Fingerprint, error) {
+	s, err := r.client.Get(ctx, fmt.Sprintf(RedisKeyNodeFingerprint, nodeid)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return common.ParseFingerprint(s)
+}
+
+// GetNodeFingerprints return the fingerprints of nodes, the node has not reported is omitted
+func (r *Redis) GetNodeFingerprints(ctx context.Context, nodeids []string) (map[string]common.Fingerprint, error) {
+	if len(nodeids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(nodeids))
+	for _, nodeid := range nodeids {
+		keys = append(keys, fmt.Sprintf(RedisKeyNodeFingerprint, nodeid))
+	}
+
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	fps := make(map[string]common.Fingerprint, len(nodeids))
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		fp, err := common.ParseFingerprint(s)
+		if err != nil {
+			return nil, err
+		}
+		fps[nodeids[i]] = fp
+	}
+	return fps, nil
+}
+
+// SetNodeFingerprint save the fingerprint of node and index its components, the changed components of old are removed from index
+func (r *Redis) SetNodeFingerprint(ctx context.Context, nodeid string, fp, old common.Fingerprint) error {
+	if len(nodeid) == 0 {
+		return fmt.Errorf("Redis.SetNodeFingerprint: nodeid can not empty")
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf(RedisKeyNodeFingerprint, nodeid), fp.String(), 0)
+	for component, hash := range old {
+		if fp[component] != hash {
+			pipe.SRem(ctx, fmt.Sprintf(RedisKeyFingerprintNodes, component, hash), nodeid)
+		}
+	}
+	for component, hash := range fp {
+		if len(hash) == 0 {
+			continue
+		}
+		if common.FingerprintIndexed(component) {
+			pipe.SAdd(ctx, fmt.Sprintf(RedisKeyFingerprintNodes, component, hash), nodeid)
+		} else {
+			// indexed by the old version
+			pipe.SRem(ctx, fmt.Sprintf(RedisKeyFingerprintNodes, component, hash), nodeid)
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetFingerprintNodes return the nodes that have any same indexed component with fp
+func (r *Redis) GetFingerprintNodes(ctx context.Context, fp common.Fingerprint) ([]string, error) {
+	keys := make([]string, 0, len(fp))
+	for component, hash := range fp {
+		if len(hash) > 0 && common.FingerprintIndexed(component) {
+			keys = append(keys, fmt.Sprintf(RedisKeyFingerprintNodes, component, hash))
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return r.client.SUnion(ctx, keys...).Result()
+}
+
+// AddNodeIdentityEvent save the event, skip if it is the same as the last one
+func (r *Redis) AddNodeIdentityEvent(ctx context.Context, event *NodeIdentityEvent) error {
+	key := fmt.Sprintf(RedisKeyNodeIdentityEvents, event.NodeID)
+
+	events, err := r.GetNodeIdentityEvents(ctx, event.NodeID, 1)
+	if err != nil {
+		return err
+	}
+	if len(events) > 0 && events[0].Type == event.Type && events[0].RelatedNodeID == event.RelatedNodeID && events[0].Fingerprint == event.Fingerprint {
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, maxNodeIdentityEvents-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetNodeIdentityEvents return the latest events of node, newest first
+func (r *Redis) GetNodeIdentityEvents(ctx context.Context, nodeid string, limit int) ([]*NodeIdentityEvent, error) {
+	items, err := r.client.LRange(ctx, fmt.Sprintf(RedisKeyNodeIdentityEvents, nodeid), 0, int64(limit-1)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	events := make([]*NodeIdentityEvent, 0, len(items))
+	for _, item := range items {
+		var event NodeIdentityEvent
+		if err := json.Unmarshal([]byte(item), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
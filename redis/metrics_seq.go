@@ -0,0 +1,73 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// the seq is forgotten if node not push metrics for this time, the spool of node can not keep so long
+const nodeMetricsSeqExpireTime = 7 * 24 * time.Hour
+
+// update the seq if it is newer, return {1, previous epoch, previous seq} if updated
+const checkMetricsSeqScript = `
+local cur = redis.call('HMGET', KEYS[1], 'epoch', 'seq')
+if cur[1] == ARGV[1] and tonumber(cur[2]) ~= nil and tonumber(cur[2]) >= tonumber(ARGV[2]) then
+	return {0}
+end
+redis.call('HSET', KEYS[1], 'epoch', ARGV[1], 'seq', ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return {1, cur[1] or '', cur[2] or ''}
+`
+
+// restore the previous seq if the seq is still the one recorded by the failed report
+const revertMetricsSeqScript = `
+local cur = redis.call('HMGET', KEYS[1], 'epoch', 'seq')
+if cur[1] ~= ARGV[1] or cur[2] ~= ARGV[2] then
+	return 0
+end
+if ARGV[3] == '' then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('HSET', KEYS[1], 'epoch', ARGV[3], 'seq', ARGV[4])
+end
+return 1
+`
+
+// NodeMetricsSeq the epoch and seq of the latest metrics report of node
+type NodeMetricsSeq struct {
+	Epoch string
+	Seq   string
+}
+
+// CheckNodeMetricsSeq record the seq of metrics report, return false if the report has been received.
+// A new epoch of node restart the seq. The previous seq is returned for RevertNodeMetricsSeq
+func (r *Redis) CheckNodeMetricsSeq(ctx context.Context, nodeid, epoch string, seq uint64) (bool, *NodeMetricsSeq, error) {
+	if len(nodeid) == 0 || len(epoch) == 0 {
+		return false, nil, fmt.Errorf("Redis.CheckNodeMetricsSeq: nodeid and epoch can not empty")
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeMetricsSeq, nodeid)
+	res, err := r.client.Eval(ctx, checkMetricsSeqScript, []string{key}, epoch, seq, int64(nodeMetricsSeqExpireTime.Seconds())).Slice()
+	if err != nil {
+		return false, nil, err
+	}
+	if len(res) != 3 {
+		return false, nil, nil
+	}
+
+	prevEpoch, _ := res[1].(string)
+	prevSeq, _ := res[2].(string)
+	return true, &NodeMetricsSeq{Epoch: prevEpoch, Seq: prevSeq}, nil
+}
+
+// RevertNodeMetricsSeq forget the seq recorded by a report that failed to process,
+// so the node can retry it. It does nothing if a newer report has been recorded
+func (r *Redis) RevertNodeMetricsSeq(ctx context.Context, nodeid, epoch string, seq uint64, prev *NodeMetricsSeq) error {
+	if prev == nil {
+		prev = &NodeMetricsSeq{}
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeMetricsSeq, nodeid)
+	return r.client.Eval(ctx, revertMetricsSeqScript, []string{key}, epoch, seq, prev.Epoch, prev.Seq).Err()
+}
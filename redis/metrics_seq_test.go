@@ -0,0 +1,70 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestNodeMetricsSeqRetry(t *testing.T) {
+	r := NewRedis(redisAddr, "")
+	ctx := context.Background()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+
+	nodeid := uuid.NewString()
+	check := func(seq uint64) (bool, *NodeMetricsSeq) {
+		isNew, prev, err := r.CheckNodeMetricsSeq(ctx, nodeid, "e1", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return isNew, prev
+	}
+
+	if isNew, _ := check(1); !isNew {
+		t.Fatal("expect first report is new")
+	}
+
+	// the report failed with 503, the retry is not a duplicate
+	isNew, prev := check(2)
+	if !isNew || prev.Epoch != "e1" || prev.Seq != "1" {
+		t.Fatalf("expect new report with previous seq 1, got %v %+v", isNew, prev)
+	}
+	if err := r.RevertNodeMetricsSeq(ctx, nodeid, "e1", 2, prev); err != nil {
+		t.Fatal(err)
+	}
+	if isNew, _ := check(2); !isNew {
+		t.Fatal("expect the retry after revert is new")
+	}
+	if isNew, _ := check(2); isNew {
+		t.Fatal("expect the processed report is duplicate")
+	}
+
+	// a newer report has been recorded, the revert of older one is ignored
+	isNew, prev = check(3)
+	if !isNew {
+		t.Fatal("expect report 3 is new")
+	}
+	check(4)
+	if err := r.RevertNodeMetricsSeq(ctx, nodeid, "e1", 3, prev); err != nil {
+		t.Fatal(err)
+	}
+	if isNew, _ := check(4); isNew {
+		t.Fatal("expect report 4 is kept")
+	}
+
+	// the first report of node failed, the seq is removed
+	nodeid = uuid.NewString()
+	isNew, prev = check(1)
+	if !isNew || prev.Epoch != "" {
+		t.Fatalf("expect no previous seq, got %+v", prev)
+	}
+	if err := r.RevertNodeMetricsSeq(ctx, nodeid, "e1", 1, prev); err != nil {
+		t.Fatal(err)
+	}
+	if isNew, _ := check(1); !isNew {
+		t.Fatal("expect the retry of first report is new")
+	}
+}
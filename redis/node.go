@@ -41,12 +41,16 @@ type Node struct {
 
 	NetIRate float64 `redis:"netIRate"`
 	NetORate float64 `redis:"netORate"`
+	// json of the per interface rates, [{"name":"eth0","irate":1.0,"orate":1.0}]
+	NetInterfaces string `redis:"netInterfaces"`
 
 	Baseboard string `redis:"baseboard"`
 
 	TotalDisk int64  `redis:"totalDisk"`
 	FreeDisk  int64  `redis:"freeDisk"`
 	DiskModel string `redis:"diskModel"`
+	// json of the mounts, [{"mountpoint":"/","device":"/dev/sda1","fstype":"ext4","total":1,"free":1,"apps":true}]
+	Disks string `redis:"disks"`
 
 	LastActivityTime time.Time `redis:"lastActivityTime"`
 
@@ -66,6 +70,9 @@ type Node struct {
 	CGroupOut   string `redis:"cgroupOut"`
 	Iptables    int    `redis:"iptables"` // 0 unchecked, 1 installed, 2 not installed
 	IptablesOut string `redis:"iptablesOut"`
+
+	// last time how long the node can not reach server
+	LastOfflineSeconds int64 `redis:"lastOfflineSeconds"`
 }
 
 // currently android app is acting like this
@@ -354,6 +361,11 @@ func (r *Redis) GetNodeList(ctx context.Context, lastActiveTime time.Time, nodei
 }
 
 func (r *Redis) IncrNodeOnlineDuration(ctx context.Context, nodeid string, seconds int) error {
+	return r.IncrNodeOnlineDurationAt(ctx, nodeid, seconds, time.Now())
+}
+
+// IncrNodeOnlineDurationAt credit the online seconds to the day of at, the replayed reports are credited to the day they are collected
+func (r *Redis) IncrNodeOnlineDurationAt(ctx context.Context, nodeid string, seconds int, at time.Time) error {
 	if len(nodeid) == 0 {
 		return fmt.Errorf("Redis.IncrNodeOnlineDuration: nodeID can not empty")
 	}
@@ -366,8 +378,8 @@ func (r *Redis) IncrNodeOnlineDuration(ctx context.Context, nodeid string, secon
 	}
 
 	statMapKey := fmt.Sprintf(RedisKeyNodeOnlineDurationStatMap, nodeid)
-	today := time.Now().Format("20060102")
-	return r.client.HIncrBy(ctx, statMapKey, today, int64(seconds)).Err()
+	day := at.Format("20060102")
+	return r.client.HIncrBy(ctx, statMapKey, day, int64(seconds)).Err()
 }
 
 func (r *Redis) GetNodeOnlineDuration(ctx context.Context, nodeid string) (int64, error) {
@@ -0,0 +1,78 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// the gap is forgotten after it, the same as the seq of metrics
+const nodeOnlineGapExpireTime = nodeMetricsSeqExpireTime
+
+// set the gap [from, to] that node was not seen, the cursor is the time that credit is
+// accounted to, it never goes back. Return the seconds from cursor to the end of gap if
+// the replayed reports have filled the gap before it
+const setOnlineGapScript = `
+local from = tonumber(ARGV[1])
+local to = tonumber(ARGV[2])
+local cursor = tonumber(redis.call('HGET', KEYS[1], 'cursor')) or 0
+local tail = 0
+if cursor > from and cursor < to and to - cursor <= tonumber(ARGV[3]) then
+	tail = to - cursor
+end
+if cursor < from then
+	cursor = from
+end
+redis.call('HSET', KEYS[1], 'to', to, 'cursor', cursor)
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return tail
+`
+
+// move the cursor to the replayed report in the gap, the gap is open if node has not been
+// seen since the last activity. Return the seconds to credit
+const fillOnlineGapScript = `
+local at = tonumber(ARGV[1])
+local last = tonumber(ARGV[2])
+local cur = redis.call('HMGET', KEYS[1], 'to', 'cursor')
+local to = tonumber(cur[1])
+local cursor = tonumber(cur[2]) or 0
+local base
+if to ~= nil and at < to then
+	base = cursor
+elseif at > last then
+	base = math.max(cursor, last)
+else
+	return 0
+end
+if at <= base then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'cursor', at)
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+if at - base > tonumber(ARGV[3]) then
+	return 0
+end
+return at - base
+`
+
+// SetNodeOnlineGap record that node was not seen from 'from' to 'to', the replayed metrics reports
+// of node fill it later. Return the seconds at the end of gap to credit
+func (r *Redis) SetNodeOnlineGap(ctx context.Context, nodeid string, from, to time.Time, maxInterval time.Duration) (int, error) {
+	if len(nodeid) == 0 {
+		return 0, fmt.Errorf("Redis.SetNodeOnlineGap: nodeid can not empty")
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeOnlineGap, nodeid)
+	return r.client.Eval(ctx, setOnlineGapScript, []string{key}, from.Unix(), to.Unix(), int64(maxInterval.Seconds()), int64(nodeOnlineGapExpireTime.Seconds())).Int()
+}
+
+// FillNodeOnlineGap account the replayed metrics report at 'at', lastActivity is the last time node was seen.
+// Return the seconds to credit, the interval longer than maxInterval is not credited
+func (r *Redis) FillNodeOnlineGap(ctx context.Context, nodeid string, at, lastActivity time.Time, maxInterval time.Duration) (int, error) {
+	if len(nodeid) == 0 {
+		return 0, fmt.Errorf("Redis.FillNodeOnlineGap: nodeid can not empty")
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeOnlineGap, nodeid)
+	return r.client.Eval(ctx, fillOnlineGapScript, []string{key}, at.Unix(), lastActivity.Unix(), int64(maxInterval.Seconds()), int64(nodeOnlineGapExpireTime.Seconds())).Int()
+}
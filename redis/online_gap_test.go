@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNodeOnlineGap(t *testing.T) {
+	r := NewRedis(redisAddr, "")
+	ctx := context.Background()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+
+	const max = 30 * time.Minute
+	now := time.Now().Truncate(time.Second)
+	lastSeen := now.Add(-2 * time.Hour)
+
+	// replayed before node is seen again, the gap is open since last seen
+	nodeid := uuid.NewString()
+	credited := 0
+	for at := lastSeen.Add(2 * time.Minute); at.Before(now.Add(-10 * time.Minute)); at = at.Add(2 * time.Minute) {
+		seconds, err := r.FillNodeOnlineGap(ctx, nodeid, at, lastSeen, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		credited += seconds
+	}
+
+	// replayed again is not credited
+	if seconds, _ := r.FillNodeOnlineGap(ctx, nodeid, lastSeen.Add(4*time.Minute), lastSeen, max); seconds != 0 {
+		t.Fatalf("expect no credit for duplicate, got %d", seconds)
+	}
+
+	tail, err := r.SetNodeOnlineGap(ctx, nodeid, lastSeen, now, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := credited + tail; total != int(now.Sub(lastSeen).Seconds()) {
+		t.Fatalf("expect the gap credited once, got %d", total)
+	}
+
+	// node seen again first, then the reports are replayed
+	nodeid = uuid.NewString()
+	if tail, _ := r.SetNodeOnlineGap(ctx, nodeid, lastSeen, now, max); tail != 0 {
+		t.Fatalf("expect no tail before replay, got %d", tail)
+	}
+	credited = 0
+	for at := lastSeen.Add(2 * time.Minute); at.Before(now); at = at.Add(2 * time.Minute) {
+		seconds, err := r.FillNodeOnlineGap(ctx, nodeid, at, now, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		credited += seconds
+	}
+	if credited != int(now.Sub(lastSeen).Seconds())-120 {
+		t.Fatalf("expect the gap credited to the last replay, got %d", credited)
+	}
+}
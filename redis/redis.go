@@ -57,6 +57,24 @@ const (
 	RedisKeyRdsSuperEval   = "titan:agent:redis:super:eval"
 	RedisKeyAppConfig      = "titan:app:config:%s"
 	RedisKeyAgentBlackList = "titan:agent:blacklist"
+
+	RedisKeyNodeAppLogsRequest = "titan:agent:applogs:request:%s" // nodeid[app1:lines, app2:lines]
+	RedisKeyNodeAppLogs        = "titan:agent:applogs:%s:%s"      // nodeid, app
+
+	RedisKeyNodeFingerprint    = "titan:agent:fingerprint:node:%s"     // nodeid
+	RedisKeyFingerprintNodes   = "titan:agent:fingerprint:nodes:%s:%s" // component, hash[nodeid1, nodeid2, ...]
+	RedisKeyNodeIdentityEvents = "titan:agent:identity:events:%s"      // nodeid
+
+	RedisKeyNodeRollouts = "titan:agent:rollouts:%s" // nodeid
+
+	RedisKeyNodeMetricsSeq = "titan:agent:metrics:seq:%s" // nodeid[epoch, seq]
+	RedisKeyNodeOnlineGap  = "titan:agent:onlinegap:%s"   // nodeid[to, cursor]
+
+	RedisKeyAppSuspensions     = "titan:agent:suspensions"         // app[suspension]
+	RedisKeyAppSuspensionNodes = "titan:agent:suspension:nodes:%s" // app, nodeid[compliance]
+
+	RedisKeyNodeDiag        = "titan:agent:diag:%s"         // nodeid
+	RedisKeyNodeDiagRequest = "titan:agent:diag:request:%s" // nodeid
 )
 
 func (r *Redis) Ping(ctx context.Context) error {
@@ -0,0 +1,61 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// the rollouts more than this are dropped
+const maxNodeRollouts = 100
+
+// NodeRollout the outcome of app config change on node
+type NodeRollout struct {
+	AppName string `json:"appName"`
+	FromMD5 string `json:"fromMD5"`
+	ToMD5   string `json:"toMD5"`
+	// committed or reverted
+	Result   string `json:"result"`
+	Reason   string `json:"reason,omitempty"`
+	Duration int64  `json:"duration"`
+	Time     int64  `json:"time"`
+}
+
+// AddNodeRollout save the rollout of node, the oldest are dropped
+func (r *Redis) AddNodeRollout(ctx context.Context, nodeid string, rollout *NodeRollout) error {
+	if len(nodeid) == 0 {
+		return fmt.Errorf("Redis.AddNodeRollout: nodeid can not empty")
+	}
+
+	data, err := json.Marshal(rollout)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf(RedisKeyNodeRollouts, nodeid)
+	pipe := r.client.Pipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, maxNodeRollouts-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetNodeRollouts return the latest rollouts of node, newest first
+func (r *Redis) GetNodeRollouts(ctx context.Context, nodeid string, limit int) ([]*NodeRollout, error) {
+	items, err := r.client.LRange(ctx, fmt.Sprintf(RedisKeyNodeRollouts, nodeid), 0, int64(limit-1)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	rollouts := make([]*NodeRollout, 0, len(items))
+	for _, item := range items {
+		var rollout NodeRollout
+		if err := json.Unmarshal([]byte(item), &rollout); err != nil {
+			return nil, err
+		}
+		rollouts = append(rollouts, &rollout)
+	}
+	return rollouts, nil
+}
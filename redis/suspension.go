@@ -0,0 +1,161 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// the compliance states of node on suspended app
+const (
+	// the app config without the suspended app has been sent to node
+	SuspensionNotified = "notified"
+	// node still report the app after notified
+	SuspensionRunning = "running"
+	// node stopped the app
+	SuspensionStopped = "stopped"
+)
+
+// AppSuspension the app is excluded from the app configs of the nodes in scope,
+// the empty scope match all nodes
+type AppSuspension struct {
+	AppName string `json:"appName"`
+	Channel string `json:"channel,omitempty"`
+	// country of node ip
+	Region string `json:"region,omitempty"`
+	// controller version
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Time    int64  `json:"time"`
+}
+
+// Match check if the node is in scope, region is only used when the suspension has region.
+// The node with unknown region is in scope of any region, so the suspension fail closed
+func (s *AppSuspension) Match(channel, version string, region func() string) bool {
+	if s.Channel != "" && s.Channel != channel {
+		return false
+	}
+	if s.Version != "" && s.Version != version {
+		return false
+	}
+	if s.Region != "" {
+		if r := region(); r != "" && r != s.Region {
+			return false
+		}
+	}
+	return true
+}
+
+// SuspensionCompliance the state of node on suspended app
+type SuspensionCompliance struct {
+	NodeID string `json:"nodeID"`
+	State  string `json:"state"`
+	Time   int64  `json:"time"`
+}
+
+// SetAppSuspension suspend the app, the previous scope of app is replaced
+func (r *Redis) SetAppSuspension(ctx context.Context, suspension *AppSuspension) error {
+	if len(suspension.AppName) == 0 {
+		return fmt.Errorf("Redis.SetAppSuspension: app name can not empty")
+	}
+
+	data, err := json.Marshal(suspension)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(ctx, RedisKeyAppSuspensions, suspension.AppName, data).Err()
+}
+
+// DeleteAppSuspension resume the app, the compliance of nodes is dropped
+func (r *Redis) DeleteAppSuspension(ctx context.Context, appName string) error {
+	pipe := r.client.Pipeline()
+	pipe.HDel(ctx, RedisKeyAppSuspensions, appName)
+	pipe.Del(ctx, fmt.Sprintf(RedisKeyAppSuspensionNodes, appName))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetAppSuspension return the suspension of app, nil if the app is not suspended
+func (r *Redis) GetAppSuspension(ctx context.Context, appName string) (*AppSuspension, error) {
+	item, err := r.client.HGet(ctx, RedisKeyAppSuspensions, appName).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var suspension AppSuspension
+	if err := json.Unmarshal([]byte(item), &suspension); err != nil {
+		return nil, err
+	}
+	return &suspension, nil
+}
+
+// GetAppSuspensions return the suspended apps
+func (r *Redis) GetAppSuspensions(ctx context.Context) ([]*AppSuspension, error) {
+	items, err := r.client.HGetAll(ctx, RedisKeyAppSuspensions).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	suspensions := make([]*AppSuspension, 0, len(items))
+	for _, item := range items {
+		var suspension AppSuspension
+		if err := json.Unmarshal([]byte(item), &suspension); err != nil {
+			return nil, err
+		}
+		suspensions = append(suspensions, &suspension)
+	}
+	return suspensions, nil
+}
+
+// SetSuspensionCompliance save the state of node on suspended app
+func (r *Redis) SetSuspensionCompliance(ctx context.Context, appName string, compliance *SuspensionCompliance) error {
+	if len(compliance.NodeID) == 0 {
+		return fmt.Errorf("Redis.SetSuspensionCompliance: nodeid can not empty")
+	}
+
+	data, err := json.Marshal(compliance)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(ctx, fmt.Sprintf(RedisKeyAppSuspensionNodes, appName), compliance.NodeID, data).Err()
+}
+
+// GetSuspensionCompliance return the state of node on suspended app, nil if node has not been notified
+func (r *Redis) GetSuspensionCompliance(ctx context.Context, appName, nodeid string) (*SuspensionCompliance, error) {
+	item, err := r.client.HGet(ctx, fmt.Sprintf(RedisKeyAppSuspensionNodes, appName), nodeid).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var compliance SuspensionCompliance
+	if err := json.Unmarshal([]byte(item), &compliance); err != nil {
+		return nil, err
+	}
+	return &compliance, nil
+}
+
+// GetSuspensionCompliances return the states of all nodes notified on suspended app
+func (r *Redis) GetSuspensionCompliances(ctx context.Context, appName string) ([]*SuspensionCompliance, error) {
+	items, err := r.client.HGetAll(ctx, fmt.Sprintf(RedisKeyAppSuspensionNodes, appName)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	compliances := make([]*SuspensionCompliance, 0, len(items))
+	for _, item := range items {
+		var compliance SuspensionCompliance
+		if err := json.Unmarshal([]byte(item), &compliance); err != nil {
+			return nil, err
+		}
+		compliances = append(compliances, &compliance)
+	}
+	return compliances, nil
+}
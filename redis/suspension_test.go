@@ -0,0 +1,40 @@
+package redis
+
+import "testing"
+
+func TestAppSuspensionMatch(t *testing.T) {
+	lookups := 0
+	region := func() string {
+		lookups++
+		return "CN"
+	}
+
+	all := &AppSuspension{AppName: "a"}
+	if !all.Match("c1", "0.1.1", region) {
+		t.Fatal("empty scope should match all nodes")
+	}
+	if lookups != 0 {
+		t.Fatal("region should not be looked up without region scope")
+	}
+
+	scoped := &AppSuspension{AppName: "a", Channel: "c1", Region: "CN", Version: "0.1.1"}
+	if !scoped.Match("c1", "0.1.1", region) {
+		t.Fatal("expect match in scope")
+	}
+	if scoped.Match("c2", "0.1.1", region) || scoped.Match("c1", "0.1.0", region) {
+		t.Fatal("expect not match out of scope")
+	}
+
+	other := &AppSuspension{AppName: "a", Region: "US"}
+	if other.Match("c1", "0.1.1", region) {
+		t.Fatal("expect not match other region")
+	}
+
+	unknown := func() string { return "" }
+	if !other.Match("c1", "0.1.1", unknown) {
+		t.Fatal("expect unknown region match region scope")
+	}
+	if scoped.Match("c2", "0.1.1", unknown) {
+		t.Fatal("expect unknown region not match other channel")
+	}
+}
@@ -10,4 +10,42 @@ type App struct {
 	Version    string `json:"version"`
 	Metric     string `json:"metric"`
 	Tag        string `json:"tag"`
+	// resource usage of the processes started by app
+	Usage *AppUsage `json:"usage,omitempty"`
+
+	// lifecycle state, pending/downloading/starting/running/degraded/stopping/stopped/failed
+	State       string           `json:"state"`
+	StateSince  int64            `json:"stateSince"`
+	StateReason string           `json:"stateReason"`
+	Transitions []*AppTransition `json:"transitions,omitempty"`
+	// the results of health checks run by controller
+	Health []*AppHealth `json:"health,omitempty"`
+}
+
+// AppHealth the latest result of a health check on node
+type AppHealth struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Healthy  bool   `json:"healthy"`
+	Failures int    `json:"failures"`
+	Error    string `json:"error,omitempty"`
+	Time     int64  `json:"time"`
+	Latency  int64  `json:"latency"`
+}
+
+// AppTransition a lifecycle state change of app
+type AppTransition struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Time   int64  `json:"time"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type AppUsage struct {
+	CPUSeconds float64 `json:"cpuSeconds"`
+	RSSBytes   uint64  `json:"rssBytes"`
+	ReadBytes  uint64  `json:"readBytes"`
+	WriteBytes uint64  `json:"writeBytes"`
+	NetRxBytes uint64  `json:"netRxBytes"`
+	NetTxBytes uint64  `json:"netTxBytes"`
 }
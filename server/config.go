@@ -19,6 +19,7 @@ type Config struct {
 
 	LuaFileList        []*FileConfig        `json:"luaFileList" yaml:"luaFileList"`
 	ControllerFileList []*FileConfig        `json:"controllerFileList" yaml:"controllerFileList"`
+	AgentFileList      []*FileConfig        `json:"agentFileList" yaml:"agentFileList"`
 	AppList            []*AppConfig         `json:"appList" yaml:"appList"`
 	NodeSpecifiedApps  map[string][]string  `json:"nodeSpecifiedApps" yaml:"nodeSpecifiedApps"`
 	Resources          map[string]*Resource `json:"resources" yaml:"resources"`
@@ -31,6 +32,19 @@ type Config struct {
 	PrivateKey string `json:"privateKey" yaml:"privateKey"`
 
 	WebServer string `json:"webServer" yaml:"webServer"`
+
+	// seconds that node token is valid, default 24 hours
+	TokenLifetime int `json:"tokenLifetime" yaml:"tokenLifetime"`
+	// seconds that token is valid for the old controllers which do not login again on 401, default 365 days
+	LegacyTokenLifetime int `json:"legacyTokenLifetime" yaml:"legacyTokenLifetime"`
+	// the tokens without exp are signed before token lifetime, the old controllers keep using them.
+	// They are accepted by default, set it to false once all nodes run the controller that login again
+	AcceptTokenWithoutExp *bool `json:"acceptTokenWithoutExp" yaml:"acceptTokenWithoutExp"`
+	// RFC3339 time after which the tokens without exp are rejected, e.g. 2026-06-01T00:00:00Z
+	TokenWithoutExpCutoff string `json:"tokenWithoutExpCutoff" yaml:"tokenWithoutExpCutoff"`
+
+	// the dir to save the diagnostics bundles of nodes, default "diag" in working dir
+	DiagDir string `json:"diagDir" yaml:"diagDir"`
 }
 
 type FileConfig struct {
@@ -40,6 +54,8 @@ type FileConfig struct {
 	URL     string `json:"url" yaml:"url"`
 	OS      string `json:"os" yaml:"os"`
 	Tag     string `json:"tag" yaml:"tag"`
+	// allow the agent update to lower version
+	Force bool `json:"force,omitempty" yaml:"force"`
 }
 
 type AppConfig struct {
@@ -54,6 +70,30 @@ type AppConfig struct {
 	ReqLocationsExclude []string `json:"reqLocationsExclude" yaml:"reqLocationsExclude"`
 	Tag                 string   `json:"tag" yaml:"tag"`
 	AutoLoad            bool     `json:"autoLoad" yaml:"autoLoad"`
+	// seconds for the new version to be ready on node before revert, use the node default if 0
+	CanaryTimeout int `json:"canaryTimeout,omitempty" yaml:"canaryTimeout"`
+	// the apps must meet the condition on node before this app start
+	DependsOn []AppDependency `json:"dependsOn,omitempty" yaml:"dependsOn"`
+	// the probes run by node independently of the script
+	HealthChecks []AppHealthCheck `json:"healthChecks,omitempty" yaml:"healthChecks"`
+}
+
+// AppHealthCheck the type is process, tcp, http or command, the target is process name, host:port, url or command line
+type AppHealthCheck struct {
+	Name             string `json:"name,omitempty" yaml:"name"`
+	Type             string `json:"type" yaml:"type"`
+	Target           string `json:"target,omitempty" yaml:"target"`
+	ExpectStatus     int    `json:"expectStatus,omitempty" yaml:"expectStatus"`
+	ExpectBody       string `json:"expectBody,omitempty" yaml:"expectBody"`
+	Interval         int    `json:"interval,omitempty" yaml:"interval"`
+	Timeout          int    `json:"timeout,omitempty" yaml:"timeout"`
+	FailureThreshold int    `json:"failureThreshold,omitempty" yaml:"failureThreshold"`
+}
+
+// AppDependency the condition is started, running or ready, default running
+type AppDependency struct {
+	AppName   string `json:"appName" yaml:"appName"`
+	Condition string `json:"condition,omitempty" yaml:"condition"`
 }
 
 type Resource struct {
@@ -63,6 +103,8 @@ type Resource struct {
 	MinCPU      int    `json:"minCPU" yaml:"minCPU"`
 	MinMemoryMB int64  `json:"minMemoryMB" yaml:"minMemoryMB"`
 	MinDiskGB   int64  `json:"minDiskGB" yaml:"minDiskGB"`
+	// the free space of the mount that apps dir is on, the node without mounts report is not matched
+	MinAppDiskFreeGB int64 `json:"minAppDiskFreeGB" yaml:"minAppDiskFreeGB"`
 }
 
 type TestApp struct {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"net/url"
 	"strconv"
 	"time"
@@ -33,9 +34,13 @@ type Device struct {
 	TotalDisk int64  `json:"totalDisk"`
 	FreeDisk  int64  `json:"freeDisk"`
 	DiskModel string `json:"diskModel"`
+	// json of the mounts
+	Disks string `json:"disks"`
 
 	NetIRate float64 `json:"netIRate"`
 	NetORate float64 `json:"netORate"`
+	// json of the per interface rates
+	NetInterfaces string `json:"netInterfaces"`
 
 	Baseboard string `json:"baseboard"`
 
@@ -52,6 +57,9 @@ type Device struct {
 	Channel    string `json:"channel"`
 
 	Version string `json:"version"`
+
+	// how long the node can not reach server before this request, 0 if always online
+	LastOfflineSeconds int64 `json:"lastOfflineSeconds"`
 }
 
 func NewDeviceFromURLQuery(values url.Values) *Device {
@@ -82,18 +90,48 @@ func NewDeviceFromURLQuery(values url.Values) *Device {
 	d.TotalDisk = stringToInt64(values.Get("totalDisk"))
 	d.FreeDisk = stringToInt64(values.Get("freeDisk"))
 	d.DiskModel = values.Get("diskModel")
+	d.Disks = values.Get("disks")
 
 	d.NetIRate = stringToFloat64(values.Get("netIRate"))
 	d.NetORate = stringToFloat64(values.Get("netORate"))
+	d.NetInterfaces = values.Get("netInterfaces")
 	d.Baseboard = values.Get("baseboard")
 
 	d.WorkingDir = values.Get("workingDir")
 	d.Channel = values.Get("channel")
 	d.Version = values.Get("version")
+	d.LastOfflineSeconds = stringToInt64(values.Get("offlineSeconds"))
 
 	return d
 }
 
+// DiskMount the mount reported by node, see agent.DiskMount
+type DiskMount struct {
+	Mountpoint string `json:"mountpoint"`
+	Total      int64  `json:"total"`
+	Free       int64  `json:"free"`
+	Apps       bool   `json:"apps"`
+}
+
+// appDiskFreeGB return the free space of the mount that apps dir is on, 0 if not reported
+func appDiskFreeGB(disks string) int64 {
+	if len(disks) == 0 {
+		return 0
+	}
+
+	var mounts []DiskMount
+	if err := json.Unmarshal([]byte(disks), &mounts); err != nil {
+		return 0
+	}
+
+	for _, m := range mounts {
+		if m.Apps {
+			return m.Free / (1024 * 1024 * 1024)
+		}
+	}
+	return 0
+}
+
 func stringToInt(v string) int {
 	i, _ := strconv.Atoi(v)
 	return i
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAppDiskFreeGB(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+
+	if free := appDiskFreeGB(""); free != 0 {
+		t.Fatalf("expect 0 without report, got %d", free)
+	}
+	if free := appDiskFreeGB("not json"); free != 0 {
+		t.Fatalf("expect 0 on invalid report, got %d", free)
+	}
+
+	disks := `[{"mountpoint":"/","total":100,"free":10,"apps":false},{"mountpoint":"/data","total":1000,"free":53687091200,"apps":true}]`
+	if free := appDiskFreeGB(disks); free != 53687091200/gb {
+		t.Fatalf("expect free of apps mount, got %d", free)
+	}
+
+	if free := appDiskFreeGB(`[{"mountpoint":"/","free":53687091200}]`); free != 0 {
+		t.Fatalf("expect 0 without apps mount, got %d", free)
+	}
+}
+
+func TestIsResourceMatchApp(t *testing.T) {
+	h := &ServerHandler{config: &Config{Resources: map[string]*Resource{
+		"linux-small": {OS: "linux", Arch: "amd64,arm64", MinCPU: 2, MinMemoryMB: 1024, MinDiskGB: 10},
+		"linux-disk":  {OS: "linux", MinCPU: 2, MinAppDiskFreeGB: 50},
+	}}}
+
+	// the query of a node that match linux-small, the pairs override it
+	query := func(pairs ...string) string {
+		values := url.Values{
+			"os":     {"linux"},
+			"arch":   {"amd64"},
+			"cpu":    {"4"},
+			"memory": {"4294967296"},
+			"disk":   {"107374182400"},
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			values.Set(pairs[i], pairs[i+1])
+		}
+		return values.Encode()
+	}
+
+	cases := []struct {
+		name      string
+		query     string
+		resources []string
+		match     bool
+	}{
+		{"match", query(), []string{"linux-small"}, true},
+		{"unknown resource", query(), []string{"unknown"}, false},
+		{"arch", query("arch", "riscv64"), []string{"linux-small"}, false},
+		{"os", query("os", "windows"), []string{"linux-small"}, false},
+		{"cpu", query("cpu", "1"), []string{"linux-small"}, false},
+		{"no disks report", query(), []string{"linux-disk"}, false},
+		{"app disk too small", query("disks", `[{"free":10737418240,"apps":true}]`), []string{"linux-disk"}, false},
+		{"app disk", query("disks", `[{"free":107374182400,"apps":true}]`), []string{"linux-disk"}, true},
+		{"any resource", query(), []string{"linux-disk", "linux-small"}, true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/config/apps?"+c.query, nil)
+		if match := h.isResourceMatchApp(r, c.resources); match != c.match {
+			t.Fatalf("%s: expect %v, got %v", c.name, c.match, match)
+		}
+	}
+}
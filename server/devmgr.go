@@ -261,6 +261,8 @@ func (dm *DevMgr) updateNodeFromDevice(ctx context.Context, nodeid string, d *De
 		log.Errorf("updateNodeFromDevice redis.SetNode error: %v", err)
 	}
 
+	recordOnlineGap(context.Background(), dm.redis, nodeid, lstAt, rNode.LastActivityTime)
+
 	duration := int(time.Since(lstAt).Seconds())
 	if duration > 0 && !lstAt.IsZero() && duration <= int(maxKeepOnlineInterval.Seconds()) {
 		if err := dm.redis.IncrNodeOnlineDuration(context.Background(), nodeid, duration); err != nil {
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"agent/common"
+	"agent/redis"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultIdentityEvents = 20
+	// the nodes compared on login at most, a hardware shared by more nodes is cloned anyway
+	maxFingerprintCandidates = 200
+)
+
+// checkNodeFingerprint compare the fingerprint reported by login with the known ones.
+// A node that report a different hardware is a clone, the stored fingerprint is kept so that
+// all the clones are found. A new node that report a known hardware is a reinstall
+func (h *ServerHandler) checkNodeFingerprint(ctx context.Context, nodeid string, fp common.Fingerprint) error {
+	stored, err := h.redis.GetNodeFingerprint(ctx, nodeid)
+	if err != nil {
+		return err
+	}
+
+	if stored != nil {
+		if _, differ := stored.Compare(fp); differ > 1 {
+			log.Warnf("node %s fingerprint %s differ from %s, may be cloned", nodeid, fp.String(), stored.String())
+			return h.redis.AddNodeIdentityEvent(ctx, &redis.NodeIdentityEvent{
+				Type:        redis.NodeIdentityClone,
+				NodeID:      nodeid,
+				Fingerprint: fp.String(),
+				Time:        time.Now().Unix(),
+			})
+		}
+
+		if stored.String() == fp.String() {
+			return nil
+		}
+		// a single component changed, follow the hardware
+		return h.redis.SetNodeFingerprint(ctx, nodeid, fp, stored)
+	}
+
+	nodes, err := h.redis.GetFingerprintNodes(ctx, fp)
+	if err != nil {
+		return err
+	}
+
+	candidates := make([]string, 0, len(nodes))
+	for _, other := range nodes {
+		if other != nodeid {
+			candidates = append(candidates, other)
+		}
+	}
+	if len(candidates) > maxFingerprintCandidates {
+		log.Warnf("node %s fingerprint %s is shared by %d nodes, only %d are compared", nodeid, fp.String(), len(candidates), maxFingerprintCandidates)
+		candidates = candidates[:maxFingerprintCandidates]
+	}
+
+	fps, err := h.redis.GetNodeFingerprints(ctx, candidates)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range candidates {
+		otherFp := fps[other]
+		if otherFp == nil || !otherFp.Match(fp) {
+			continue
+		}
+
+		log.Warnf("node %s has the same hardware as node %s, may be reinstalled", nodeid, other)
+		if err := h.redis.AddNodeIdentityEvent(ctx, &redis.NodeIdentityEvent{
+			Type:          redis.NodeIdentityReinstall,
+			NodeID:        nodeid,
+			RelatedNodeID: other,
+			Fingerprint:   fp.String(),
+			Time:          time.Now().Unix(),
+		}); err != nil {
+			return err
+		}
+		break
+	}
+
+	return h.redis.SetNodeFingerprint(ctx, nodeid, fp, nil)
+}
+
+// handleGetIdentityEvents return the suspected clone and reinstall events of node
+func (h *ServerHandler) handleGetIdentityEvents(w http.ResponseWriter, r *http.Request) {
+	nodeid := r.URL.Query().Get("node_id")
+	if nodeid == "" {
+		apiResultErr(w, "node_id can not be empty")
+		return
+	}
+
+	limit := stringToInt(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = defaultIdentityEvents
+	}
+
+	events, err := h.redis.GetNodeIdentityEvents(r.Context(), nodeid, limit)
+	if err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: events}); err != nil {
+		log.Error("ServerHandler.handleGetIdentityEvents, Encode: ", err.Error())
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"crypto/rsa"
 
@@ -28,14 +30,41 @@ type ServerHandler struct {
 	devMgr *DevMgr
 	redis  *redis.Redis
 	auth   *auth
+	// the control channels of nodes connected to this server
+	control *controlHub
+	// unix time of last pruning of the diagnostics bundles
+	diagPrunedAt atomic.Int64
 	// authenticate func
 }
 
 // type tokenPayload struct {
 // }
 
+const (
+	// the default lifetime of node token
+	defaultTokenLifetime = 24 * time.Hour
+	// the lifetime of token for the old controllers that never login again,
+	// they have to keep working until the fleet is upgraded
+	defaultLegacyTokenLifetime = 365 * 24 * time.Hour
+	// tolerate the clock difference of servers on nbf and iat
+	tokenClockSkew = time.Minute
+)
+
 type auth struct {
-	apiSecret *jwt.HMACSHA
+	apiSecret      *jwt.HMACSHA
+	lifetime       time.Duration
+	legacyLifetime time.Duration
+	// accept the legacy tokens that have no exp until the cutoff, zero cutoff accept them forever
+	acceptWithoutExp bool
+	withoutExpCutoff time.Time
+}
+
+// acceptTokenWithoutExp check if the legacy token without exp is accepted at now
+func (a *auth) acceptTokenWithoutExp(now time.Time) bool {
+	if !a.acceptWithoutExp {
+		return false
+	}
+	return a.withoutExpCutoff.IsZero() || now.Before(a.withoutExpCutoff)
 }
 
 func (a *auth) proxy(next http.HandlerFunc) http.HandlerFunc {
@@ -53,8 +82,10 @@ func (a *auth) proxy(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		var payload common.JwtPayload
-		if _, err := jwt.Verify([]byte(token), a.apiSecret, &payload); err != nil {
+		if _, err := jwt.Verify([]byte(token), a.apiSecret, &payload, jwt.ValidatePayload(&payload.Payload, a.validators()...)); err != nil {
 			log.Errorf("jwt.Verify: %v", err)
+			// node login again on invalid token
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -108,12 +139,65 @@ func parseTokenFromRequestContext(ctx context.Context) (*common.JwtPayload, erro
 	return &payload, nil
 }
 
-func (a *auth) sign(p common.JwtPayload) ([]byte, error) {
+func (a *auth) validators() []jwt.Validator {
+	now := time.Now()
+	validators := []jwt.Validator{jwt.NotBeforeValidator(now.Add(tokenClockSkew)), jwt.IssuedAtValidator(now.Add(tokenClockSkew))}
+
+	exp := jwt.ExpirationTimeValidator(now)
+	validators = append(validators, func(pl *jwt.Payload) error {
+		if pl.ExpirationTime == nil && a.acceptTokenWithoutExp(now) {
+			return nil
+		}
+		return exp(pl)
+	})
+	return validators
+}
+
+// sign issue the token that valid for lifetime since now. The controller that can not
+// login again on 401 get the token of legacy lifetime
+func (a *auth) sign(p common.JwtPayload, relogin bool) ([]byte, error) {
+	lifetime := a.lifetime
+	if !relogin {
+		lifetime = a.legacyLifetime
+	}
+
+	now := time.Now()
+	p.IssuedAt = jwt.NumericDate(now)
+	p.NotBefore = jwt.NumericDate(now)
+	p.ExpirationTime = jwt.NumericDate(now.Add(lifetime))
 	return jwt.Sign(p, a.apiSecret)
 }
 
 func newServerHandler(config *Config, devMgr *DevMgr, redis *redis.Redis, authApiSecret *jwt.HMACSHA) *ServerHandler {
-	return &ServerHandler{config: config, devMgr: devMgr, redis: redis, auth: &auth{apiSecret: authApiSecret}}
+	lifetime := defaultTokenLifetime
+	if config.TokenLifetime > 0 {
+		lifetime = time.Duration(config.TokenLifetime) * time.Second
+	}
+
+	legacyLifetime := defaultLegacyTokenLifetime
+	if config.LegacyTokenLifetime > 0 {
+		legacyLifetime = time.Duration(config.LegacyTokenLifetime) * time.Second
+	}
+
+	// the tokens signed before the upgrade have no exp, accept them unless disabled
+	acceptWithoutExp := config.AcceptTokenWithoutExp == nil || *config.AcceptTokenWithoutExp
+	var withoutExpCutoff time.Time
+	if len(config.TokenWithoutExpCutoff) > 0 {
+		cutoff, err := time.Parse(time.RFC3339, config.TokenWithoutExpCutoff)
+		if err != nil {
+			log.Errorf("invalid tokenWithoutExpCutoff %s, accept the tokens without exp: %v", config.TokenWithoutExpCutoff, err)
+		}
+		withoutExpCutoff = cutoff
+	}
+
+	auth := &auth{
+		apiSecret:        authApiSecret,
+		lifetime:         lifetime,
+		legacyLifetime:   legacyLifetime,
+		acceptWithoutExp: acceptWithoutExp,
+		withoutExpCutoff: withoutExpCutoff,
+	}
+	return &ServerHandler{config: config, devMgr: devMgr, redis: redis, auth: auth, control: newControlHub()}
 }
 
 func (h *ServerHandler) handleAgentList(w http.ResponseWriter, r *http.Request) {
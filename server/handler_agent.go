@@ -139,3 +139,37 @@ func (h *ServerHandler) handleGetControllerConfig(w http.ResponseWriter, r *http
 
 	w.Write(buf)
 }
+
+// handleAgentUpdate return the agent binary for self update, arch match version first
+func (h *ServerHandler) handleAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	log.Infof("handleAgentUpdate, queryString %s\n", r.URL.RawQuery)
+	os := r.URL.Query().Get("os")
+	arch := r.URL.Query().Get("arch")
+
+	var file *FileConfig = nil
+	for _, f := range h.config.AgentFileList {
+		if f.OS != os {
+			continue
+		}
+
+		if f.Tag == "" && file == nil {
+			file = f
+		} else if f.Tag != "" && arch != "" && strings.Contains(f.Tag, arch) {
+			file = f
+			break
+		}
+	}
+
+	if file == nil {
+		resultError(w, http.StatusBadRequest, fmt.Sprintf("can not find the os %s agent", os))
+		return
+	}
+
+	buf, err := json.Marshal(file)
+	if err != nil {
+		resultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Write(buf)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAppLogLines = 200
+	// the logs uploaded by node can not bigger than this
+	maxAppLogsSize = 4 << 20
+)
+
+// handlePushAppLogs receive the app logs that node upload by request
+func (h *ServerHandler) handlePushAppLogs(w http.ResponseWriter, r *http.Request) {
+	payload, err := parseTokenFromRequestContext(r.Context())
+	if err != nil {
+		resultError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	appName := r.URL.Query().Get("app")
+	if appName == "" {
+		resultError(w, http.StatusBadRequest, "app can not be empty")
+		return
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxAppLogsSize))
+	if err != nil {
+		log.Error("ServerHandler.handlePushAppLogs read body failed: ", err.Error())
+		resultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.redis.SetNodeAppLogs(r.Context(), payload.NodeID, appName, string(b)); err != nil {
+		log.Error("ServerHandler.handlePushAppLogs SetNodeAppLogs failed: ", err.Error())
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// handleGetAppLogs return the last uploaded logs of app, and ask node to upload again.
+// node will upload the logs after next metrics push
+func (h *ServerHandler) handleGetAppLogs(w http.ResponseWriter, r *http.Request) {
+	nodeid := r.URL.Query().Get("node_id")
+	appName := r.URL.Query().Get("app")
+	if nodeid == "" || appName == "" {
+		apiResultErr(w, "node_id and app can not be empty")
+		return
+	}
+
+	lines := stringToInt(r.URL.Query().Get("lines"))
+	if lines <= 0 {
+		lines = defaultAppLogLines
+	}
+
+	if err := h.redis.RequestNodeAppLogs(r.Context(), nodeid, appName, lines); err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	logs, err := h.redis.GetNodeAppLogs(r.Context(), nodeid, appName)
+	if err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	type AppLogsRet struct {
+		Logs      string `json:"logs"`
+		UpdatedAt int64  `json:"updatedAt"`
+		Pending   bool   `json:"pending"`
+	}
+
+	ret := AppLogsRet{Pending: true}
+	if logs != nil {
+		ret.Logs = logs.Logs
+		ret.UpdatedAt = logs.UpdatedAt.Unix()
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: ret}); err != nil {
+		log.Error("ServerHandler.handleGetAppLogs, Encode: ", err.Error())
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"agent/common"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the controller ping in 30s, the channel is closed if nothing read in controlReadWait
+	controlReadWait  = 90 * time.Second
+	controlWriteWait = 10 * time.Second
+	// the default time to wait the result of command
+	defaultControlTimeout = 30 * time.Second
+	maxControlTimeout     = 5 * time.Minute
+	maxControlMessage     = 8 << 20
+)
+
+var controlUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// controlNode the control channel of a node, the commands wait their results in pending
+type controlNode struct {
+	nodeID      string
+	ws          *websocket.Conn
+	connectTime time.Time
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan *common.ControlMessage
+}
+
+func (cn *controlNode) write(msg *common.ControlMessage) error {
+	cn.writeMu.Lock()
+	defer cn.writeMu.Unlock()
+
+	cn.ws.SetWriteDeadline(time.Now().Add(controlWriteWait))
+	return cn.ws.WriteJSON(msg)
+}
+
+// call send the command and wait its result
+func (cn *controlNode) call(ctx context.Context, cmd *common.ControlMessage) (*common.ControlMessage, error) {
+	ch := make(chan *common.ControlMessage, 1)
+
+	cn.mu.Lock()
+	cn.pending[cmd.ID] = ch
+	cn.mu.Unlock()
+
+	defer func() {
+		cn.mu.Lock()
+		delete(cn.pending, cmd.ID)
+		cn.mu.Unlock()
+	}()
+
+	if err := cn.write(cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("node %s control channel closed", cn.nodeID)
+		}
+		return result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cn *controlNode) dispatch(result *common.ControlMessage) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	if ch, ok := cn.pending[result.ID]; ok {
+		ch <- result
+		delete(cn.pending, result.ID)
+	}
+}
+
+// close fail the commands wait results
+func (cn *controlNode) close() {
+	cn.ws.Close()
+
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	for id, ch := range cn.pending {
+		close(ch)
+		delete(cn.pending, id)
+	}
+}
+
+// controlHub the control channels connected to this server, the nodes connected to other
+// server instances are not reachable, the caller fall back to polling
+type controlHub struct {
+	mu    sync.Mutex
+	nodes map[string]*controlNode
+}
+
+func newControlHub() *controlHub {
+	return &controlHub{nodes: make(map[string]*controlNode)}
+}
+
+// add register the channel, the old channel of the same node is closed
+func (hub *controlHub) add(cn *controlNode) {
+	hub.mu.Lock()
+	old := hub.nodes[cn.nodeID]
+	hub.nodes[cn.nodeID] = cn
+	hub.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+func (hub *controlHub) remove(cn *controlNode) {
+	hub.mu.Lock()
+	if hub.nodes[cn.nodeID] == cn {
+		delete(hub.nodes, cn.nodeID)
+	}
+	hub.mu.Unlock()
+
+	cn.close()
+}
+
+func (hub *controlHub) get(nodeID string) *controlNode {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	return hub.nodes[nodeID]
+}
+
+func (hub *controlHub) list() []*controlNode {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	nodes := make([]*controlNode, 0, len(hub.nodes))
+	for _, cn := range hub.nodes {
+		nodes = append(nodes, cn)
+	}
+	return nodes
+}
+
+// Send push the command to node and wait the result
+func (hub *controlHub) Send(ctx context.Context, nodeID, command string, args map[string]string) (*common.ControlMessage, error) {
+	cn := hub.get(nodeID)
+	if cn == nil {
+		return nil, fmt.Errorf("node %s control channel not connected", nodeID)
+	}
+
+	cmd := &common.ControlMessage{ID: uuid.NewString(), Type: common.ControlTypeCommand, Command: command, Args: args}
+	return cn.call(ctx, cmd)
+}
+
+// handleControlWs accept the control channel from controller, it is kept until either side close
+func (h *ServerHandler) handleControlWs(w http.ResponseWriter, r *http.Request) {
+	payload, err := parseTokenFromRequestContext(r.Context())
+	if err != nil {
+		resultError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if payload.NodeID == "" {
+		resultError(w, http.StatusBadRequest, "node id not found")
+		return
+	}
+
+	ws, err := controlUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("ServerHandler.handleControlWs upgrade failed: %s", err.Error())
+		return
+	}
+
+	cn := &controlNode{nodeID: payload.NodeID, ws: ws, connectTime: time.Now(), pending: make(map[string]chan *common.ControlMessage)}
+	h.control.add(cn)
+	defer h.control.remove(cn)
+
+	log.Infof("node %s control channel connected from %s", cn.nodeID, r.RemoteAddr)
+
+	ws.SetReadLimit(maxControlMessage)
+	ws.SetReadDeadline(time.Now().Add(controlReadWait))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(controlReadWait))
+
+		cn.writeMu.Lock()
+		defer cn.writeMu.Unlock()
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(controlWriteWait))
+	})
+
+	for {
+		msg := &common.ControlMessage{}
+		if err := ws.ReadJSON(msg); err != nil {
+			log.Infof("node %s control channel closed: %s", cn.nodeID, err.Error())
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(controlReadWait))
+
+		if msg.Type != common.ControlTypeResult {
+			log.Warnf("node %s control channel ignore message type %s", cn.nodeID, msg.Type)
+			continue
+		}
+		cn.dispatch(msg)
+	}
+}
+
+// controlCommandTimeout the default time to wait the result of command
+func controlCommandTimeout(command string) time.Duration {
+	if command == common.ControlCmdDiag {
+		return diagControlTimeout
+	}
+	return defaultControlTimeout
+}
+
+// handleControlCommand push a command to node over control channel and return its result
+func (h *ServerHandler) handleControlCommand(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	nodeid := query.Get("node_id")
+	if nodeid == "" {
+		apiResultErr(w, "node_id can not be empty")
+		return
+	}
+
+	command := query.Get("command")
+	switch command {
+	case common.ControlCmdRefresh, common.ControlCmdStatus, common.ControlCmdDiag:
+	case common.ControlCmdRestart:
+		if query.Get("app") == "" {
+			apiResultErr(w, "app can not be empty")
+			return
+		}
+	default:
+		apiResultErr(w, fmt.Sprintf("unsupported command %s", command))
+		return
+	}
+
+	timeout := controlCommandTimeout(command)
+	if seconds := stringToInt(query.Get("timeout")); seconds > 0 {
+		timeout = min(time.Duration(seconds)*time.Second, maxControlTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	var args map[string]string
+	if app := query.Get("app"); app != "" {
+		args = map[string]string{"app": app}
+	}
+	if command == common.ControlCmdDiag {
+		args = map[string]string{"logMB": strconv.Itoa(diagLogMB(query.Get("logMB")))}
+	}
+
+	result, err := h.control.Send(ctx, nodeid, command, args)
+	if err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	if result.Error != "" {
+		apiResultErr(w, result.Error)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: result.Data}); err != nil {
+		log.Error("ServerHandler.handleControlCommand, Encode: ", err.Error())
+	}
+}
+
+// handleGetControlNodes return the nodes that have control channel connected to this server
+func (h *ServerHandler) handleGetControlNodes(w http.ResponseWriter, r *http.Request) {
+	type controlNodeInfo struct {
+		NodeID      string `json:"nodeID"`
+		ConnectTime int64  `json:"connectTime"`
+	}
+
+	nodes := make([]controlNodeInfo, 0)
+	for _, cn := range h.control.list() {
+		nodes = append(nodes, controlNodeInfo{NodeID: cn.nodeID, ConnectTime: cn.connectTime.Unix()})
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: nodes}); err != nil {
+		log.Error("ServerHandler.handleGetControlNodes, Encode: ", err.Error())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"agent/redis/metrics"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
@@ -22,6 +23,7 @@ import (
 
 	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
 	"github.com/jinzhu/copier"
+	goredis "github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -213,7 +215,10 @@ func (h *ServerHandler) handleGetAppsConfig(w http.ResponseWriter, r *http.Reque
 		appList = filteredAppList
 	}
 
-	// usually (matched + extra - removed) or (specified + extra - removed)
+	// the apps suspended by kill switch
+	appList = h.filterSuspendedApps(r, payload.NodeID, d, appList)
+
+	// usually (matched + extra - removed - suspended) or (specified + extra - removed - suspended)
 	appListStr, _ := json.Marshal(appList)
 	log.Infof("GetAppList node: %s, os: %s, channel: %s, apps: %s", payload.NodeID, r.URL.Query().Get("os"), channel, appListStr)
 
@@ -369,9 +374,14 @@ func (h *ServerHandler) isResourceMatchApp(r *http.Request, reqResources []strin
 			continue
 		}
 
-		if reqRes.OS == os && cpu >= reqRes.MinCPU && memoryMB >= reqRes.MinMemoryMB && diskGB >= reqRes.MinDiskGB {
-			return true
+		if reqRes.OS != os || cpu < reqRes.MinCPU || memoryMB < reqRes.MinMemoryMB || diskGB < reqRes.MinDiskGB {
+			continue
+		}
+
+		if reqRes.MinAppDiskFreeGB > 0 && appDiskFreeGB(r.URL.Query().Get("disks")) < reqRes.MinAppDiskFreeGB {
+			continue
 		}
+		return true
 	}
 	return false
 }
@@ -688,13 +698,27 @@ func (h *ServerHandler) HandleNodeLogin(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// the old agents do not report fingerprint
+	if fingerprint := r.URL.Query().Get("fingerprint"); len(fingerprint) > 0 {
+		fp, err := common.ParseFingerprint(fingerprint)
+		if err != nil {
+			resultError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := h.checkNodeFingerprint(r.Context(), nodeid, fp); err != nil {
+			log.Errorf("HandleNodeLogin check fingerprint of %s failed: %s", nodeid, err.Error())
+		}
+	}
+
 	payload := common.JwtPayload{
 		NodeID: nodeid,
 	}
 
 	w.Header().Set("Web-Server", h.config.WebServer)
 
-	tk, err := h.auth.sign(payload)
+	// the controller that login again on 401 tell it by relogin
+	tk, err := h.auth.sign(payload, r.URL.Query().Get("relogin") == "true")
 	if err != nil {
 		resultError(w, http.StatusBadRequest, fmt.Sprintf("sign jwt token failed: %s", err.Error()))
 		return
@@ -731,6 +755,7 @@ type NodeKeepaliveDeviceInfo struct {
 	TotalDisk int64  `json:"totalDisk"`
 	FreeDisk  int64  `json:"freeDisk"`
 	DiskModel string `json:"diskModel"`
+	Disks     string `json:"disks"`
 
 	NetIRate float64 `json:"netIRate"`
 	NetORate float64 `json:"netORate"`
@@ -804,6 +829,8 @@ func (h *ServerHandler) HandleNodeKeepalive(w http.ResponseWriter, r *http.Reque
 	}
 
 	// SetNode
+	recordOnlineGap(r.Context(), h.redis, node.ID, lastActivityTime, time.Now())
+
 	duration := int(time.Since(lastActivityTime).Seconds())
 	if duration > 0 && !lastActivityTime.IsZero() && duration <= int(maxKeepOnlineInterval.Seconds()) {
 		if err := h.redis.IncrNodeOnlineDuration(r.Context(), node.ID, duration); err != nil {
@@ -823,7 +850,7 @@ func (h *ServerHandler) HandleNodeKeepalive(w http.ResponseWriter, r *http.Reque
 	}
 
 	// SetNodeApps
-	if err := h.updateNodeApps(payload.NodeID, req.Apps); err != nil {
+	if err := h.updateNodeApps(payload.NodeID, req.Apps, time.Now()); err != nil {
 		log.Error("ServerHandler.handlePushMetrics update nodes app failed:", err.Error())
 	}
 
@@ -863,11 +890,36 @@ func (h *ServerHandler) HandleNodeGetConfig(w http.ResponseWriter, r *http.Reque
 	w.Write([]byte(cfg))
 }
 
+const (
+	// the headers that identify a metrics report
+	metricsEpochHeader = "X-Metrics-Epoch"
+	metricsSeqHeader   = "X-Metrics-Seq"
+	metricsTimeHeader  = "X-Metrics-Time"
+	// the reports older than this are replayed from node spool
+	replayedMetricsAge = 5 * time.Minute
+	maxMetricsBodySize = 16 << 20
+)
+
+// readMetricsBody read the metrics report, it is gzip compressed by the new nodes
+func readMetricsBody(r *http.Request) ([]byte, error) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	}
+
+	return io.ReadAll(io.LimitReader(reader, maxMetricsBodySize))
+}
+
 func (h *ServerHandler) handlePushMetrics(w http.ResponseWriter, r *http.Request) {
 	payload, _ := parseTokenFromRequestContext(r.Context())
 	// uuid := r.URL.Query().Get("uuid")
 
-	b, err := io.ReadAll(r.Body)
+	b, err := readMetricsBody(r)
 	if err != nil {
 		log.Error("ServerHandler.handlePushMetrics read body failed: ", err.Error())
 		resultError(w, http.StatusBadRequest, err.Error())
@@ -889,17 +941,84 @@ func (h *ServerHandler) handlePushMetrics(w http.ResponseWriter, r *http.Request
 	}
 	log.Infof("[PushMetrics] NodeID:%s, apps: %v, body: %s", payload.NodeID, apps, string(b))
 
-	if err := h.updateNodeApps(payload.NodeID, apps); err != nil {
+	// the reports replayed by node are deduped by epoch and seq, the old nodes send without them
+	reportTime := time.Now()
+	revertSeq := func() {}
+	if epoch, seqStr := r.Header.Get(metricsEpochHeader), r.Header.Get(metricsSeqHeader); epoch != "" && seqStr != "" {
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			resultError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s %s", metricsSeqHeader, seqStr))
+			return
+		}
+
+		isNew, prev, err := h.redis.CheckNodeMetricsSeq(r.Context(), payload.NodeID, epoch, seq)
+		if err != nil {
+			log.Error("ServerHandler.handlePushMetrics CheckNodeMetricsSeq failed:", err.Error())
+		} else if !isNew {
+			log.Infof("[PushMetrics] NodeID:%s, duplicate report %s/%d", payload.NodeID, epoch, seq)
+			return
+		} else {
+			// the report is not processed, so the retry of node is not a duplicate
+			revertSeq = func() {
+				if err := h.redis.RevertNodeMetricsSeq(context.Background(), payload.NodeID, epoch, seq, prev); err != nil {
+					log.Error("ServerHandler.handlePushMetrics RevertNodeMetricsSeq failed:", err.Error())
+				}
+			}
+		}
+
+		if t, err := strconv.ParseInt(r.Header.Get(metricsTimeHeader), 10, 64); err == nil && t > 0 && t < reportTime.Unix() {
+			reportTime = time.Unix(t, 0)
+		}
+	}
+
+	// the state of node is decided by the latest report, replayed reports only fill the app activity
+	// and the online credit of the time they are collected
+	replayed := time.Since(reportTime) > replayedMetricsAge
+
+	// check the node before any change, so the report can be retried as a whole
+	var node *redis.Node
+	if !replayed {
+		node, err = h.redis.GetNode(r.Context(), payload.NodeID)
+		if err == goredis.Nil {
+			revertSeq()
+			resultError(w, http.StatusBadRequest, fmt.Sprintf("node %s not exist", payload.NodeID))
+			return
+		}
+		if err != nil {
+			// node retry the report later
+			revertSeq()
+			log.Error("ServerHandler.handlePushMetrics get node failed:", err.Error())
+			resultError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+	}
+
+	// ask node to upload the app logs requested by api
+	if logsReq, err := h.redis.GetNodeAppLogsRequest(r.Context(), payload.NodeID); err != nil {
+		log.Error("ServerHandler.handlePushMetrics GetNodeAppLogsRequest failed:", err.Error())
+	} else if logsReq != "" {
+		w.Header().Set("Upload-App-Logs", logsReq)
+	}
+
+	// ask node to upload the diagnostics bundle requested by api
+	if logMB, err := h.redis.GetNodeDiagRequest(r.Context(), payload.NodeID); err != nil {
+		log.Error("ServerHandler.handlePushMetrics GetNodeDiagRequest failed:", err.Error())
+	} else if logMB > 0 {
+		w.Header().Set("Upload-Diag", strconv.Itoa(logMB))
+	}
+
+	if err := h.updateNodeApps(payload.NodeID, apps, reportTime); err != nil {
 		log.Error("ServerHandler.handlePushMetrics update nodes app failed:", err.Error())
 	}
 
-	node, err := h.redis.GetNode(r.Context(), payload.NodeID)
-	if err != nil {
-		log.Error("ServerHandler.handlePushMetrics get node failed:", err.Error())
-		resultError(w, http.StatusBadRequest, err.Error())
+	if replayed {
+		log.Infof("[PushMetrics] NodeID:%s, replayed report of %s", payload.NodeID, reportTime.Format(time.RFC3339))
+		h.fillOnlineGap(r.Context(), payload.NodeID, reportTime)
 		return
 	}
 
+	h.updateSuspensionCompliance(r.Context(), payload.NodeID, apps)
+
 	if node.NodeIsAndroidApp() {
 		if err := h.registAndroidApp(r.Context(), payload.NodeID, apps); err != nil {
 			log.Error("ServerHandler.handlePushMetrics regist android app failed:", err.Error())
@@ -984,11 +1103,97 @@ func (h *ServerHandler) registAndroidApp(ctx context.Context, nodeID string, app
 // 4. 保存当前的所有app
 
 // ------- 覆盖全部的指标信息 ------------------
-func (h *ServerHandler) updateNodeApps(nodeID string, apps []*App) error {
+// olderNodeApps return the apps that have no state newer than reportTime
+func (h *ServerHandler) olderNodeApps(nodeID string, nodeApps []*redis.NodeApp, reportTime time.Time) []*redis.NodeApp {
+	appNames := make([]string, 0, len(nodeApps))
+	for _, app := range nodeApps {
+		appNames = append(appNames, app.AppName)
+	}
+
+	current, err := h.redis.GetNodeApps(context.Background(), nodeID, appNames)
+	if err != nil {
+		log.Errorf("ServerHandler.olderNodeApps GetNodeApps: %v", err)
+		return nodeApps
+	}
+
+	result := make([]*redis.NodeApp, 0, len(nodeApps))
+	for i, app := range nodeApps {
+		if i < len(current) && current[i].LastActivityTime.After(reportTime) {
+			continue
+		}
+		result = append(result, app)
+	}
+	return result
+}
+
+// recordOnlineGap record the time node was not seen if it is too long to credit, the replayed
+// metrics reports of node fill it
+func recordOnlineGap(ctx context.Context, r *redis.Redis, nodeid string, from, to time.Time) {
+	if from.IsZero() || to.Sub(from) <= maxKeepOnlineInterval {
+		return
+	}
+
+	tail, err := r.SetNodeOnlineGap(ctx, nodeid, from, to, maxKeepOnlineInterval)
+	if err != nil {
+		log.Errorf("recordOnlineGap SetNodeOnlineGap: %v", err)
+		return
+	}
+
+	if tail > 0 {
+		if err := r.IncrNodeOnlineDurationAt(ctx, nodeid, tail, to); err != nil {
+			log.Errorf("recordOnlineGap IncrNodeOnlineDurationAt: %v", err)
+		}
+	}
+}
+
+// fillOnlineGap credit the online time of the replayed report in the gap that node was not seen
+func (h *ServerHandler) fillOnlineGap(ctx context.Context, nodeid string, reportTime time.Time) {
+	node, err := h.redis.GetNode(ctx, nodeid)
+	if err != nil {
+		log.Errorf("ServerHandler.fillOnlineGap GetNode: %v", err)
+		return
+	}
+
+	seconds, err := h.redis.FillNodeOnlineGap(ctx, nodeid, reportTime, node.LastActivityTime, maxKeepOnlineInterval)
+	if err != nil {
+		log.Errorf("ServerHandler.fillOnlineGap FillNodeOnlineGap: %v", err)
+		return
+	}
+
+	if seconds > 0 {
+		if err := h.redis.IncrNodeOnlineDurationAt(ctx, nodeid, seconds, reportTime); err != nil {
+			log.Errorf("ServerHandler.fillOnlineGap IncrNodeOnlineDurationAt: %v", err)
+		}
+	}
+}
+
+func (h *ServerHandler) updateNodeApps(nodeID string, apps []*App, reportTime time.Time) error {
 	nodeApps := make([]*redis.NodeApp, 0, len(apps))
 	for _, app := range apps {
 		if app.AppName != "" {
-			nodeApps = append(nodeApps, &redis.NodeApp{AppName: app.AppName, MD5: app.ScriptMD5, Metric: app.Metric})
+			nodeApp := &redis.NodeApp{AppName: app.AppName, MD5: app.ScriptMD5, Metric: app.Metric, LastActivityTime: reportTime}
+			nodeApp.State = app.State
+			nodeApp.StateSince = app.StateSince
+			nodeApp.StateReason = app.StateReason
+			if len(app.Transitions) > 0 {
+				if b, err := json.Marshal(app.Transitions); err == nil {
+					nodeApp.Transitions = string(b)
+				}
+			}
+			if len(app.Health) > 0 {
+				if b, err := json.Marshal(app.Health); err == nil {
+					nodeApp.Health = string(b)
+				}
+			}
+			if app.Usage != nil {
+				nodeApp.CPUSeconds = app.Usage.CPUSeconds
+				nodeApp.RSSBytes = app.Usage.RSSBytes
+				nodeApp.ReadBytes = app.Usage.ReadBytes
+				nodeApp.WriteBytes = app.Usage.WriteBytes
+				nodeApp.NetRxBytes = app.Usage.NetRxBytes
+				nodeApp.NetTxBytes = app.Usage.NetTxBytes
+			}
+			nodeApps = append(nodeApps, nodeApp)
 		}
 	}
 	// appNames, err := h.redis.GetNodeAppList(context.Background(), nodeID)
@@ -1018,6 +1223,11 @@ func (h *ServerHandler) updateNodeApps(nodeID string, apps []*App) error {
 	// 	return err
 	// }
 
+	// the replayed report does not overwrite the newer state of apps
+	if time.Since(reportTime) > replayedMetricsAge {
+		nodeApps = h.olderNodeApps(nodeID, nodeApps, reportTime)
+	}
+
 	if err := h.redis.SetNodeApps(context.Background(), nodeID, nodeApps); err != nil {
 		return err
 	}
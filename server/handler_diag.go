@@ -0,0 +1,224 @@
+package server
+
+import (
+	"agent/common"
+	"agent/redis"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxDiagSize = 32 << 20
+	// the bundles are saved in this dir of working dir if not configured
+	defaultDiagDir = "diag"
+	// the expired bundles are removed at most once in this interval
+	diagPruneInterval = time.Hour
+	// the controller tail the logs in this size, it is capped by controller too
+	defaultDiagLogMB = 2
+	maxDiagLogMB     = 16
+	// wait for the bundle when node is connected by control channel
+	diagControlTimeout = 3 * time.Minute
+)
+
+// handlePushDiag save the diagnostics bundle uploaded by node
+func (h *ServerHandler) handlePushDiag(w http.ResponseWriter, r *http.Request) {
+	payload, err := parseTokenFromRequestContext(r.Context())
+	if err != nil {
+		resultError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxDiagSize+1))
+	if err != nil {
+		log.Error("ServerHandler.handlePushDiag read body failed: ", err.Error())
+		resultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(b) > maxDiagSize {
+		resultError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("bundle exceed %d bytes", maxDiagSize))
+		return
+	}
+
+	if !bytes.HasPrefix(b, []byte("PK")) {
+		resultError(w, http.StatusBadRequest, "bundle is not a zip")
+		return
+	}
+
+	file, err := h.saveDiagBundle(payload.NodeID, b)
+	if err != nil {
+		log.Error("ServerHandler.handlePushDiag saveDiagBundle failed: ", err.Error())
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	diag := &redis.NodeDiag{File: file, Size: int64(len(b)), Reason: r.URL.Query().Get("reason"), UpdatedAt: time.Now()}
+	if err := h.redis.SetNodeDiag(r.Context(), payload.NodeID, diag); err != nil {
+		log.Error("ServerHandler.handlePushDiag SetNodeDiag failed: ", err.Error())
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Infof("[PushDiag] NodeID:%s, size:%d, reason:%s", payload.NodeID, diag.Size, diag.Reason)
+
+	go h.pruneDiagBundles()
+}
+
+func (h *ServerHandler) diagDir() string {
+	if len(h.config.DiagDir) > 0 {
+		return h.config.DiagDir
+	}
+	return defaultDiagDir
+}
+
+// saveDiagBundle write the bundle to diag dir, the last bundle of node is replaced
+func (h *ServerHandler) saveDiagBundle(nodeid string, bundle []byte) (string, error) {
+	if len(nodeid) == 0 || strings.ContainsAny(nodeid, `/\`) || strings.Contains(nodeid, "..") {
+		return "", fmt.Errorf("invalid node id %q", nodeid)
+	}
+
+	dir := h.diagDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	file := nodeid + ".zip"
+	tmp, err := os.CreateTemp(dir, file+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bundle); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, file)); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// pruneDiagBundles remove the bundles that expired in redis
+func (h *ServerHandler) pruneDiagBundles() {
+	last := h.diagPrunedAt.Load()
+	now := time.Now()
+	if now.Sub(time.Unix(last, 0)) < diagPruneInterval || !h.diagPrunedAt.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+
+	entries, err := os.ReadDir(h.diagDir())
+	if err != nil {
+		log.Errorf("ServerHandler.pruneDiagBundles: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < redis.NodeDiagExpireTime {
+			continue
+		}
+		if err := os.Remove(filepath.Join(h.diagDir(), entry.Name())); err != nil {
+			log.Errorf("ServerHandler.pruneDiagBundles: %v", err)
+		}
+	}
+}
+
+// diagLogMB parse the log size of diagnostics bundle, it is defaultDiagLogMB if not set and at most maxDiagLogMB
+func diagLogMB(value string) int {
+	logMB := stringToInt(value)
+	if logMB <= 0 {
+		logMB = defaultDiagLogMB
+	}
+	return min(logMB, maxDiagLogMB)
+}
+
+// handleRequestDiag ask node to upload the diagnostics bundle. The node connected by control channel
+// upload it now, the others upload it after next metrics push
+func (h *ServerHandler) handleRequestDiag(w http.ResponseWriter, r *http.Request) {
+	nodeid := r.URL.Query().Get("node_id")
+	if nodeid == "" {
+		apiResultErr(w, "node_id can not be empty")
+		return
+	}
+
+	logMB := diagLogMB(r.URL.Query().Get("logMB"))
+
+	ctx, cancel := context.WithTimeout(r.Context(), diagControlTimeout)
+	defer cancel()
+
+	result, err := h.control.Send(ctx, nodeid, common.ControlCmdDiag, map[string]string{"logMB": strconv.Itoa(logMB)})
+	if err == nil && result.Error == "" {
+		if err := json.NewEncoder(w).Encode(APIResult{Data: result.Data}); err != nil {
+			log.Error("ServerHandler.handleRequestDiag, Encode: ", err.Error())
+		}
+		return
+	}
+
+	if err == nil {
+		err = fmt.Errorf("%s", result.Error)
+	}
+	log.Infof("ServerHandler.handleRequestDiag node %s over control channel: %v, wait for next metrics push", nodeid, err)
+
+	if err := h.redis.RequestNodeDiag(r.Context(), nodeid, logMB); err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: "requested"}); err != nil {
+		log.Error("ServerHandler.handleRequestDiag, Encode: ", err.Error())
+	}
+}
+
+// handleGetDiag return the last bundle info of node, or the bundle if download=true
+func (h *ServerHandler) handleGetDiag(w http.ResponseWriter, r *http.Request) {
+	nodeid := r.URL.Query().Get("node_id")
+	if nodeid == "" {
+		apiResultErr(w, "node_id can not be empty")
+		return
+	}
+
+	diag, err := h.redis.GetNodeDiag(r.Context(), nodeid)
+	if err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	if diag == nil {
+		apiResultErr(w, fmt.Sprintf("node %s has no diagnostics bundle", nodeid))
+		return
+	}
+
+	if r.URL.Query().Get("download") == "true" {
+		f, err := os.Open(filepath.Join(h.diagDir(), filepath.Base(diag.File)))
+		if err != nil {
+			apiResultErr(w, err.Error())
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=diag-%s-%s.zip", nodeid, diag.UpdatedAt.Format("20060102-150405")))
+		io.Copy(w, f)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: diag}); err != nil {
+		log.Error("ServerHandler.handleGetDiag, Encode: ", err.Error())
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"agent/redis"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveDiagBundle(t *testing.T) {
+	dir := t.TempDir()
+	h := &ServerHandler{config: &Config{DiagDir: dir}}
+
+	file, err := h.saveDiagBundle("node1", []byte("PK1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.saveDiagBundle("node1", []byte("PK2")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "PK2" {
+		t.Fatalf("expect the last bundle, got %q", b)
+	}
+
+	for _, nodeid := range []string{"", "../node1", "a/b", `a\b`} {
+		if _, err := h.saveDiagBundle(nodeid, []byte("PK")); err == nil {
+			t.Fatalf("expect error for node id %q", nodeid)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("expect only the bundle in dir, got %d entries", len(entries))
+	}
+
+	// expired bundle
+	old := time.Now().Add(-redis.NodeDiagExpireTime - time.Hour)
+	os.WriteFile(filepath.Join(dir, "node2.zip"), []byte("PK"), 0600)
+	os.Chtimes(filepath.Join(dir, "node2.zip"), old, old)
+
+	h.pruneDiagBundles()
+	if _, err := os.Stat(filepath.Join(dir, "node2.zip")); !os.IsNotExist(err) {
+		t.Fatal("expired bundle should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+		t.Fatal("bundle should be kept")
+	}
+}
+
+func TestDiagLogMB(t *testing.T) {
+	cases := map[string]int{
+		"":    defaultDiagLogMB,
+		"0":   defaultDiagLogMB,
+		"-1":  defaultDiagLogMB,
+		"abc": defaultDiagLogMB,
+		"4":   4,
+		"100": maxDiagLogMB,
+	}
+	for value, expect := range cases {
+		if got := diagLogMB(value); got != expect {
+			t.Errorf("diagLogMB(%q) = %d, expect %d", value, got, expect)
+		}
+	}
+}
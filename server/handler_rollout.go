@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"agent/redis"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRollouts = 20
+	maxRolloutSize  = 64 << 10
+)
+
+// handlePushRollout receive the outcome of app config change, the new version is committed or reverted by node
+func (h *ServerHandler) handlePushRollout(w http.ResponseWriter, r *http.Request) {
+	payload, err := parseTokenFromRequestContext(r.Context())
+	if err != nil {
+		resultError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxRolloutSize))
+	if err != nil {
+		log.Error("ServerHandler.handlePushRollout read body failed: ", err.Error())
+		resultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rollout := &redis.NodeRollout{}
+	if err := json.Unmarshal(b, rollout); err != nil {
+		resultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if rollout.AppName == "" {
+		resultError(w, http.StatusBadRequest, "appName can not be empty")
+		return
+	}
+
+	if rollout.Result != "committed" {
+		log.Warnf("node %s app %s rollout %s -> %s %s: %s", payload.NodeID, rollout.AppName, rollout.FromMD5, rollout.ToMD5, rollout.Result, rollout.Reason)
+	}
+
+	if err := h.redis.AddNodeRollout(r.Context(), payload.NodeID, rollout); err != nil {
+		log.Error("ServerHandler.handlePushRollout AddNodeRollout failed: ", err.Error())
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// handleGetRollouts return the latest app config rollouts of node
+func (h *ServerHandler) handleGetRollouts(w http.ResponseWriter, r *http.Request) {
+	nodeid := r.URL.Query().Get("node_id")
+	if nodeid == "" {
+		apiResultErr(w, "node_id can not be empty")
+		return
+	}
+
+	limit := stringToInt(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = defaultRollouts
+	}
+
+	rollouts, err := h.redis.GetNodeRollouts(r.Context(), nodeid, limit)
+	if err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: rollouts}); err != nil {
+		log.Error("ServerHandler.handleGetRollouts, Encode: ", err.Error())
+	}
+}
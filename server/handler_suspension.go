@@ -0,0 +1,311 @@
+package server
+
+import (
+	"agent/common"
+	"agent/redis"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the nodes refreshed over control channel at the same time
+	suspensionRefreshConcurrency = 32
+	suspensionRefreshTimeout     = 30 * time.Second
+)
+
+// filterSuspendedApps remove the suspended apps in scope of node. The node that had the app is
+// recorded as notified, the controller remove the app like the other apps not in config
+func (h *ServerHandler) filterSuspendedApps(r *http.Request, nodeid string, d *Device, appList []*AppConfig) []*AppConfig {
+	suspensions, err := h.redis.GetAppSuspensions(r.Context())
+	if err != nil {
+		log.Errorf("ServerHandler.filterSuspendedApps GetAppSuspensions: %v", err)
+		return appList
+	}
+	if len(suspensions) == 0 {
+		return appList
+	}
+
+	var region *string
+	getRegion := func() string {
+		if region == nil {
+			country, _ := getLocationCountry(getClientIP(r))
+			region = &country
+		}
+		return *region
+	}
+
+	suspended := make(map[string]bool)
+	for _, suspension := range suspensions {
+		if suspension.Match(d.Channel, d.Version, getRegion) {
+			suspended[suspension.AppName] = true
+		}
+	}
+	if len(suspended) == 0 {
+		return appList
+	}
+
+	// the apps have been sent to node
+	prevApps, err := h.redis.GetNodeAppList(r.Context(), nodeid)
+	if err != nil {
+		log.Errorf("ServerHandler.filterSuspendedApps GetNodeAppList: %v", err)
+	}
+	for _, appName := range prevApps {
+		if !suspended[appName] {
+			continue
+		}
+
+		compliance, err := h.redis.GetSuspensionCompliance(r.Context(), appName, nodeid)
+		if err != nil {
+			log.Errorf("ServerHandler.filterSuspendedApps GetSuspensionCompliance: %v", err)
+			continue
+		}
+		if compliance != nil {
+			// updated by metrics report
+			continue
+		}
+
+		compliance = &redis.SuspensionCompliance{NodeID: nodeid, State: redis.SuspensionNotified, Time: time.Now().Unix()}
+		if err := h.redis.SetSuspensionCompliance(r.Context(), appName, compliance); err != nil {
+			log.Errorf("ServerHandler.filterSuspendedApps SetSuspensionCompliance: %v", err)
+		}
+	}
+
+	filtered := make([]*AppConfig, 0, len(appList))
+	for _, app := range appList {
+		if suspended[app.AppName] {
+			log.Infof("ServerHandler.filterSuspendedApps app %s is suspended on node %s", app.AppName, nodeid)
+			continue
+		}
+		filtered = append(filtered, app)
+	}
+	return filtered
+}
+
+// updateSuspensionCompliance check if the notified node still run the suspended apps by its report
+func (h *ServerHandler) updateSuspensionCompliance(ctx context.Context, nodeid string, apps []*App) {
+	suspensions, err := h.redis.GetAppSuspensions(ctx)
+	if err != nil {
+		log.Errorf("ServerHandler.updateSuspensionCompliance GetAppSuspensions: %v", err)
+		return
+	}
+
+	running := make(map[string]bool)
+	for _, app := range apps {
+		running[app.AppName] = true
+	}
+
+	for _, suspension := range suspensions {
+		compliance, err := h.redis.GetSuspensionCompliance(ctx, suspension.AppName, nodeid)
+		if err != nil {
+			log.Errorf("ServerHandler.updateSuspensionCompliance GetSuspensionCompliance: %v", err)
+			continue
+		}
+		if compliance == nil {
+			// not in scope, or never run the app
+			continue
+		}
+
+		state := redis.SuspensionStopped
+		if running[suspension.AppName] {
+			state = redis.SuspensionRunning
+		}
+		if state == compliance.State {
+			continue
+		}
+
+		if state == redis.SuspensionRunning {
+			log.Warnf("node %s still run suspended app %s", nodeid, suspension.AppName)
+		}
+
+		compliance.State = state
+		compliance.Time = time.Now().Unix()
+		if err := h.redis.SetSuspensionCompliance(ctx, suspension.AppName, compliance); err != nil {
+			log.Errorf("ServerHandler.updateSuspensionCompliance SetSuspensionCompliance: %v", err)
+		}
+	}
+}
+
+// refreshControlNodes ask the nodes in scope of any suspension and with live control channel
+// to poll app configs now, the other nodes get the change on next poll
+func (h *ServerHandler) refreshControlNodes(reason string, scopes ...*redis.AppSuspension) {
+	nodes := make([]*controlNode, 0)
+	for _, cn := range h.control.list() {
+		if h.inSuspensionScope(cn.nodeID, scopes) {
+			nodes = append(nodes, cn)
+		}
+	}
+	if len(nodes) == 0 {
+		return
+	}
+
+	log.Infof("ServerHandler.refreshControlNodes refresh %d nodes: %s", len(nodes), reason)
+
+	sem := make(chan struct{}, suspensionRefreshConcurrency)
+	var wg sync.WaitGroup
+	for _, cn := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(nodeID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), suspensionRefreshTimeout)
+			defer cancel()
+
+			result, err := h.control.Send(ctx, nodeID, common.ControlCmdRefresh, nil)
+			if err != nil {
+				log.Errorf("ServerHandler.refreshControlNodes node %s: %v", nodeID, err)
+				return
+			}
+			if result.Error != "" {
+				log.Errorf("ServerHandler.refreshControlNodes node %s: %s", nodeID, result.Error)
+			}
+		}(cn.nodeID)
+	}
+	wg.Wait()
+}
+
+// inSuspensionScope check if the node match any of the suspensions, the node without
+// device info is refreshed anyway, the refresh only make it poll earlier
+func (h *ServerHandler) inSuspensionScope(nodeID string, scopes []*redis.AppSuspension) bool {
+	controller := h.devMgr.getController(nodeID)
+	if controller == nil {
+		return true
+	}
+
+	var region *string
+	getRegion := func() string {
+		if region == nil {
+			country, _ := getLocationCountry(controller.IP)
+			region = &country
+		}
+		return *region
+	}
+
+	for _, scope := range scopes {
+		if scope != nil && scope.Match(controller.Channel, controller.Version, getRegion) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSuspendApp suspend the app fleet-wide or in the scope of channel, region and version
+func (h *ServerHandler) handleSuspendApp(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	suspension := &redis.AppSuspension{
+		AppName: query.Get("app"),
+		Channel: query.Get("channel"),
+		Region:  query.Get("region"),
+		Version: query.Get("version"),
+		Reason:  query.Get("reason"),
+		Time:    time.Now().Unix(),
+	}
+
+	if suspension.AppName == "" {
+		apiResultErr(w, "app can not be empty")
+		return
+	}
+
+	// the nodes out of the new scope get the app back
+	prev, err := h.redis.GetAppSuspension(r.Context(), suspension.AppName)
+	if err != nil {
+		log.Errorf("ServerHandler.handleSuspendApp GetAppSuspension: %v", err)
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	if err := h.redis.SetAppSuspension(r.Context(), suspension); err != nil {
+		log.Errorf("ServerHandler.handleSuspendApp SetAppSuspension: %v", err)
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	log.Warnf("app %s suspended, channel: %s, region: %s, version: %s, reason: %s", suspension.AppName, suspension.Channel, suspension.Region, suspension.Version, suspension.Reason)
+	go h.refreshControlNodes("suspend "+suspension.AppName, suspension, prev)
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: suspension}); err != nil {
+		log.Error("ServerHandler.handleSuspendApp, Encode: ", err.Error())
+	}
+}
+
+// handleResumeApp lift the suspension, the nodes get the app again on next poll
+func (h *ServerHandler) handleResumeApp(w http.ResponseWriter, r *http.Request) {
+	appName := r.URL.Query().Get("app")
+	if appName == "" {
+		apiResultErr(w, "app can not be empty")
+		return
+	}
+
+	suspension, err := h.redis.GetAppSuspension(r.Context(), appName)
+	if err != nil {
+		log.Errorf("ServerHandler.handleResumeApp GetAppSuspension: %v", err)
+		apiResultErr(w, err.Error())
+		return
+	}
+	if err := h.redis.DeleteAppSuspension(r.Context(), appName); err != nil {
+		log.Errorf("ServerHandler.handleResumeApp DeleteAppSuspension: %v", err)
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	if suspension != nil {
+		log.Warnf("app %s resumed", appName)
+		go h.refreshControlNodes("resume "+appName, suspension)
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: "success"}); err != nil {
+		log.Error("ServerHandler.handleResumeApp, Encode: ", err.Error())
+	}
+}
+
+// handleGetSuspensions return the suspended apps with the count of nodes in each compliance state,
+// the states of nodes are returned if app is specified
+func (h *ServerHandler) handleGetSuspensions(w http.ResponseWriter, r *http.Request) {
+	type suspensionInfo struct {
+		*redis.AppSuspension
+		Nodes       map[string]int                `json:"nodes"`
+		Compliances []*redis.SuspensionCompliance `json:"compliances,omitempty"`
+	}
+
+	appName := r.URL.Query().Get("app")
+
+	suspensions, err := h.redis.GetAppSuspensions(r.Context())
+	if err != nil {
+		apiResultErr(w, err.Error())
+		return
+	}
+
+	infos := make([]*suspensionInfo, 0, len(suspensions))
+	for _, suspension := range suspensions {
+		if appName != "" && suspension.AppName != appName {
+			continue
+		}
+
+		compliances, err := h.redis.GetSuspensionCompliances(r.Context(), suspension.AppName)
+		if err != nil {
+			apiResultErr(w, err.Error())
+			return
+		}
+
+		info := &suspensionInfo{AppSuspension: suspension, Nodes: make(map[string]int)}
+		for _, compliance := range compliances {
+			info.Nodes[compliance.State]++
+		}
+		if appName != "" {
+			info.Compliances = compliances
+		}
+		infos = append(infos, info)
+	}
+
+	if err := json.NewEncoder(w).Encode(APIResult{Data: infos}); err != nil {
+		log.Error("ServerHandler.handleGetSuspensions, Encode: ", err.Error())
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"agent/common"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestTokenWithoutExp(t *testing.T) {
+	secret := jwt.NewHS256([]byte("secret"))
+
+	// the token signed before the upgrade has no exp
+	legacy, err := jwt.Sign(common.JwtPayload{NodeID: "n1"}, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(config *Config) int {
+		h := newServerHandler(config, nil, nil, secret)
+		req := httptest.NewRequest("GET", "/config/apps", nil)
+		req.Header.Set("Authorization", "Bearer "+string(legacy))
+		w := httptest.NewRecorder()
+		h.auth.proxy(func(w http.ResponseWriter, r *http.Request) {})(w, req)
+		return w.Code
+	}
+
+	disabled := false
+	cases := []struct {
+		name   string
+		config *Config
+		want   int
+	}{
+		{"default", &Config{}, http.StatusOK},
+		{"disabled", &Config{AcceptTokenWithoutExp: &disabled}, http.StatusUnauthorized},
+		{"before cutoff", &Config{TokenWithoutExpCutoff: time.Now().Add(time.Hour).Format(time.RFC3339)}, http.StatusOK},
+		{"after cutoff", &Config{TokenWithoutExpCutoff: time.Now().Add(-time.Hour).Format(time.RFC3339)}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		if got := status(c.config); got != c.want {
+			t.Errorf("%s: expect %d, got %d", c.name, c.want, got)
+		}
+	}
+}
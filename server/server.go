@@ -32,10 +32,12 @@ func NewServer(config *Config) (*Server, error) {
 	s := &Server{routes: make(map[string]http.Handler)}
 	// /update/lua support old agent
 	s.handle("/update/lua", http.HandlerFunc(handler.handleLuaUpdate))
+	s.handle("/update/agent", http.HandlerFunc(handler.handleAgentUpdate))
 	s.handle("/config/lua", http.HandlerFunc(handler.handleGetLuaConfig))
 	s.handle("/config/controller", http.HandlerFunc(handler.handleGetControllerConfig))
 	s.handle("/config/apps", handler.auth.proxy(handler.handleGetAppsConfig))
 	s.handle("/config/ssh", handler.auth.proxy(handler.handleGetWssshConfig))
+	s.handle("/control/ws", handler.auth.proxy(handler.handleControlWs))
 	// s.handle("/ws", handler.auth.proxy(handler.handleGetWssshConfig))
 
 	s.handle("/rds/eval", handler.auth.proxy(handler.handleRdsEval))
@@ -56,9 +58,22 @@ func NewServer(config *Config) (*Server, error) {
 	s.handle("/api/onlineDuration", http.HandlerFunc(handler.handleOnlineDurationByDate))
 	s.handle("/api/setNodeConfigs", http.HandlerFunc(handler.handleSetNodeConfigs))
 	s.handle("/api/getNodeConfigs", http.HandlerFunc(handler.handleGetNodeConfigs))
+	s.handle("/api/applogs", http.HandlerFunc(handler.handleGetAppLogs))
+	s.handle("/api/identityEvents", http.HandlerFunc(handler.handleGetIdentityEvents))
+	s.handle("/api/rollouts", http.HandlerFunc(handler.handleGetRollouts))
+	s.handle("/api/control", http.HandlerFunc(handler.handleControlCommand))
+	s.handle("/api/controlnodes", http.HandlerFunc(handler.handleGetControlNodes))
+	s.handle("/api/suspendapp", http.HandlerFunc(handler.handleSuspendApp))
+	s.handle("/api/resumeapp", http.HandlerFunc(handler.handleResumeApp))
+	s.handle("/api/suspensions", http.HandlerFunc(handler.handleGetSuspensions))
+	s.handle("/api/requestdiag", http.HandlerFunc(handler.handleRequestDiag))
+	s.handle("/api/diag", http.HandlerFunc(handler.handleGetDiag))
 
 	s.handle("/push/metrics", handler.auth.proxy(handler.handlePushMetrics))
 	s.handle("/push/appinfo", handler.auth.proxy(handler.handlePushAppInfo))
+	s.handle("/push/applogs", handler.auth.proxy(handler.handlePushAppLogs))
+	s.handle("/push/rollout", handler.auth.proxy(handler.handlePushRollout))
+	s.handle("/push/diag", handler.auth.proxy(handler.handlePushDiag))
 
 	s.handle("/node/regist", http.HandlerFunc(handler.HandleNodeRegist))
 	s.handle("/node/registWithWallet", http.HandlerFunc(handler.HandleNodeRegistWithWallet))